@@ -0,0 +1,618 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/kubernetes"
+
+	"k8s-ups-drainer/pkg/nodedrainer"
+)
+
+// stateTimeout is how long the status command waits for the broker and the
+// retained controller state by default
+const stateTimeout = 5 * time.Second
+
+func runCommand(name string, args []string) error {
+	switch name {
+	case "status":
+		return runStatus(args)
+	case "drain":
+		return runDrain(args)
+	case "uncordon":
+		return runUncordon(args)
+	case "audit":
+		return runAudit(args)
+	case "simulate":
+		return runSimulate(args)
+	case "validate-config":
+		return runValidateConfig(args)
+	default:
+		return fmt.Errorf("unknown command (available: status, drain, uncordon, audit, simulate, validate-config)")
+	}
+}
+
+// commandStatus is printed by the status command
+type commandStatus struct {
+	// State is the controller state retained on STATE_TOPIC, if available
+	State           *nodedrainer.ControllerState `json:"state,omitempty"`
+	StateError      string                       `json:"stateError,omitempty"`
+	DrainedNodes    []string                     `json:"drainedNodes"`
+	PoweredOffNodes []string                     `json:"poweredOffNodes"`
+}
+
+// runStatus prints the last UPS readings as published by the controller and
+// the nodes currently drained or powered off
+func runStatus(args []string) error {
+	fs := flag.NewFlagSet("status", flag.ExitOnError)
+	asJSON := fs.Bool("json", false, "print the status as JSON")
+	timeout := fs.Duration("timeout", stateTimeout, "how long to wait for the controller state on STATE_TOPIC")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: k8s-ups-drainer status [-json] [-timeout <duration>]")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	drainer, config, err := newOfflineDrainer()
+	if err != nil {
+		return err
+	}
+
+	status := commandStatus{DrainedNodes: []string{}, PoweredOffNodes: []string{}}
+	if status.State, err = readControllerState(config.StateTopic, *timeout); err != nil {
+		status.StateError = err.Error()
+	}
+	drained, err := drainer.GetDrainedNodes()
+	if err != nil {
+		return err
+	}
+	poweredOff, err := drainer.GetPoweredOffNodes()
+	if err != nil {
+		return err
+	}
+	status.DrainedNodes = append(status.DrainedNodes, drained...)
+	status.PoweredOffNodes = append(status.PoweredOffNodes, poweredOff...)
+
+	if *asJSON {
+		return printJSON(status)
+	}
+	printStatus(os.Stdout, &status)
+	return nil
+}
+
+// readControllerState returns the controller state retained on topic
+func readControllerState(topic string, timeout time.Duration) (*nodedrainer.ControllerState, error) {
+	if topic == "" {
+		return nil, fmt.Errorf("STATE_TOPIC is disabled")
+	}
+
+	client := newMQTTClient(fmt.Sprintf("-status-%d", os.Getpid()))
+	token := client.Connect()
+	if !token.WaitTimeout(timeout) {
+		return nil, fmt.Errorf("timed out connecting to MQTT broker")
+	}
+	if token.Error() != nil {
+		return nil, fmt.Errorf("failed to connect to MQTT broker: %w", token.Error())
+	}
+	defer client.Disconnect(250)
+
+	payloads := make(chan []byte, 1)
+	token = client.Subscribe(topic, 1, func(_ mqtt.Client, msg mqtt.Message) {
+		select {
+		case payloads <- msg.Payload():
+		default:
+		}
+	})
+	if token.WaitTimeout(timeout) && token.Error() != nil {
+		return nil, fmt.Errorf("failed to subscribe to %s: %w", topic, token.Error())
+	}
+
+	select {
+	case payload := <-payloads:
+		var state nodedrainer.ControllerState
+		if err := json.Unmarshal(payload, &state); err != nil {
+			return nil, fmt.Errorf("failed to parse state on %s: %w", topic, err)
+		}
+		return &state, nil
+	case <-time.After(timeout):
+		return nil, fmt.Errorf("no state retained on %s", topic)
+	}
+}
+
+func printStatus(w io.Writer, status *commandStatus) {
+	if state := status.State; state != nil {
+		fmt.Fprintf(w, "Controller state updated %s (%s ago)\n", state.Updated.Format(time.RFC3339), time.Since(state.Updated).Round(time.Second))
+		fmt.Fprintf(w, "Stage: %s", state.Stage)
+		if state.Stale {
+			fmt.Fprint(w, " (stale UPS data)")
+		}
+		if state.DryRun {
+			fmt.Fprint(w, " (dry run)")
+		}
+		fmt.Fprintln(w)
+		for _, ups := range state.UPS {
+			name := ups.Name
+			if name == "" {
+				name = "UPS"
+			}
+			fmt.Fprintf(w, "%s: stage=%s", name, ups.Stage)
+			if ups.PendingStage != "" {
+				fmt.Fprintf(w, " pending=%s", ups.PendingStage)
+			}
+			if reading := ups.LastReading; reading != nil {
+				fmt.Fprintf(w, " status=%s battery=%d%%", reading.Status, reading.BatteryLevel)
+				if reading.TimeLeft > 0 {
+					fmt.Fprintf(w, " runtime=%s", time.Duration(reading.TimeLeft*float64(time.Minute)).Round(time.Second))
+				}
+			}
+			if ups.LastReadingTime != nil {
+				fmt.Fprintf(w, " received=%s", ups.LastReadingTime.Format(time.RFC3339))
+			}
+			if ups.OnBatterySince != nil {
+				fmt.Fprintf(w, " onBatterySince=%s", ups.OnBatterySince.Format(time.RFC3339))
+			}
+			fmt.Fprintln(w)
+		}
+		for _, override := range state.Overrides {
+			fmt.Fprintf(w, "Override: %s\n", override.String())
+		}
+		if len(state.PendingEvictions) > 0 {
+			fmt.Fprintf(w, "Pending evictions: %s\n", strings.Join(state.PendingEvictions, ", "))
+		}
+		if action := state.LastAction; action != nil {
+			fmt.Fprintf(w, "Last action: %s %s %s %s\n", action.Time.Format(time.RFC3339), action.Action, action.Target, action.Message)
+		}
+		if action := state.LastError; action != nil {
+			fmt.Fprintf(w, "Last error: %s %s %s: %s\n", action.Time.Format(time.RFC3339), action.Action, action.Target, action.Error)
+		}
+	} else {
+		fmt.Fprintf(w, "Controller state unavailable: %s\n", status.StateError)
+	}
+
+	fmt.Fprintf(w, "Drained nodes: %s\n", listOrNone(status.DrainedNodes))
+	fmt.Fprintf(w, "Powered-off nodes: %s\n", listOrNone(status.PoweredOffNodes))
+}
+
+// runDrain cordons and drains worker nodes regardless of UPS status, or
+// prints what that would do
+func runDrain(args []string) error {
+	fs := flag.NewFlagSet("drain", flag.ExitOnError)
+	dryRun := fs.Bool("dry-run", false, "only print the nodes and pods that would be drained")
+	asJSON := fs.Bool("json", false, "print the dry-run plan as JSON")
+	ups := fs.String("ups", "", "only drain nodes powered by this UPS, when following several UPSes")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: k8s-ups-drainer drain [-dry-run] [-json] [-ups <name>] [<node>...]")
+		fmt.Fprintln(fs.Output(), "Drains the named worker nodes, or all of them, with the configured pod filters.")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	drainer, _, err := newOfflineDrainer()
+	if err != nil {
+		return err
+	}
+
+	if *dryRun {
+		plan, err := drainer.PlanDrain(context.Background(), *ups, fs.Args())
+		if err != nil {
+			return err
+		}
+		if *asJSON {
+			return printJSON(plan)
+		}
+		printPlan(os.Stdout, plan)
+		return nil
+	}
+	report, err := drainer.DrainNodes(context.Background(), *ups, fs.Args())
+	if report != nil {
+		printCapacity(os.Stdout, report)
+	}
+	return err
+}
+
+// runUncordon uncordons nodes drained by the controller, or prints which
+// nodes that would be
+func runUncordon(args []string) error {
+	fs := flag.NewFlagSet("uncordon", flag.ExitOnError)
+	dryRun := fs.Bool("dry-run", false, "only print the nodes that would be uncordoned")
+	ups := fs.String("ups", "", "only uncordon nodes powered by this UPS, when following several UPSes")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: k8s-ups-drainer uncordon [-dry-run] [-ups <name>] [<node>...]")
+		fmt.Fprintln(fs.Output(), "Uncordons the named nodes, or all nodes, drained by UPS drainer.")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	drainer, _, err := newOfflineDrainer()
+	if err != nil {
+		return err
+	}
+
+	if *dryRun {
+		plan, err := drainer.PlanUncordon(*ups, fs.Args())
+		if err != nil {
+			return err
+		}
+		printPlan(os.Stdout, plan)
+		return nil
+	}
+	uncordoned, err := drainer.UncordonNodes(*ups, fs.Args())
+	fmt.Printf("Uncordoned nodes: %s\n", listOrNone(uncordoned))
+	return err
+}
+
+// runAudit prints the most recent drain/uncordon cycles recorded in the audit
+// ConfigMap
+func runAudit(args []string) error {
+	fs := flag.NewFlagSet("audit", flag.ExitOnError)
+	asJSON := fs.Bool("json", false, "print the records as JSON")
+	ups := fs.String("ups", "", "only print cycles of this UPS, when following several UPSes")
+	limit := fs.Int("limit", 10, "how many of the most recent cycles to print, 0 for all")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: k8s-ups-drainer audit [-json] [-ups <name>] [-limit <n>]")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	config := createConfig()
+	if config.AuditConfigMap == "" {
+		return fmt.Errorf("AUDIT_CONFIGMAP is disabled")
+	}
+	clientset, err := newClientset()
+	if err != nil {
+		return err
+	}
+	records, err := nodedrainer.LoadAuditRecords(context.Background(), clientset, config.AuditNamespace, config.AuditConfigMap)
+	if err != nil {
+		return err
+	}
+
+	selected := []nodedrainer.AuditRecord{}
+	for _, rec := range records {
+		if *ups == "" || rec.UPS == *ups {
+			selected = append(selected, rec)
+		}
+	}
+	if *limit > 0 && len(selected) > *limit {
+		selected = selected[len(selected)-*limit:]
+	}
+
+	if *asJSON {
+		return printJSON(selected)
+	}
+	if len(selected) == 0 {
+		fmt.Println("No drain cycles recorded")
+	}
+	for i := range selected {
+		printAuditRecord(os.Stdout, &selected[i])
+	}
+	return nil
+}
+
+// runSimulate prints the actions a hypothetical UPS reading would trigger
+// against the current cluster, without modifying anything
+func runSimulate(args []string) error {
+	fs := flag.NewFlagSet("simulate", flag.ExitOnError)
+	asJSON := fs.Bool("json", false, "print the plan as JSON")
+	ups := fs.String("ups", "", "name of the UPS the reading is from, when following several UPSes")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: k8s-ups-drainer simulate [-json] [-ups <name>] [<ups-status-json> | -]")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	var payload []byte
+	var err error
+	if fs.NArg() == 0 || fs.Arg(0) == "-" {
+		payload, err = io.ReadAll(os.Stdin)
+		if err != nil {
+			return fmt.Errorf("failed to read UPS status from stdin: %w", err)
+		}
+	} else {
+		payload = []byte(fs.Arg(0))
+	}
+
+	var status nodedrainer.UPSStatus
+	if err := json.Unmarshal(payload, &status); err != nil {
+		return fmt.Errorf("failed to parse UPS status: %w", err)
+	}
+
+	drainer, _, err := newOfflineDrainer()
+	if err != nil {
+		return err
+	}
+
+	plan, err := drainer.Plan(context.Background(), *ups, &status)
+	if err != nil {
+		return err
+	}
+
+	if *asJSON {
+		return printJSON(plan)
+	}
+	printPlan(os.Stdout, plan)
+	return nil
+}
+
+// runValidateConfig checks the configuration in the environment and, unless
+// -offline is given, that the cluster, the referenced resources and the MQTT
+// broker can be reached
+func runValidateConfig(args []string) error {
+	fs := flag.NewFlagSet("validate-config", flag.ExitOnError)
+	offline := fs.Bool("offline", false, "only check the environment, without connecting to the cluster or the MQTT broker")
+	timeout := fs.Duration("timeout", stateTimeout, "how long to wait for the MQTT broker")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: k8s-ups-drainer validate-config [-offline] [-timeout <duration>]")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	configProblems = nil
+	config := createConfig()
+	notifiers := notifiersFromEnv()
+	problems := configProblems
+	if err := config.Validate(); err != nil {
+		problems = append(problems, strings.Split(err.Error(), "\n")...)
+	}
+
+	if !*offline {
+		problems = append(problems, checkConnectivity(config, *timeout)...)
+	}
+
+	fmt.Printf("MQTT topic: %s (qos %d)\n", config.MQTTTopic, config.QoS)
+	fmt.Printf("Battery drain threshold: %d%%, drain mode: %s, dry run: %t\n", config.BatteryDrainThreshold, config.DrainMode, config.DryRun)
+	var names []string
+	for _, notifier := range notifiers {
+		names = append(names, notifier.Name())
+	}
+	fmt.Printf("Notifiers: %s\n", listOrNone(names))
+
+	if len(problems) > 0 {
+		fmt.Println("Problems:")
+		for _, problem := range problems {
+			fmt.Printf("  %s\n", problem)
+		}
+		return fmt.Errorf("%d configuration problems found", len(problems))
+	}
+	fmt.Println("Configuration is valid")
+	return nil
+}
+
+// checkConnectivity returns the problems found reaching the cluster, the
+// UPSPolicy and override ConfigMap if configured, and the MQTT broker
+func checkConnectivity(config *nodedrainer.Config, timeout time.Duration) []string {
+	var problems []string
+	ctx := context.Background()
+
+	restConfig, err := initKubernetesConfig()
+	if err != nil {
+		return append(problems, fmt.Sprintf("Kubernetes: %v", err))
+	}
+	clientset, err := kubernetes.NewForConfig(restConfig)
+	if err != nil {
+		return append(problems, fmt.Sprintf("Kubernetes: %v", err))
+	}
+	if _, err := clientset.Discovery().ServerVersion(); err != nil {
+		problems = append(problems, fmt.Sprintf("Kubernetes: %v", err))
+	} else {
+		if name := os.Getenv("UPS_POLICY_NAME"); name != "" {
+			if dynamicClient, err := dynamic.NewForConfig(restConfig); err != nil {
+				problems = append(problems, fmt.Sprintf("UPSPolicy: %v", err))
+			} else if _, err := nodedrainer.LoadPolicy(ctx, dynamicClient, name, config); err != nil {
+				problems = append(problems, fmt.Sprintf("UPSPolicy: %v", err))
+			}
+		}
+		if name := os.Getenv("OVERRIDE_CONFIGMAP"); name != "" {
+			namespace := os.Getenv("POD_NAMESPACE")
+			if namespace == "" {
+				namespace = "default"
+			}
+			if _, err := nodedrainer.LoadOverrides(ctx, clientset, namespace, name); err != nil {
+				problems = append(problems, fmt.Sprintf("Overrides: %v", err))
+			}
+		}
+	}
+
+	client := newMQTTClient(fmt.Sprintf("-validate-%d", os.Getpid()))
+	token := client.Connect()
+	switch {
+	case !token.WaitTimeout(timeout):
+		problems = append(problems, "MQTT: timed out connecting to broker")
+	case token.Error() != nil:
+		problems = append(problems, fmt.Sprintf("MQTT: %v", token.Error()))
+	default:
+		client.Disconnect(250)
+	}
+	return problems
+}
+
+// newClientset creates a Kubernetes client for one-off commands
+func newClientset() (*kubernetes.Clientset, error) {
+	restConfig, err := initKubernetesConfig()
+	if err != nil {
+		return nil, err
+	}
+	clientset, err := kubernetes.NewForConfig(restConfig)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create clientset: %w", err)
+	}
+	return clientset, nil
+}
+
+// newOfflineDrainer creates a NodeDrainer for one-off commands that talk to
+// the cluster but not to MQTT, and returns it with its configuration
+func newOfflineDrainer() (*nodedrainer.NodeDrainer, *nodedrainer.Config, error) {
+	restConfig, err := initKubernetesConfig()
+	if err != nil {
+		return nil, nil, err
+	}
+	clientset, err := kubernetes.NewForConfig(restConfig)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to create clientset: %w", err)
+	}
+	var dynamicClient dynamic.Interface
+	if os.Getenv("UPS_POLICY_NAME") != "" {
+		if dynamicClient, err = dynamic.NewForConfig(restConfig); err != nil {
+			return nil, nil, fmt.Errorf("failed to create dynamic client: %w", err)
+		}
+	}
+	return startOfflineDrainer(context.Background(), clientset, dynamicClient, createConfig())
+}
+
+// startOfflineDrainer starts a NodeDrainer on config with the UPSPolicy named
+// by UPS_POLICY_NAME applied on top, as the controller runs it. A missing
+// policy leaves config alone, like the controller does without its CRD.
+func startOfflineDrainer(ctx context.Context, clientset kubernetes.Interface, dynamicClient dynamic.Interface, config *nodedrainer.Config) (*nodedrainer.NodeDrainer, *nodedrainer.Config, error) {
+	if name := os.Getenv("UPS_POLICY_NAME"); name != "" {
+		policyConfig, err := nodedrainer.LoadPolicy(ctx, dynamicClient, name, config)
+		switch {
+		case apierrors.IsNotFound(err):
+			log.Printf("UPSPolicy %s not found, using the environment configuration", name)
+		case err != nil:
+			return nil, nil, err
+		default:
+			config = policyConfig
+		}
+	}
+
+	drainer := nodedrainer.New(clientset, nil)
+	drainer.Configure(config)
+	if err := drainer.Start(ctx); err != nil {
+		return nil, nil, err
+	}
+	return drainer, config, nil
+}
+
+func printCapacity(w io.Writer, report *nodedrainer.CapacityReport) {
+	fmt.Fprintf(w, "Worker nodes drained: %d of %d, at most %d\n", report.Drained, report.WorkerNodes, report.MaxDrained)
+	for _, held := range report.Held {
+		fmt.Fprintf(w, "Keep node %s schedulable (%s)\n", held.Node, held.Reason)
+	}
+	if report.Fits != nil && !*report.Fits {
+		fmt.Fprintf(w, "Warning: %d evicted pods will not fit on the remaining nodes\n", len(report.Unplaced))
+		for _, pod := range report.Unplaced {
+			fmt.Fprintf(w, "  no room for %s\n", pod)
+		}
+	}
+}
+
+func printAuditRecord(w io.Writer, rec *nodedrainer.AuditRecord) {
+	fmt.Fprintf(w, "%s", rec.Started.Format(time.RFC3339))
+	if rec.UPS != "" {
+		fmt.Fprintf(w, " UPS %s", rec.UPS)
+	}
+	fmt.Fprintf(w, ": %s", rec.Trigger)
+	if reading := rec.Reading; reading != nil {
+		fmt.Fprintf(w, " (status=%s battery=%d%%)", reading.Status, reading.BatteryLevel)
+	}
+	if rec.Finished != nil {
+		fmt.Fprintf(w, ", took %s\n", rec.Duration)
+	} else {
+		fmt.Fprintln(w, ", still in progress")
+	}
+	if rec.Note != "" {
+		fmt.Fprintf(w, "  Note: %s\n", rec.Note)
+	}
+	fmt.Fprintf(w, "  Nodes: %s\n", listOrNone(rec.Nodes))
+	fmt.Fprintf(w, "  Pods evicted: %d\n", len(rec.Evictions)+rec.EvictionsOmitted)
+
+	var entries []nodedrainer.Action
+	entries = append(entries, rec.Steps...)
+	entries = append(entries, rec.Evictions...)
+	entries = append(entries, rec.Failures...)
+	sort.SliceStable(entries, func(i, j int) bool { return entries[i].Time.Before(entries[j].Time) })
+	for _, entry := range entries {
+		fmt.Fprintf(w, "  %s %s", entry.Time.Format(time.TimeOnly), entry.Action)
+		if entry.Target != "" {
+			fmt.Fprintf(w, " %s", entry.Target)
+		}
+		if entry.Error != "" {
+			fmt.Fprintf(w, " failed: %s\n", entry.Error)
+		} else {
+			fmt.Fprintf(w, ": %s\n", entry.Message)
+		}
+	}
+	if rec.EvictionsOmitted > 0 {
+		fmt.Fprintf(w, "  (%d earlier evictions omitted)\n", rec.EvictionsOmitted)
+	}
+}
+
+func printJSON(v interface{}) error {
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(v)
+}
+
+// listOrNone joins names for display
+func listOrNone(names []string) string {
+	if len(names) == 0 {
+		return "none"
+	}
+	return strings.Join(names, ", ")
+}
+
+func printPlan(w io.Writer, plan *nodedrainer.Plan) {
+	if plan.UPS != "" {
+		fmt.Fprintf(w, "UPS: %s\n", plan.UPS)
+	}
+	if plan.Reading != nil {
+		fmt.Fprintf(w, "UPS reading: status=%s battery=%d%%", plan.Reading.Status, plan.Reading.BatteryLevel)
+		if runtime := plan.Reading.Runtime(); runtime > 0 {
+			fmt.Fprintf(w, " runtime=%s", runtime)
+		}
+		fmt.Fprintln(w)
+	}
+
+	switch plan.Stage {
+	case nodedrainer.StageDrain:
+		fmt.Fprintf(w, "Stage: %s\n", plan.Stage)
+		if len(plan.Drain) == 0 && len(plan.ScaleDown) == 0 {
+			fmt.Fprintln(w, "No worker nodes left to drain")
+		}
+		if plan.Capacity != nil {
+			printCapacity(w, plan.Capacity)
+		}
+		for _, node := range plan.Drain {
+			fmt.Fprintf(w, "Cordon node %s and evict %d pods\n", node.Node, len(node.Evict)+len(node.Blocked))
+			for _, pod := range node.Evict {
+				fmt.Fprintf(w, "  evict %s\n", pod)
+			}
+			for _, blocked := range node.Blocked {
+				fmt.Fprintf(w, "  evict %s (blocked: %s)\n", blocked.Pod, blocked.Reason)
+			}
+			for _, skipped := range node.Skipped {
+				fmt.Fprintf(w, "  skip %s (%s)\n", skipped.Pod, skipped.Reason)
+			}
+		}
+		for _, node := range plan.PowerOff {
+			fmt.Fprintf(w, "Power off node %s once drained\n", node)
+		}
+		for _, workload := range plan.ScaleDown {
+			fmt.Fprintf(w, "Scale down %s to zero\n", workload)
+		}
+	case nodedrainer.StageNormal:
+		fmt.Fprintf(w, "Stage: %s\n", plan.Stage)
+		for _, workload := range plan.Restore {
+			fmt.Fprintf(w, "Restore %s\n", workload)
+		}
+		if len(plan.Uncordon) == 0 {
+			fmt.Fprintln(w, "No nodes to uncordon")
+		}
+		for _, node := range plan.Uncordon {
+			fmt.Fprintf(w, "Uncordon node %s\n", node)
+		}
+	default:
+		fmt.Fprintln(w, "Reading does not trigger any action")
+	}
+}
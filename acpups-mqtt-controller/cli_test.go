@@ -0,0 +1,69 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+	"k8s.io/client-go/kubernetes/fake"
+
+	"k8s-ups-drainer/pkg/nodedrainer"
+)
+
+func TestOfflineDrainerAppliesPolicy(t *testing.T) {
+	t.Setenv("UPS_POLICY_NAME", "default")
+
+	var nodes []runtime.Object
+	for _, name := range []string{"worker-1", "worker-2", "worker-3", "worker-4"} {
+		nodes = append(nodes, &corev1.Node{ObjectMeta: metav1.ObjectMeta{Name: name}})
+	}
+	policy := &unstructured.Unstructured{Object: map[string]interface{}{
+		"apiVersion": "ups-drainer.k8s.io/v1alpha1",
+		"kind":       "UPSPolicy",
+		"metadata":   map[string]interface{}{"name": "default"},
+		"spec": map[string]interface{}{
+			"capacity": map[string]interface{}{"maxDrainPercent": int64(50)},
+		},
+	}}
+	dynamicClient := dynamicfake.NewSimpleDynamicClientWithCustomListKinds(runtime.NewScheme(),
+		map[schema.GroupVersionResource]string{nodedrainer.UPSPolicyResource: "UPSPolicyList"}, policy)
+
+	config := nodedrainer.DefaultConfig()
+	config.MQTTTopic = "ups/status"
+	drainer, applied, err := startOfflineDrainer(context.Background(), fake.NewSimpleClientset(nodes...), dynamicClient, config)
+	if err != nil {
+		t.Fatalf("startOfflineDrainer: %v", err)
+	}
+	if applied.MaxDrainPercent != 50 {
+		t.Errorf("policy not applied: max drain percent %d", applied.MaxDrainPercent)
+	}
+
+	plan, err := drainer.Plan(context.Background(), "", &nodedrainer.UPSStatus{BatteryLevel: 10, Status: "ONBATT"})
+	if err != nil {
+		t.Fatalf("Plan: %v", err)
+	}
+	if plan.Capacity == nil || plan.Capacity.MaxDrained != 2 || len(plan.Drain) != 2 {
+		t.Errorf("expected the simulation to drain 2 of 4 nodes under the policy, got capacity %+v, %d drains", plan.Capacity, len(plan.Drain))
+	}
+}
+
+func TestOfflineDrainerWithoutPolicy(t *testing.T) {
+	t.Setenv("UPS_POLICY_NAME", "missing")
+
+	dynamicClient := dynamicfake.NewSimpleDynamicClientWithCustomListKinds(runtime.NewScheme(),
+		map[schema.GroupVersionResource]string{nodedrainer.UPSPolicyResource: "UPSPolicyList"})
+	config := nodedrainer.DefaultConfig()
+	config.MQTTTopic = "ups/status"
+	_, applied, err := startOfflineDrainer(context.Background(), fake.NewSimpleClientset(), dynamicClient, config)
+	if err != nil {
+		t.Fatalf("startOfflineDrainer: %v", err)
+	}
+	if applied != config {
+		t.Errorf("expected the environment configuration without the policy")
+	}
+}
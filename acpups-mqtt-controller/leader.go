@@ -0,0 +1,85 @@
+package main
+
+import (
+	"context"
+	"log"
+	"os"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/leaderelection"
+	"k8s.io/client-go/tools/leaderelection/resourcelock"
+
+	"k8s-ups-drainer/pkg/nodedrainer"
+)
+
+// runWithLeaderElection runs run only while this replica holds the controller
+// Lease. Losing the Lease exits the process so that no two replicas ever act
+// at the same time; the replacement pod rejoins as a follower.
+func runWithLeaderElection(ctx context.Context, clientset kubernetes.Interface, drainer *nodedrainer.NodeDrainer, run func(context.Context)) {
+	identity := os.Getenv("POD_NAME")
+	if identity == "" {
+		hostname, err := os.Hostname()
+		if err != nil {
+			log.Fatalf("Failed to determine leader election identity: %v", err)
+		}
+		identity = hostname
+	}
+
+	namespace := os.Getenv("POD_NAMESPACE")
+	if namespace == "" {
+		namespace = "default"
+	}
+
+	leaseName := os.Getenv("LEADER_ELECTION_LEASE_NAME")
+	if leaseName == "" {
+		leaseName = "k8s-ups-drainer"
+	}
+
+	leaseDuration := 15 * time.Second
+	renewDeadline := 10 * time.Second
+	retryPeriod := 2 * time.Second
+	readEnvDuration("LEADER_ELECTION_LEASE_DURATION", &leaseDuration)
+	readEnvDuration("LEADER_ELECTION_RENEW_DEADLINE", &renewDeadline)
+	readEnvDuration("LEADER_ELECTION_RETRY_PERIOD", &retryPeriod)
+
+	lock := &resourcelock.LeaseLock{
+		LeaseMeta: metav1.ObjectMeta{
+			Name:      leaseName,
+			Namespace: namespace,
+		},
+		Client: clientset.CoordinationV1(),
+		LockConfig: resourcelock.ResourceLockConfig{
+			Identity: identity,
+		},
+	}
+
+	log.Printf("Starting leader election for Lease %s/%s as %s", namespace, leaseName, identity)
+	leaderelection.RunOrDie(ctx, leaderelection.LeaderElectionConfig{
+		Lock:            lock,
+		ReleaseOnCancel: true,
+		LeaseDuration:   leaseDuration,
+		RenewDeadline:   renewDeadline,
+		RetryPeriod:     retryPeriod,
+		Name:            leaseName,
+		Callbacks: leaderelection.LeaderCallbacks{
+			OnStartedLeading: func(ctx context.Context) {
+				log.Printf("Acquired leadership as %s - starting controller", identity)
+				run(ctx)
+			},
+			OnStoppedLeading: func() {
+				drainer.SetLeader("", false)
+				if ctx.Err() != nil {
+					log.Println("Released leadership")
+					return
+				}
+				log.Fatalf("Lost leadership as %s - exiting", identity)
+			},
+			OnNewLeader: func(current string) {
+				log.Printf("Current leader: %s", current)
+				drainer.SetLeader(current, current == identity)
+			},
+		},
+	})
+}
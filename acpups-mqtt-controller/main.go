@@ -1,15 +1,21 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"log"
+	"math"
+	"net/http"
 	"os"
 	"os/signal"
 	"strconv"
+	"strings"
 	"syscall"
 	"time"
 
 	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/dynamic"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/rest"
 	"k8s.io/client-go/tools/clientcmd"
@@ -26,42 +32,122 @@ func main() {
 		log.Println("No .env file found, continuing...")
 	}
 
+	// Run a one-off subcommand instead of the controller if requested
+	if len(os.Args) > 1 {
+		if err := runCommand(os.Args[1], os.Args[2:]); err != nil {
+			log.Fatalf("%s: %v", os.Args[1], err)
+		}
+		return
+	}
+
 	log.Println("Starting Kubernetes UPS Node Drainer")
 
 	// Initialize Kubernetes client
-	k8sClient, err := initKubernetesClient()
+	restConfig, err := initKubernetesConfig()
 	if err != nil {
 		log.Fatalf("Failed to initialize Kubernetes client: %v", err)
 	}
-	log.Println("Initializing Kubernetes Controllers")
-
-	// Initialize MQTT client
-	mqttClient, err := initMQTTClient()
+	k8sClient, err := kubernetes.NewForConfig(restConfig)
 	if err != nil {
-		log.Fatalf("Failed to initialize MQTT client: %v", err)
+		log.Fatalf("Failed to create clientset: %v", err)
 	}
-	log.Println("Connected to MQTT broker")
+	log.Println("Initializing Kubernetes Controllers")
+
+	// Initialize MQTT client; it only connects once this replica may act
+	mqttClient := newMQTTClient("")
 
 	// Create node drainer
 	drainer := nodedrainer.New(k8sClient, mqttClient)
-
-	// Subscribe to UPS status with configuration
 	config := createConfig()
-	if err := drainer.Subscribe(config); err != nil {
-		log.Fatalf("Failed to subscribe to MQTT: %v", err)
+	for _, notifier := range notifiersFromEnv() {
+		drainer.AddNotifier(notifier)
 	}
-	log.Println("Subscribed to UPS status updates")
 
-	// Wait for interrupt signal
-	c := make(chan os.Signal, 1)
-	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
-	<-c
+	// Stop on interrupt signal
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer cancel()
+
+	// Serve metrics and health probes on every replica
+	go serveHTTP(drainer)
+
+	run := func(ctx context.Context) {
+		// Cache nodes and pods before acting on any UPS status
+		if err := drainer.Start(ctx); err != nil {
+			log.Fatalf("Failed to start node and pod caches: %v", err)
+		}
+
+		if token := mqttClient.Connect(); token.Wait() && token.Error() != nil {
+			log.Fatalf("Failed to connect to MQTT broker: %v", token.Error())
+		}
+		log.Println("Connected to MQTT broker")
+
+		// Subscribe to UPS status with configuration
+		if err := drainer.Subscribe(config); err != nil {
+			log.Fatalf("Failed to subscribe to MQTT: %v", err)
+		}
+		log.Println("Subscribed to UPS status updates")
+
+		// Follow maintenance overrides kept in a ConfigMap if configured
+		if name := os.Getenv("OVERRIDE_CONFIGMAP"); name != "" {
+			namespace := os.Getenv("POD_NAMESPACE")
+			if namespace == "" {
+				namespace = "default"
+			}
+			if err := drainer.WatchOverrides(ctx, namespace, name); err != nil {
+				log.Fatalf("Failed to watch override ConfigMap: %v", err)
+			}
+		}
+
+		// Manage policy declaratively through a UPSPolicy resource if configured
+		if policyName := os.Getenv("UPS_POLICY_NAME"); policyName != "" {
+			dynamicClient, err := dynamic.NewForConfig(restConfig)
+			if err != nil {
+				log.Fatalf("Failed to create dynamic client: %v", err)
+			}
+			if err := drainer.WatchPolicy(ctx, dynamicClient, policyName); err != nil {
+				log.Fatalf("Failed to watch UPSPolicy: %v", err)
+			}
+		}
+
+		// Finish drains that a previous run, or leader, left behind
+		if err := drainer.ResumeInterruptedDrains(ctx); err != nil {
+			log.Printf("Failed to resume interrupted drains: %v", err)
+		}
 
-	log.Println("Shutting down...")
-	mqttClient.Disconnect(250)
+		<-ctx.Done()
+		log.Println("Shutting down...")
+		mqttClient.Disconnect(250)
+	}
+
+	// With several replicas only the Lease holder subscribes and acts
+	leaderElection := false
+	readEnvBool("LEADER_ELECTION", &leaderElection)
+	if leaderElection {
+		runWithLeaderElection(ctx, k8sClient, drainer, run)
+	} else {
+		drainer.SetLeader("", true)
+		run(ctx)
+	}
 }
 
-func initKubernetesClient() (*kubernetes.Clientset, error) {
+func serveHTTP(drainer *nodedrainer.NodeDrainer) {
+	addr := os.Getenv("METRICS_ADDR")
+	if addr == "" {
+		addr = ":8080"
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", drainer.MetricsHandler())
+	mux.Handle("/healthz", drainer.LivenessHandler())
+	mux.Handle("/readyz", drainer.ReadinessHandler())
+
+	log.Printf("Serving metrics and health checks on %s", addr)
+	if err := http.ListenAndServe(addr, mux); err != nil {
+		log.Fatalf("HTTP server failed: %v", err)
+	}
+}
+
+func initKubernetesConfig() (*rest.Config, error) {
 	var config *rest.Config
 	var err error
 
@@ -79,15 +165,13 @@ func initKubernetesClient() (*kubernetes.Clientset, error) {
 		}
 	}
 
-	clientset, err := kubernetes.NewForConfig(config)
-	if err != nil {
-		return nil, fmt.Errorf("failed to create clientset: %w", err)
-	}
-
-	return clientset, nil
+	return config, nil
 }
 
-func initMQTTClient() (mqtt.Client, error) {
+// newMQTTClient creates a client for the configured broker; suffix is
+// appended to the client ID so that one-off commands do not disconnect the
+// controller
+func newMQTTClient(suffix string) mqtt.Client {
 	broker := os.Getenv("MQTT_BROKER")
 	if broker == "" {
 		broker = "tcp://localhost:1883"
@@ -97,6 +181,7 @@ func initMQTTClient() (mqtt.Client, error) {
 	if clientID == "" {
 		clientID = "k8s-ups-drainer"
 	}
+	clientID += suffix
 
 	opts := mqtt.NewClientOptions()
 	opts.AddBroker(broker)
@@ -119,13 +204,8 @@ func initMQTTClient() (mqtt.Client, error) {
 		log.Printf("MQTT connection lost: %v", err)
 	})
 
-	client := mqtt.NewClient(opts)
-	if token := client.Connect(); token.Wait() && token.Error() != nil {
-		return nil, fmt.Errorf("failed to connect to MQTT broker: %w", token.Error())
-	}
-
-	log.Printf("Connected to MQTT broker: %s", broker)
-	return client, nil
+	log.Printf("Using MQTT broker: %s", broker)
+	return mqtt.NewClient(opts)
 }
 
 func createConfig() *nodedrainer.Config {
@@ -137,15 +217,281 @@ func createConfig() *nodedrainer.Config {
 		log.Printf("Using MQTT topic from env: %s", topic)
 	}
 
+	// Read the node to UPS mapping from environment
+	if label := os.Getenv("UPS_SOURCE_LABEL"); label != "" {
+		config.SourceLabel = label
+		log.Printf("Using UPS source label from env: %s", label)
+	}
+	if source := os.Getenv("UPS_DEFAULT_SOURCE"); source != "" {
+		config.DefaultSource = source
+		log.Printf("Using default UPS source from env: %s", source)
+	}
+
 	// Read battery drain threshold from environment
 	if thresholdStr := os.Getenv("BATTERY_DRAIN_THRESHOLD"); thresholdStr != "" {
 		if threshold, err := strconv.Atoi(thresholdStr); err == nil && threshold > 0 && threshold <= 100 {
 			config.BatteryDrainThreshold = threshold
 			log.Printf("Using battery drain threshold from env: %d%%", threshold)
 		} else {
-			log.Printf("Invalid BATTERY_DRAIN_THRESHOLD value '%s', using default: %d%%", thresholdStr, config.BatteryDrainThreshold)
+			invalidEnv("Invalid BATTERY_DRAIN_THRESHOLD value '%s', using default: %d%%", thresholdStr, config.BatteryDrainThreshold)
 		}
 	}
 
+	// Read capacity safeguards from environment
+	readEnvInt("MAX_DRAIN_PERCENT", &config.MaxDrainPercent, 1, 100)
+	if selectorStr := os.Getenv("LAST_RESORT_NODE_SELECTOR"); selectorStr != "" {
+		if selector, err := labels.Parse(selectorStr); err == nil {
+			config.LastResortSelector = selector
+			log.Printf("Using last resort node selector from env: %s", selector)
+		} else {
+			invalidEnv("Invalid LAST_RESORT_NODE_SELECTOR value '%s', draining every selected node: %v", selectorStr, err)
+		}
+	}
+	if check := os.Getenv("CAPACITY_CHECK"); check != "" {
+		if check == nodedrainer.CapacityCheckOff || check == nodedrainer.CapacityCheckWarn || check == nodedrainer.CapacityCheckEnforce {
+			config.CapacityCheck = check
+			log.Printf("Using capacity check from env: %s", check)
+		} else {
+			invalidEnv("Invalid CAPACITY_CHECK value '%s', using default: %s", check, config.CapacityCheck)
+		}
+	}
+
+	// Read status flag rules from environment, on top of the defaults
+	var flagRules []string
+	readEnvList("UPS_FLAG_ACTIONS", &flagRules)
+	if len(flagRules) > 0 {
+		if actions, err := nodedrainer.ParseFlagActions(flagRules); err == nil {
+			config.FlagActions = nodedrainer.MergeFlagActions(config.FlagActions, actions)
+		} else {
+			invalidEnv("Invalid UPS_FLAG_ACTIONS value, using default rules: %v", err)
+		}
+	}
+
+	// Read runtime-based triggers from environment
+	readEnvDuration("MAX_TIME_ON_BATTERY", &config.MaxOnBattery)
+	readEnvDuration("MIN_RUNTIME_LEFT", &config.MinRuntime)
+
+	// Read drain behaviour from environment
+	readEnvDuration("DRAIN_TIMEOUT", &config.DrainTimeout)
+	readEnvBool("DRAIN_DELETE_AFTER_TIMEOUT", &config.DeleteAfterTimeout)
+	if mode := os.Getenv("DRAIN_MODE"); mode != "" {
+		if mode == nodedrainer.DrainModeEvict || mode == nodedrainer.DrainModeScaleDown {
+			config.DrainMode = mode
+			log.Printf("Using drain mode from env: %s", mode)
+		} else {
+			invalidEnv("Invalid DRAIN_MODE value '%s', using default: %s", mode, config.DrainMode)
+		}
+	}
+	if selectorStr := os.Getenv("SCALE_DOWN_SELECTOR"); selectorStr != "" {
+		if selector, err := labels.Parse(selectorStr); err == nil {
+			config.ScaleDownSelector = selector
+			log.Printf("Using scale-down selector from env: %s", selector)
+		} else {
+			invalidEnv("Invalid SCALE_DOWN_SELECTOR value '%s', not scaling down workloads: %v", selectorStr, err)
+		}
+	}
+	readEnvInt("EVICTION_PRIORITY_LIMIT", &config.EvictionPriorityLimit, 0, math.MaxInt32)
+
+	// Read pod eviction filters from environment
+	readEnvList("EVICT_NAMESPACES", &config.IncludeNamespaces)
+	readEnvList("EVICT_EXCLUDE_NAMESPACES", &config.ExcludeNamespaces)
+	if selectorStr := os.Getenv("EVICT_POD_SELECTOR"); selectorStr != "" {
+		if selector, err := labels.Parse(selectorStr); err == nil {
+			config.PodSelector = selector
+			log.Printf("Using pod selector from env: %s", selector)
+		} else {
+			invalidEnv("Invalid EVICT_POD_SELECTOR value '%s', evicting pods regardless of labels: %v", selectorStr, err)
+		}
+	}
+	readEnvBool("DRAIN_DELETE_EMPTYDIR_DATA", &config.DeleteEmptyDirData)
+	readEnvBool("EVICT_HOSTPATH_PODS", &config.EvictHostPathPods)
+	readEnvBool("EVICT_UNMANAGED_PODS", &config.EvictUnmanagedPods)
+
+	// Read stale data handling from environment
+	readEnvDuration("UPS_STALE_AFTER", &config.StaleAfter)
+	readEnvDuration("UPS_MAX_CLOCK_SKEW", &config.MaxClockSkew)
+	if action := os.Getenv("UPS_STALE_ACTION"); action != "" {
+		if action == nodedrainer.StaleActionHold || action == nodedrainer.StaleActionDrain {
+			config.StaleAction = action
+			log.Printf("Using stale action from env: %s", action)
+		} else {
+			invalidEnv("Invalid UPS_STALE_ACTION value '%s', using default: %s", action, config.StaleAction)
+		}
+	}
+	if topic := os.Getenv("MQTT_AVAILABILITY_TOPIC"); topic != "" {
+		config.AvailabilityTopic = topic
+		log.Printf("Using MQTT availability topic from env: %s", topic)
+	}
+
+	// Read hysteresis settings from environment
+	readEnvDuration("HYSTERESIS_STABLE_FOR", &config.StableFor)
+	readEnvInt("HYSTERESIS_STABLE_MESSAGES", &config.StableMessages, 0, 1000)
+	readEnvInt("BATTERY_UNCORDON_THRESHOLD", &config.BatteryUncordonThreshold, 0, 100)
+	readEnvDuration("MIN_DRAIN_DURATION", &config.MinDrainDuration)
+
+	// Read node power-off settings from environment
+	readEnvInt("SHUTDOWN_THRESHOLD", &config.ShutdownThreshold, 0, 100)
+	if method := os.Getenv("SHUTDOWN_METHOD"); method != "" {
+		config.ShutdownMethod = method
+		log.Printf("Using shutdown method from env: %s", method)
+	}
+	if namespace := os.Getenv("POD_NAMESPACE"); namespace != "" {
+		config.ShutdownNamespace = namespace
+		config.AuditNamespace = namespace
+	}
+	if image := os.Getenv("SHUTDOWN_IMAGE"); image != "" {
+		config.ShutdownImage = image
+		log.Printf("Using shutdown image from env: %s", image)
+	}
+	if webhook := os.Getenv("SHUTDOWN_WEBHOOK_URL"); webhook != "" {
+		config.ShutdownWebhookURL = webhook
+		log.Println("Using shutdown webhook from env")
+	}
+
+	// Read dry-run mode from environment
+	readEnvBool("DRY_RUN", &config.DryRun)
+	if topic := os.Getenv("PLAN_TOPIC"); topic != "" {
+		config.PlanTopic = topic
+		log.Printf("Using plan topic from env: %s", topic)
+	}
+
+	if topic := os.Getenv("COMMAND_TOPIC"); topic != "" {
+		config.CommandTopic = topic
+		log.Printf("Using command topic from env: %s", topic)
+	}
+
+	// Read state publishing topics from environment; set but empty disables
+	if topic, ok := os.LookupEnv("STATE_TOPIC"); ok {
+		config.StateTopic = topic
+		log.Printf("Using state topic from env: %q", topic)
+	}
+	if topic, ok := os.LookupEnv("ACTION_TOPIC"); ok {
+		config.ActionTopic = topic
+		log.Printf("Using action topic from env: %q", topic)
+	}
+	if topic, ok := os.LookupEnv("DEAD_LETTER_TOPIC"); ok {
+		config.DeadLetterTopic = topic
+		log.Printf("Using dead-letter topic from env: %q", topic)
+	}
+
+	// Read notification settings from environment
+	readEnvList("NOTIFY_EVENTS", &config.NotifyEvents)
+	if text := os.Getenv("NOTIFY_TEMPLATE"); text != "" {
+		if _, err := nodedrainer.ParseNotifyTemplate(text); err == nil {
+			config.NotifyTemplate = text
+			log.Println("Using notification template from env")
+		} else {
+			invalidEnv("Invalid NOTIFY_TEMPLATE, using default: %v", err)
+		}
+	}
+	readEnvInt("NOTIFY_RATE_LIMIT", &config.NotifyRateLimit, 0, 10000)
+
+	// Read audit trail settings from environment; set but empty disables
+	if name, ok := os.LookupEnv("AUDIT_CONFIGMAP"); ok {
+		config.AuditConfigMap = name
+		log.Printf("Using audit ConfigMap from env: %q", name)
+	}
+	readEnvInt("AUDIT_MAX_RECORDS", &config.AuditMaxRecords, 1, 1000)
+
 	return config
 }
+
+// notifiersFromEnv returns the notification backends configured in the environment
+func notifiersFromEnv() []nodedrainer.Notifier {
+	var notifiers []nodedrainer.Notifier
+	if url := os.Getenv("NOTIFY_WEBHOOK_URL"); url != "" {
+		notifiers = append(notifiers, nodedrainer.NewWebhookNotifier(url))
+	}
+	if url := os.Getenv("NOTIFY_SLACK_WEBHOOK_URL"); url != "" {
+		notifiers = append(notifiers, nodedrainer.NewSlackNotifier(url))
+	}
+	if homeserver := os.Getenv("NOTIFY_MATRIX_HOMESERVER"); homeserver != "" {
+		room, token := os.Getenv("NOTIFY_MATRIX_ROOM_ID"), os.Getenv("NOTIFY_MATRIX_TOKEN")
+		if room == "" || token == "" {
+			invalidEnv("NOTIFY_MATRIX_HOMESERVER requires NOTIFY_MATRIX_ROOM_ID and NOTIFY_MATRIX_TOKEN, not notifying Matrix")
+		} else {
+			notifiers = append(notifiers, nodedrainer.NewMatrixNotifier(homeserver, room, token))
+		}
+	}
+	if addr := os.Getenv("NOTIFY_SMTP_ADDR"); addr != "" {
+		var to []string
+		readEnvList("NOTIFY_SMTP_TO", &to)
+		from := os.Getenv("NOTIFY_SMTP_FROM")
+		if from == "" || len(to) == 0 {
+			invalidEnv("NOTIFY_SMTP_ADDR requires NOTIFY_SMTP_FROM and NOTIFY_SMTP_TO, not sending email")
+		} else {
+			notifiers = append(notifiers, nodedrainer.NewSMTPNotifier(addr, from, to, os.Getenv("NOTIFY_SMTP_USER"), os.Getenv("NOTIFY_SMTP_PASSWORD")))
+		}
+	}
+	return notifiers
+}
+
+// configProblems collects the invalid settings found while reading the
+// environment, for validate-config
+var configProblems []string
+
+// invalidEnv logs an invalid setting that is being ignored
+func invalidEnv(format string, args ...interface{}) {
+	problem := fmt.Sprintf(format, args...)
+	configProblems = append(configProblems, problem)
+	log.Print(problem)
+}
+
+// readEnvDuration overrides value with the named variable if it holds a valid duration
+func readEnvDuration(name string, value *time.Duration) {
+	str := os.Getenv(name)
+	if str == "" {
+		return
+	}
+	if d, err := time.ParseDuration(str); err == nil && d >= 0 {
+		*value = d
+		log.Printf("Using %s from env: %s", name, d)
+	} else {
+		invalidEnv("Invalid %s value '%s', using default: %s", name, str, *value)
+	}
+}
+
+// readEnvList overrides value with the named comma-separated variable. A set
+// but empty variable clears the list.
+func readEnvList(name string, value *[]string) {
+	str, ok := os.LookupEnv(name)
+	if !ok {
+		return
+	}
+	var list []string
+	for _, item := range strings.Split(str, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	*value = list
+	log.Printf("Using %s from env: %s", name, strings.Join(list, ","))
+}
+
+// readEnvBool overrides value with the named variable if it holds a valid boolean
+func readEnvBool(name string, value *bool) {
+	str := os.Getenv(name)
+	if str == "" {
+		return
+	}
+	if b, err := strconv.ParseBool(str); err == nil {
+		*value = b
+		log.Printf("Using %s from env: %t", name, b)
+	} else {
+		invalidEnv("Invalid %s value '%s', using default: %t", name, str, *value)
+	}
+}
+
+// readEnvInt overrides value with the named variable if it holds an integer in [min, max]
+func readEnvInt(name string, value *int, min, max int) {
+	str := os.Getenv(name)
+	if str == "" {
+		return
+	}
+	if i, err := strconv.Atoi(str); err == nil && i >= min && i <= max {
+		*value = i
+		log.Printf("Using %s from env: %d", name, i)
+	} else {
+		invalidEnv("Invalid %s value '%s', using default: %d", name, str, *value)
+	}
+}
@@ -0,0 +1,365 @@
+package nodedrainer
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"sort"
+	"sync"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/util/retry"
+)
+
+const (
+	// AuditConfigMapKey is the ConfigMap data key holding the audit records
+	AuditConfigMapKey = "records"
+	// auditMaxBytes keeps the audit ConfigMap well below the 1MiB object limit
+	auditMaxBytes = 900 * 1024
+)
+
+// Audit record triggers; overrides and stale UPS data are described instead
+const (
+	AuditTriggerReading        = "UPS reading"
+	AuditTriggerManualDrain    = "manual drain"
+	AuditTriggerManualUncordon = "manual uncordon"
+)
+
+// AuditRecord describes one drain/uncordon cycle: from the moment a UPS
+// called for draining, or a manual command, until its nodes were uncordoned
+type AuditRecord struct {
+	ID  string `json:"id"`
+	UPS string `json:"ups,omitempty"`
+	// Trigger is what started the cycle
+	Trigger string `json:"trigger"`
+	// Reading is the UPS reading that triggered the cycle, if any
+	Reading  *UPSStatus `json:"reading,omitempty"`
+	Started  time.Time  `json:"started"`
+	Finished *time.Time `json:"finished,omitempty"`
+	Duration string     `json:"duration,omitempty"`
+	// Nodes lists the nodes cordoned, drained, uncordoned or powered off
+	Nodes []string `json:"nodes"`
+	// Steps lists the successful actions other than pod evictions
+	Steps []Action `json:"steps"`
+	// Evictions lists the pods evicted or deleted, with their timestamps
+	Evictions []Action `json:"evictions"`
+	// EvictionsOmitted counts evictions dropped to fit the ConfigMap
+	EvictionsOmitted int      `json:"evictionsOmitted,omitempty"`
+	Failures         []Action `json:"failures"`
+	// Note explains a record not finished by the end of its cycle
+	Note string `json:"note,omitempty"`
+}
+
+// auditLog collects the actions of open audit records and persists them
+type auditLog struct {
+	mutex sync.Mutex
+	// open holds the record of the current cycle of each UPS
+	open map[string]*AuditRecord
+}
+
+// auditRecordKey is the context key of the audit record of a drain run
+type auditRecordKey struct{}
+
+// withAuditRecord returns ctx carrying the audit record that the actions of a
+// drain run under it go to
+func withAuditRecord(ctx context.Context, rec *AuditRecord) context.Context {
+	return context.WithValue(ctx, auditRecordKey{}, rec)
+}
+
+// auditRecordOf returns the audit record carried by ctx, if any
+func auditRecordOf(ctx context.Context) *AuditRecord {
+	rec, _ := ctx.Value(auditRecordKey{}).(*AuditRecord)
+	return rec
+}
+
+// auditStart opens an audit record for a drain of the named UPS unless one
+// is open already, and returns it and whether it was opened. Callers must
+// hold nd.mutex.
+func (nd *NodeDrainer) auditStart(source, trigger string, reading *UPSStatus) (*AuditRecord, bool) {
+	a := &nd.audit
+	a.mutex.Lock()
+	if rec, ok := a.open[source]; ok {
+		a.mutex.Unlock()
+		return rec, false
+	}
+	now := time.Now()
+	rec := &AuditRecord{
+		ID:        auditID(source, now),
+		UPS:       source,
+		Trigger:   trigger,
+		Reading:   reading,
+		Started:   now,
+		Nodes:     []string{},
+		Steps:     []Action{},
+		Evictions: []Action{},
+		Failures:  []Action{},
+	}
+	if a.open == nil {
+		a.open = make(map[string]*AuditRecord)
+	}
+	a.open[source] = rec
+	a.mutex.Unlock()
+
+	nd.saveAuditRecord(rec)
+	return rec, true
+}
+
+// auditFinish closes the audit record of the named UPS, if one is open.
+// Callers must hold nd.mutex.
+func (nd *NodeDrainer) auditFinish(source string) {
+	a := &nd.audit
+	a.mutex.Lock()
+	rec, ok := a.open[source]
+	if ok {
+		delete(a.open, source)
+		finish(rec)
+	}
+	a.mutex.Unlock()
+
+	if ok {
+		nd.saveAuditRecord(rec)
+	}
+}
+
+// auditAction adds an action to rec, or to the open audit record of its UPS
+// if rec is nil
+func (nd *NodeDrainer) auditAction(action *Action, rec *AuditRecord) {
+	a := &nd.audit
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	if rec == nil {
+		rec = a.open[action.UPS]
+	}
+	if rec == nil {
+		return
+	}
+
+	switch {
+	case action.Error != "":
+		rec.Failures = append(rec.Failures, *action)
+	case action.Action == ActionEvict || action.Action == ActionDelete:
+		rec.Evictions = append(rec.Evictions, *action)
+	default:
+		rec.Steps = append(rec.Steps, *action)
+	}
+	switch action.Action {
+	case ActionCordon, ActionDrain, ActionUncordon, ActionPowerOff:
+		if !containsString(rec.Nodes, action.Target) {
+			rec.Nodes = append(rec.Nodes, action.Target)
+			sort.Strings(rec.Nodes)
+		}
+	}
+}
+
+// reloadAuditRecords reopens the unfinished audit records that a previous run
+// of the controller, or another leader, left in the ConfigMap, so that the
+// cycles they describe carry on in them. Only the most recent record of each
+// UPS is reopened; older ones are closed with a note. Callers must hold
+// nd.mutex.
+func (nd *NodeDrainer) reloadAuditRecords() {
+	if nd.config == nil || nd.config.AuditConfigMap == "" {
+		return
+	}
+	records, err := LoadAuditRecords(context.Background(), nd.clientset, nd.config.AuditNamespace, nd.config.AuditConfigMap)
+	if err != nil {
+		log.Printf("Failed to reload open audit records: %v", err)
+		return
+	}
+
+	var closed []*AuditRecord
+	a := &nd.audit
+	a.mutex.Lock()
+	if a.open == nil {
+		a.open = make(map[string]*AuditRecord)
+	}
+	// Records are ordered by start time, so later ones supersede earlier ones
+	reopened := make(map[string]*AuditRecord)
+	for i := range records {
+		rec := &records[i]
+		if rec.Finished != nil {
+			continue
+		}
+		if open, ok := a.open[rec.UPS]; ok && open.ID == rec.ID {
+			// Still open in memory, e.g. when leadership returns
+			continue
+		}
+		if previous, ok := reopened[rec.UPS]; ok {
+			closed = append(closed, supersede(previous, rec.ID))
+		}
+		reopened[rec.UPS] = rec
+	}
+	for source, rec := range reopened {
+		if open, ok := a.open[source]; ok {
+			// A cycle started since supersedes the record
+			closed = append(closed, supersede(rec, open.ID))
+			continue
+		}
+		log.Printf("Reopened audit record %s of %s left open by a previous run", rec.ID, upsLabel(source))
+		a.open[source] = rec
+	}
+	a.mutex.Unlock()
+
+	for _, rec := range closed {
+		nd.saveAuditRecord(rec)
+	}
+}
+
+// supersede finishes rec, left open by a previous run, in favour of the
+// record with the given ID and returns it
+func supersede(rec *AuditRecord, id string) *AuditRecord {
+	rec.Note = "left open by a previous run of the controller, superseded by " + id
+	finish(rec)
+	return rec
+}
+
+// finish marks rec as finished now
+func finish(rec *AuditRecord) {
+	now := time.Now()
+	rec.Finished = &now
+	rec.Duration = now.Sub(rec.Started).Round(time.Second).String()
+}
+
+// auditID names a record after its UPS and start time
+func auditID(source string, started time.Time) string {
+	id := started.UTC().Format("20060102-150405.000000000")
+	if source != "" {
+		id += "-" + source
+	}
+	return id
+}
+
+// saveAuditRecord adds or updates rec in the audit ConfigMap, keeping the
+// most recent AuditMaxRecords records. Failures are logged, as the audit
+// trail never holds up a drain.
+func (nd *NodeDrainer) saveAuditRecord(rec *AuditRecord) {
+	if nd.config == nil || nd.config.AuditConfigMap == "" {
+		return
+	}
+	nd.audit.mutex.Lock()
+	snapshot := *rec
+	snapshot.Nodes = append([]string(nil), rec.Nodes...)
+	snapshot.Steps = append([]Action(nil), rec.Steps...)
+	snapshot.Evictions = append([]Action(nil), rec.Evictions...)
+	snapshot.Failures = append([]Action(nil), rec.Failures...)
+	nd.audit.mutex.Unlock()
+
+	namespace, name := nd.config.AuditNamespace, nd.config.AuditConfigMap
+	configMaps := nd.clientset.CoreV1().ConfigMaps(namespace)
+	ctx := context.Background()
+	err := retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		configMap, err := configMaps.Get(ctx, name, metav1.GetOptions{})
+		exists := err == nil
+		if apierrors.IsNotFound(err) {
+			configMap = &corev1.ConfigMap{ObjectMeta: metav1.ObjectMeta{Namespace: namespace, Name: name}}
+		} else if err != nil {
+			return err
+		}
+
+		records, err := parseAuditRecords(configMap.Data[AuditConfigMapKey])
+		if err != nil {
+			log.Printf("Replacing invalid audit records in ConfigMap %s/%s: %v", namespace, name, err)
+			records = nil
+		}
+		data, err := encodeAuditRecords(upsertAuditRecord(records, snapshot), nd.config.AuditMaxRecords)
+		if err != nil {
+			return err
+		}
+		if configMap.Data == nil {
+			configMap.Data = make(map[string]string)
+		}
+		configMap.Data[AuditConfigMapKey] = data
+
+		if !exists {
+			_, err = configMaps.Create(ctx, configMap, metav1.CreateOptions{})
+			if apierrors.IsAlreadyExists(err) {
+				// Created concurrently; retry as an update
+				return apierrors.NewConflict(corev1.Resource("configmaps"), name, err)
+			}
+			return err
+		}
+		_, err = configMaps.Update(ctx, configMap, metav1.UpdateOptions{})
+		return err
+	})
+	if err != nil {
+		log.Printf("Failed to save audit record %s to ConfigMap %s/%s: %v", rec.ID, namespace, name, err)
+	}
+}
+
+// upsertAuditRecord replaces the record with the ID of rec, or adds it, and
+// keeps the records ordered by start time
+func upsertAuditRecord(records []AuditRecord, rec AuditRecord) []AuditRecord {
+	replaced := false
+	for i := range records {
+		if records[i].ID == rec.ID {
+			records[i] = rec
+			replaced = true
+			break
+		}
+	}
+	if !replaced {
+		records = append(records, rec)
+	}
+	sort.SliceStable(records, func(i, j int) bool { return records[i].Started.Before(records[j].Started) })
+	return records
+}
+
+// encodeAuditRecords encodes the most recent max records, dropping older
+// ones, and then evictions of the oldest remaining one, until they fit the
+// ConfigMap
+func encodeAuditRecords(records []AuditRecord, max int) (string, error) {
+	if max > 0 && len(records) > max {
+		records = records[len(records)-max:]
+	}
+	for {
+		data, err := json.Marshal(records)
+		if err != nil || len(data) <= auditMaxBytes {
+			return string(data), err
+		}
+		if len(records) > 1 {
+			records = records[1:]
+			continue
+		}
+		rec := &records[0]
+		if len(rec.Evictions) == 0 {
+			return "", fmt.Errorf("audit record %s exceeds %d bytes", rec.ID, auditMaxBytes)
+		}
+		drop := (len(rec.Evictions) + 1) / 2
+		rec.Evictions = rec.Evictions[drop:]
+		rec.EvictionsOmitted += drop
+	}
+}
+
+// parseAuditRecords decodes the records of the audit ConfigMap
+func parseAuditRecords(data string) ([]AuditRecord, error) {
+	if data == "" {
+		return nil, nil
+	}
+	var records []AuditRecord
+	if err := json.Unmarshal([]byte(data), &records); err != nil {
+		return nil, err
+	}
+	return records, nil
+}
+
+// LoadAuditRecords reads the audit records kept in the named ConfigMap,
+// oldest first
+func LoadAuditRecords(ctx context.Context, clientset kubernetes.Interface, namespace, name string) ([]AuditRecord, error) {
+	configMap, err := clientset.CoreV1().ConfigMaps(namespace).Get(ctx, name, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get ConfigMap %s/%s: %w", namespace, name, err)
+	}
+	records, err := parseAuditRecords(configMap.Data[AuditConfigMapKey])
+	if err != nil {
+		return nil, fmt.Errorf("invalid audit records in ConfigMap %s/%s: %w", namespace, name, err)
+	}
+	return records, nil
+}
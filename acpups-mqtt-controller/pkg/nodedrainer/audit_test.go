@@ -0,0 +1,233 @@
+package nodedrainer
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+// auditRecords returns the records in the audit ConfigMap
+func (e *testEnv) auditRecords() []AuditRecord {
+	e.t.Helper()
+
+	records, err := LoadAuditRecords(context.Background(), e.clientset, e.config.AuditNamespace, e.config.AuditConfigMap)
+	if err != nil {
+		e.t.Fatalf("LoadAuditRecords: %v", err)
+	}
+	return records
+}
+
+// waitForAuditRecords waits until n finished records were saved
+func (e *testEnv) waitForAuditRecords(n int) []AuditRecord {
+	var records []AuditRecord
+	e.eventually(fmt.Sprintf("%d finished audit records", n), func() bool {
+		records = e.auditRecords()
+		if len(records) != n {
+			return false
+		}
+		for _, rec := range records {
+			if rec.Finished == nil {
+				return false
+			}
+		}
+		return true
+	})
+	return records
+}
+
+func targets(actions []Action) string {
+	var names []string
+	for _, action := range actions {
+		names = append(names, action.Action+" "+action.Target)
+	}
+	return strings.Join(names, ",")
+}
+
+func TestAuditRecordsDrainCycle(t *testing.T) {
+	env := newTestEnv(t, testConfig(), clusterObjects()...)
+
+	env.powerEvent("ONBATT", 30)
+	env.waitForDrained("worker-1", "worker-2")
+	env.eventually("open audit record", func() bool {
+		records := env.auditRecords()
+		return len(records) == 1 && records[0].Finished == nil && len(records[0].Evictions) == 2
+	})
+
+	env.powerEvent("ONLINE", 100)
+	env.waitForDrained()
+	rec := env.waitForAuditRecords(1)[0]
+
+	if rec.Trigger != AuditTriggerReading || rec.Reading == nil || rec.Reading.BatteryLevel != 30 {
+		t.Errorf("unexpected trigger %q, reading %+v", rec.Trigger, rec.Reading)
+	}
+	if strings.Join(rec.Nodes, ",") != "worker-1,worker-2" {
+		t.Errorf("nodes = %v, want worker-1 and worker-2", rec.Nodes)
+	}
+	evicted := map[string]bool{}
+	for _, eviction := range rec.Evictions {
+		if eviction.Time.IsZero() {
+			t.Errorf("eviction of %s has no timestamp", eviction.Target)
+		}
+		evicted[eviction.Target] = true
+	}
+	if len(evicted) != 2 || !evicted["default/app-1"] || !evicted["default/app-2"] {
+		t.Errorf("unexpected evictions %s", targets(rec.Evictions))
+	}
+	uncordoned := 0
+	for _, step := range rec.Steps {
+		if step.Action == ActionUncordon {
+			uncordoned++
+		}
+	}
+	if uncordoned != 2 {
+		t.Errorf("expected 2 uncordon steps, got %s", targets(rec.Steps))
+	}
+	if len(rec.Failures) != 0 || rec.Duration == "" {
+		t.Errorf("unexpected failures %s, duration %q", targets(rec.Failures), rec.Duration)
+	}
+}
+
+func TestAuditRecordsFailures(t *testing.T) {
+	env := newTestEnv(t, testConfig(), clusterObjects()...)
+	env.failEviction("app-1", apierrors.NewForbidden(schema.GroupResource{Resource: "pods"}, "app-1", nil))
+
+	env.powerEvent("ONBATT", 30)
+	env.eventually("failures in audit record", func() bool {
+		records := env.auditRecords()
+		return len(records) == 1 && targets(records[0].Failures) == "evict default/app-1,drain worker-1"
+	})
+}
+
+func TestAuditRecordsConcurrentDrains(t *testing.T) {
+	config := testConfig()
+	config.MQTTTopic = "test/ups/+/status"
+	env := newTestEnv(t, config,
+		testNode("rack-a-1", map[string]string{DefaultSourceLabel: "rack-a"}),
+		testNode("rack-b-1", map[string]string{DefaultSourceLabel: "rack-b"}),
+		testPod("default", "web-a-1", "rack-a-1", "ReplicaSet"),
+		testPod("default", "web-b-1", "rack-b-1", "ReplicaSet"),
+	)
+	env.failEviction("web-a-1", apierrors.NewTooManyRequests("Cannot evict pod as it would violate the pod's disruption budget.", 0))
+
+	// The drain of rack-b goes ahead while the one of rack-a is blocked
+	env.send("test/ups/rack-a/status", UPSStatus{BatteryLevel: 30, Status: "ONBATT"})
+	env.send("test/ups/rack-b/status", UPSStatus{BatteryLevel: 30, Status: "ONBATT"})
+	env.eventually("rack-b drained", func() bool {
+		return env.node("rack-b-1").Annotations[DrainPhaseAnnotation] == DrainPhaseDrained
+	})
+	if !env.draining() {
+		t.Fatalf("drain of rack-a finished before the drain timeout")
+	}
+	env.waitForDrains()
+
+	records := map[string]AuditRecord{}
+	for _, rec := range env.auditRecords() {
+		records[rec.UPS] = rec
+	}
+	if rec := records["rack-a"]; strings.Join(rec.Nodes, ",") != "rack-a-1" || len(rec.Evictions) != 0 || targets(rec.Failures) != "evict default/web-a-1,drain rack-a-1" {
+		t.Errorf("unexpected rack-a record %+v", rec)
+	}
+	if rec := records["rack-b"]; strings.Join(rec.Nodes, ",") != "rack-b-1" || targets(rec.Evictions) != "evict default/web-b-1" || len(rec.Failures) != 0 {
+		t.Errorf("unexpected rack-b record %+v", rec)
+	}
+}
+
+func TestAuditRecordsManualCommands(t *testing.T) {
+	env := newTestEnv(t, testConfig(), clusterObjects()...)
+
+	if _, err := env.drainer.DrainNodes(context.Background(), "", []string{"worker-1"}); err != nil {
+		t.Fatalf("DrainNodes: %v", err)
+	}
+	env.waitForDrained("worker-1")
+	if _, err := env.drainer.UncordonNodes("", nil); err != nil {
+		t.Fatalf("UncordonNodes: %v", err)
+	}
+
+	records := env.waitForAuditRecords(2)
+	if records[0].Trigger != AuditTriggerManualDrain || targets(records[0].Evictions) != "evict default/app-1" {
+		t.Errorf("unexpected drain record %+v", records[0])
+	}
+	if records[1].Trigger != AuditTriggerManualUncordon || strings.Join(records[1].Nodes, ",") != "worker-1" {
+		t.Errorf("unexpected uncordon record %+v", records[1])
+	}
+}
+
+func TestAuditRecordsLeftOpenAreReloaded(t *testing.T) {
+	config := testConfig()
+	started := time.Now().Add(-time.Hour)
+	finished := started.Add(10 * time.Minute)
+	data, err := json.Marshal([]AuditRecord{
+		{ID: "done", Trigger: AuditTriggerReading, Started: started, Finished: &finished},
+		{ID: "stale", Trigger: AuditTriggerReading, Started: started.Add(20 * time.Minute)},
+		{ID: "current", Trigger: AuditTriggerReading, Started: started.Add(30 * time.Minute), Nodes: []string{"worker-1"}},
+	})
+	if err != nil {
+		t.Fatalf("failed to encode records: %v", err)
+	}
+	configMap := &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Namespace: config.AuditNamespace, Name: config.AuditConfigMap},
+		Data:       map[string]string{AuditConfigMapKey: string(data)},
+	}
+	env := newTestEnv(t, config, append(clusterObjects(), configMap)...)
+
+	// The recovery finishes the cycle the previous run left open
+	env.powerEvent("ONLINE", 100)
+	records := env.waitForAuditRecords(3)
+
+	if rec := records[1]; rec.ID != "stale" || !strings.Contains(rec.Note, "superseded by current") {
+		t.Errorf("older open record not closed with a note: %+v", rec)
+	}
+	if rec := records[2]; rec.ID != "current" || rec.Note != "" || strings.Join(rec.Nodes, ",") != "worker-1" {
+		t.Errorf("most recent open record not carried on: %+v", rec)
+	}
+}
+
+func TestEncodeAuditRecords(t *testing.T) {
+	started := time.Date(2025, 9, 15, 12, 0, 0, 0, time.UTC)
+	var records []AuditRecord
+	for i := 0; i < 5; i++ {
+		records = upsertAuditRecord(records, AuditRecord{ID: fmt.Sprint(i), Started: started.Add(time.Duration(i) * time.Hour)})
+	}
+	// Updating a record keeps its place
+	records = upsertAuditRecord(records, AuditRecord{ID: "2", Started: records[2].Started, Trigger: "updated"})
+
+	data, err := encodeAuditRecords(records, 3)
+	if err != nil {
+		t.Fatalf("encodeAuditRecords: %v", err)
+	}
+	kept, err := parseAuditRecords(data)
+	if err != nil {
+		t.Fatalf("parseAuditRecords: %v", err)
+	}
+	if len(kept) != 3 || kept[0].ID != "2" || kept[0].Trigger != "updated" || kept[2].ID != "4" {
+		t.Errorf("unexpected records %+v", kept)
+	}
+
+	// Evictions of a huge record are dropped to fit the ConfigMap
+	huge := AuditRecord{ID: "huge"}
+	for i := 0; i < 10000; i++ {
+		huge.Evictions = append(huge.Evictions, Action{Action: ActionEvict, Target: fmt.Sprintf("default/pod-%d", i), Message: "evicted from node worker-1"})
+	}
+	data, err = encodeAuditRecords([]AuditRecord{huge}, 3)
+	if err != nil {
+		t.Fatalf("encodeAuditRecords: %v", err)
+	}
+	if len(data) > auditMaxBytes {
+		t.Errorf("encoded %d bytes, limit is %d", len(data), auditMaxBytes)
+	}
+	var trimmed []AuditRecord
+	if err := json.Unmarshal([]byte(data), &trimmed); err != nil {
+		t.Fatalf("failed to decode records: %v", err)
+	}
+	if trimmed[0].EvictionsOmitted == 0 || trimmed[0].EvictionsOmitted+len(trimmed[0].Evictions) != 10000 {
+		t.Errorf("omitted %d of 10000 evictions, kept %d", trimmed[0].EvictionsOmitted, len(trimmed[0].Evictions))
+	}
+}
@@ -0,0 +1,131 @@
+package nodedrainer
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	listerscorev1 "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/util/retry"
+)
+
+const (
+	// informerResync is how often the node and pod caches are resynced
+	informerResync = 10 * time.Minute
+
+	// podNodeIndex indexes cached pods by the node they are scheduled on
+	podNodeIndex = "spec.nodeName"
+)
+
+// informerCache caches nodes and pods so that status messages do not list them
+// from the API server
+type informerCache struct {
+	factory     informers.SharedInformerFactory
+	nodes       listerscorev1.NodeLister
+	pods        cache.SharedIndexInformer
+	nodesSynced cache.InformerSynced
+}
+
+func newInformerCache(clientset kubernetes.Interface) *informerCache {
+	factory := informers.NewSharedInformerFactory(clientset, informerResync)
+	nodeInformer := factory.Core().V1().Nodes()
+	podInformer := factory.Core().V1().Pods().Informer()
+
+	// Cannot fail before the informer is started
+	_ = podInformer.AddIndexers(cache.Indexers{
+		podNodeIndex: func(obj interface{}) ([]string, error) {
+			pod, ok := obj.(*corev1.Pod)
+			if !ok || pod.Spec.NodeName == "" {
+				return nil, nil
+			}
+			return []string{pod.Spec.NodeName}, nil
+		},
+	})
+
+	return &informerCache{
+		factory:     factory,
+		nodes:       nodeInformer.Lister(),
+		pods:        podInformer,
+		nodesSynced: nodeInformer.Informer().HasSynced,
+	}
+}
+
+// Start fills the node and pod caches and keeps them up to date until ctx is
+// done. It must be called before the drainer handles any UPS status.
+func (nd *NodeDrainer) Start(ctx context.Context) error {
+	nd.cache.factory.Start(ctx.Done())
+	if !cache.WaitForCacheSync(ctx.Done(), nd.cache.nodesSynced, nd.cache.pods.HasSynced) {
+		return fmt.Errorf("timed out waiting for node and pod caches to sync")
+	}
+	return nil
+}
+
+// listNodes returns the cached nodes matching selector, ordered by name so
+// that reports derived from them are stable; nil selects all. The returned
+// nodes are shared with the cache and must not be modified.
+func (nd *NodeDrainer) listNodes(selector labels.Selector) ([]corev1.Node, error) {
+	if selector == nil {
+		selector = labels.Everything()
+	}
+	cached, err := nd.cache.nodes.List(selector)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list nodes: %w", err)
+	}
+
+	nodes := make([]corev1.Node, 0, len(cached))
+	for _, node := range cached {
+		nodes = append(nodes, *node)
+	}
+	sort.Slice(nodes, func(i, j int) bool { return nodes[i].Name < nodes[j].Name })
+	return nodes, nil
+}
+
+// podsOnNode returns the cached pods scheduled on the named node. The
+// returned pods are shared with the cache and must not be modified.
+func (nd *NodeDrainer) podsOnNode(name string) ([]corev1.Pod, error) {
+	cached, err := nd.cache.pods.GetIndexer().ByIndex(podNodeIndex, name)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list pods on node %s: %w", name, err)
+	}
+
+	pods := make([]corev1.Pod, 0, len(cached))
+	for _, obj := range cached {
+		if pod, ok := obj.(*corev1.Pod); ok {
+			pods = append(pods, *pod)
+		}
+	}
+	return pods, nil
+}
+
+// patchNode applies a strategic merge patch to the named node, retrying a
+// few times on conflicts. The patch carries no resourceVersion and only
+// touches the fields it names, but the API server still reports a conflict
+// when it loses a race applying it to a node updated concurrently.
+func (nd *NodeDrainer) patchNode(ctx context.Context, name string, patch map[string]interface{}) error {
+	data, err := json.Marshal(patch)
+	if err != nil {
+		return err
+	}
+
+	return retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		_, err := nd.clientset.CoreV1().Nodes().Patch(ctx, name, types.StrategicMergePatchType, data, metav1.PatchOptions{})
+		return err
+	})
+}
+
+// annotationPatch returns a patch setting the given node annotations; nil
+// values remove the annotation
+func annotationPatch(annotations map[string]interface{}) map[string]interface{} {
+	return map[string]interface{}{
+		"metadata": map[string]interface{}{"annotations": annotations},
+	}
+}
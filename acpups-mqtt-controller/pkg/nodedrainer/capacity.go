@@ -0,0 +1,310 @@
+package nodedrainer
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+)
+
+// Capacity check modes
+const (
+	// CapacityCheckOff drains without looking at the remaining capacity
+	CapacityCheckOff = "off"
+	// CapacityCheckWarn reports when the evicted pods would not fit on the
+	// remaining nodes, and drains anyway
+	CapacityCheckWarn = "warn"
+	// CapacityCheckEnforce holds back nodes until the evicted pods fit on the
+	// remaining nodes
+	CapacityCheckEnforce = "enforce"
+)
+
+// CapacityReport is the outcome of the capacity safeguards for a drain,
+// reported before any node is cordoned
+type CapacityReport struct {
+	// WorkerNodes is the number of selected worker nodes across all UPSes
+	WorkerNodes int `json:"workerNodes"`
+	// Drained is the number of worker nodes already drained by us
+	Drained int `json:"drained"`
+	// MaxDrained is how many worker nodes may be drained at once
+	MaxDrained int `json:"maxDrained"`
+	// Held lists the drain candidates kept schedulable
+	Held []HeldNode `json:"held,omitempty"`
+	// Fits reports whether the pods evicted from the nodes to drain fit on
+	// the remaining schedulable nodes; nil when the check is off
+	Fits *bool `json:"fits,omitempty"`
+	// Unplaced lists the evicted pods that would not fit anywhere
+	Unplaced []string `json:"unplaced,omitempty"`
+}
+
+// HeldNode is a drain candidate kept schedulable by the capacity safeguards
+type HeldNode struct {
+	Node   string `json:"node"`
+	Reason string `json:"reason"`
+}
+
+// String summarizes the report for logs and the action log
+func (r *CapacityReport) String() string {
+	s := fmt.Sprintf("%d of %d worker nodes drained, at most %d", r.Drained, r.WorkerNodes, r.MaxDrained)
+	if len(r.Held) > 0 {
+		var held []string
+		for _, h := range r.Held {
+			held = append(held, fmt.Sprintf("%s (%s)", h.Node, h.Reason))
+		}
+		s += "; holding " + strings.Join(held, ", ")
+	}
+	if r.Fits != nil && !*r.Fits {
+		s += fmt.Sprintf("; %d evicted pods will not fit on the remaining nodes: %s", len(r.Unplaced), strings.Join(r.Unplaced, ", "))
+	}
+	return s
+}
+
+// isLastResortNode reports whether node must stay schedulable. Callers must
+// hold nd.mutex.
+func (nd *NodeDrainer) isLastResortNode(node *corev1.Node) bool {
+	selector := nd.config.LastResortSelector
+	return selector != nil && !selector.Empty() && selector.Matches(labels.Set(node.Labels))
+}
+
+// applySafeguards limits the nodes about to be drained to MaxDrainPercent of
+// the worker nodes and, with CapacityCheckEnforce, to as many as leave room
+// for their pods. Nodes already cordoned by us, whose drain is resumed, are
+// never held back and come first; the others are kept in name order.
+// Callers must hold nd.mutex.
+func (nd *NodeDrainer) applySafeguards(nodes []corev1.Node) ([]corev1.Node, *CapacityReport, error) {
+	sort.SliceStable(nodes, func(i, j int) bool {
+		if a, b := cordonedByUs(&nodes[i]), cordonedByUs(&nodes[j]); a != b {
+			return a
+		}
+		return nodes[i].Name < nodes[j].Name
+	})
+	resumed := 0
+	for resumed < len(nodes) && cordonedByUs(&nodes[resumed]) {
+		resumed++
+	}
+
+	workers, err := nd.listNodes(nd.config.NodeSelector)
+	if err != nil {
+		return nil, nil, err
+	}
+	report := &CapacityReport{}
+	for i := range workers {
+		if nd.isControlPlaneNode(&workers[i]) {
+			continue
+		}
+		report.WorkerNodes++
+		if cordonedByUs(&workers[i]) {
+			report.Drained++
+		}
+	}
+
+	report.MaxDrained = report.WorkerNodes * nd.config.MaxDrainPercent / 100
+	if allowed := resumed + report.MaxDrained - report.Drained; len(nodes) > allowed {
+		if allowed < resumed {
+			allowed = resumed
+		}
+		for _, node := range nodes[allowed:] {
+			report.Held = append(report.Held, HeldNode{Node: node.Name,
+				Reason: fmt.Sprintf("at most %d%% of %d worker nodes are drained", nd.config.MaxDrainPercent, report.WorkerNodes)})
+		}
+		nodes = nodes[:allowed]
+	}
+
+	if nd.config.CapacityCheck == CapacityCheckOff || len(nodes) == 0 {
+		return nodes, report, nil
+	}
+
+	unplaced, err := nd.unplacedPods(nodes)
+	if err != nil {
+		return nil, nil, err
+	}
+	if nd.config.CapacityCheck == CapacityCheckEnforce {
+		// Hold back nodes from the end until the rest fits
+		n := len(nodes)
+		for n > resumed && len(unplaced) > 0 {
+			n--
+			report.Held = append(report.Held, HeldNode{Node: nodes[n].Name, Reason: "remaining nodes cannot fit its pods"})
+			if unplaced, err = nd.unplacedPods(nodes[:n]); err != nil {
+				return nil, nil, err
+			}
+		}
+		nodes = nodes[:n]
+	}
+	fits := len(unplaced) == 0
+	report.Fits = &fits
+	report.Unplaced = unplaced
+	return nodes, report, nil
+}
+
+// reportCapacity logs the outcome of the safeguards and records it in the
+// action log when they held back nodes or found too little room. Callers
+// must hold nd.mutex.
+func (nd *NodeDrainer) reportCapacity(source string, report *CapacityReport) {
+	log.Printf("Capacity safeguards for %s: %s", upsLabel(source), report)
+	if len(report.Held) == 0 && (report.Fits == nil || *report.Fits) {
+		return
+	}
+	nd.recordAction(Action{Action: ActionCapacity, UPS: source, Message: report.String()})
+}
+
+// unplacedPods returns the pods that draining nodes would evict, and that
+// their controllers would recreate, which do not fit on the remaining
+// schedulable nodes. Pods are placed first-fit in decreasing size by CPU,
+// memory and pod count, honouring node selectors and taints but not
+// affinity. Callers must hold nd.mutex.
+func (nd *NodeDrainer) unplacedPods(drain []corev1.Node) ([]string, error) {
+	draining := make(map[string]bool, len(drain))
+	var pods []corev1.Pod
+	for i := range drain {
+		draining[drain[i].Name] = true
+		evictable, _, err := nd.evictablePods(&drain[i])
+		if err != nil {
+			return nil, err
+		}
+		for _, pod := range evictable {
+			// Pods without a controller are not recreated elsewhere
+			if metav1.GetControllerOf(&pod) != nil {
+				pods = append(pods, pod)
+			}
+		}
+	}
+	if len(pods) == 0 {
+		return nil, nil
+	}
+
+	nodes, err := nd.listNodes(nil)
+	if err != nil {
+		return nil, err
+	}
+	var free []nodeRoom
+	for i := range nodes {
+		node := &nodes[i]
+		if draining[node.Name] || node.Spec.Unschedulable {
+			continue
+		}
+		room, err := nd.freeRoom(node)
+		if err != nil {
+			return nil, err
+		}
+		free = append(free, room)
+	}
+
+	sort.SliceStable(pods, func(i, j int) bool {
+		a, b := podRequests(&pods[i]), podRequests(&pods[j])
+		if c := a.Cpu().Cmp(*b.Cpu()); c != 0 {
+			return c > 0
+		}
+		return a.Memory().Cmp(*b.Memory()) > 0
+	})
+
+	var unplaced []string
+	for i := range pods {
+		if !placePod(&pods[i], free) {
+			unplaced = append(unplaced, podKey(&pods[i]))
+		}
+	}
+	sort.Strings(unplaced)
+	return unplaced, nil
+}
+
+// nodeRoom is the unrequested capacity of a schedulable node
+type nodeRoom struct {
+	node   *corev1.Node
+	cpu    resource.Quantity
+	memory resource.Quantity
+	pods   int64
+}
+
+// freeRoom returns the allocatable resources of node not requested by the
+// pods running on it
+func (nd *NodeDrainer) freeRoom(node *corev1.Node) (nodeRoom, error) {
+	room := nodeRoom{
+		node:   node,
+		cpu:    node.Status.Allocatable.Cpu().DeepCopy(),
+		memory: node.Status.Allocatable.Memory().DeepCopy(),
+		pods:   node.Status.Allocatable.Pods().Value(),
+	}
+
+	pods, err := nd.podsOnNode(node.Name)
+	if err != nil {
+		return room, err
+	}
+	for i := range pods {
+		if pods[i].Status.Phase == corev1.PodSucceeded || pods[i].Status.Phase == corev1.PodFailed {
+			continue
+		}
+		requests := podRequests(&pods[i])
+		room.cpu.Sub(*requests.Cpu())
+		room.memory.Sub(*requests.Memory())
+		room.pods--
+	}
+	return room, nil
+}
+
+// placePod reserves room for pod on the first node that has enough and
+// accepts it, and reports whether there was one
+func placePod(pod *corev1.Pod, free []nodeRoom) bool {
+	requests := podRequests(pod)
+	for i := range free {
+		room := &free[i]
+		if room.pods < 1 || room.cpu.Cmp(*requests.Cpu()) < 0 || room.memory.Cmp(*requests.Memory()) < 0 {
+			continue
+		}
+		if !labels.SelectorFromSet(pod.Spec.NodeSelector).Matches(labels.Set(room.node.Labels)) || !toleratesTaints(pod, room.node) {
+			continue
+		}
+		room.cpu.Sub(*requests.Cpu())
+		room.memory.Sub(*requests.Memory())
+		room.pods--
+		return true
+	}
+	return false
+}
+
+// toleratesTaints reports whether pod tolerates the taints of node that keep
+// pods off it
+func toleratesTaints(pod *corev1.Pod, node *corev1.Node) bool {
+	for i := range node.Spec.Taints {
+		taint := &node.Spec.Taints[i]
+		if taint.Effect == corev1.TaintEffectPreferNoSchedule {
+			continue
+		}
+		tolerated := false
+		for j := range pod.Spec.Tolerations {
+			if pod.Spec.Tolerations[j].ToleratesTaint(taint) {
+				tolerated = true
+				break
+			}
+		}
+		if !tolerated {
+			return false
+		}
+	}
+	return true
+}
+
+// podRequests returns the CPU and memory the scheduler reserves for pod: the
+// larger of its containers' and any init container's requests, plus overhead
+func podRequests(pod *corev1.Pod) corev1.ResourceList {
+	cpu, memory := resource.Quantity{}, resource.Quantity{}
+	for _, c := range pod.Spec.Containers {
+		cpu.Add(*c.Resources.Requests.Cpu())
+		memory.Add(*c.Resources.Requests.Memory())
+	}
+	for _, c := range pod.Spec.InitContainers {
+		if c.Resources.Requests.Cpu().Cmp(cpu) > 0 {
+			cpu = c.Resources.Requests.Cpu().DeepCopy()
+		}
+		if c.Resources.Requests.Memory().Cmp(memory) > 0 {
+			memory = c.Resources.Requests.Memory().DeepCopy()
+		}
+	}
+	cpu.Add(*pod.Spec.Overhead.Cpu())
+	memory.Add(*pod.Spec.Overhead.Memory())
+	return corev1.ResourceList{corev1.ResourceCPU: cpu, corev1.ResourceMemory: memory}
+}
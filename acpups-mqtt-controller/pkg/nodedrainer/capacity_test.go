@@ -0,0 +1,155 @@
+package nodedrainer
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+// sizedNode returns a worker node with cpu allocatable and room for 110 pods
+func sizedNode(name, cpu string) *corev1.Node {
+	node := testNode(name, nil)
+	node.Status.Allocatable = corev1.ResourceList{
+		corev1.ResourceCPU:    resource.MustParse(cpu),
+		corev1.ResourceMemory: resource.MustParse("8Gi"),
+		corev1.ResourcePods:   resource.MustParse("110"),
+	}
+	return node
+}
+
+// sizedPod returns a ReplicaSet pod on node requesting cpu
+func sizedPod(name, node, cpu string) *corev1.Pod {
+	pod := testPod("default", name, node, "ReplicaSet")
+	pod.Spec.Containers = []corev1.Container{{
+		Name:      "app",
+		Resources: corev1.ResourceRequirements{Requests: corev1.ResourceList{corev1.ResourceCPU: resource.MustParse(cpu)}},
+	}}
+	return pod
+}
+
+func TestMaxDrainPercentHoldsNodes(t *testing.T) {
+	config := testConfig()
+	config.MaxDrainPercent = 50
+	config.CapacityCheck = CapacityCheckOff
+	env := newTestEnv(t, config, clusterObjects()...)
+
+	plan, err := env.drainer.PlanDrain(context.Background(), "", nil)
+	if err != nil {
+		t.Fatalf("PlanDrain: %v", err)
+	}
+	if plan.Capacity == nil || plan.Capacity.WorkerNodes != 2 || plan.Capacity.MaxDrained != 1 {
+		t.Fatalf("unexpected capacity report %+v", plan.Capacity)
+	}
+	if len(plan.Capacity.Held) != 1 || plan.Capacity.Held[0].Node != "worker-2" {
+		t.Errorf("expected worker-2 to be held, got %+v", plan.Capacity.Held)
+	}
+
+	env.powerEvent("ONBATT", 30)
+	env.waitForDrained("worker-1")
+	// Further readings do not drain past the limit
+	env.powerEvent("ONBATT", 25)
+	env.waitForDrained("worker-1")
+}
+
+func TestLastResortNodeStaysSchedulable(t *testing.T) {
+	config := testConfig()
+	config.LastResortSelector = labels.SelectorFromSet(labels.Set{"ups.example.com/last-resort": "true"})
+	objects := append(clusterObjects(), testNode("worker-3", map[string]string{"ups.example.com/last-resort": "true"}))
+	env := newTestEnv(t, config, objects...)
+
+	env.powerEvent("ONBATT", 30)
+	env.waitForDrained("worker-1", "worker-2")
+	if env.node("worker-3").Spec.Unschedulable {
+		t.Errorf("last resort node worker-3 was cordoned")
+	}
+
+	if _, err := env.drainer.PlanDrain(context.Background(), "", []string{"worker-3"}); err == nil || !strings.Contains(err.Error(), "last resort node") {
+		t.Errorf("expected planning to drain worker-3 to fail, got %v", err)
+	}
+}
+
+func TestCapacityCheck(t *testing.T) {
+	// Draining both rack nodes leaves room on worker-3 for only one of their pods
+	objects := func() []runtime.Object {
+		return []runtime.Object{
+			sizedNode("worker-1", "2"),
+			sizedNode("worker-2", "2"),
+			sizedNode("worker-3", "4"),
+			sizedPod("app-1", "worker-1", "1500m"),
+			sizedPod("app-2", "worker-2", "1500m"),
+			sizedPod("app-3", "worker-3", "1500m"),
+			testPod("default", "standalone", "worker-2", ""),
+		}
+	}
+
+	tests := []struct {
+		mode     string
+		drain    string
+		held     string
+		fits     bool
+		unplaced string
+	}{
+		{CapacityCheckWarn, "worker-1,worker-2", "", false, "default/app-2"},
+		{CapacityCheckEnforce, "worker-1", "worker-2", true, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.mode, func(t *testing.T) {
+			config := testConfig()
+			config.CapacityCheck = tt.mode
+			env := newTestEnv(t, config, objects()...)
+
+			plan, err := env.drainer.PlanDrain(context.Background(), "", []string{"worker-1", "worker-2"})
+			if err != nil {
+				t.Fatalf("PlanDrain: %v", err)
+			}
+			var drain, held []string
+			for _, node := range plan.Drain {
+				drain = append(drain, node.Node)
+			}
+			for _, node := range plan.Capacity.Held {
+				held = append(held, node.Node)
+			}
+			if strings.Join(drain, ",") != tt.drain || strings.Join(held, ",") != tt.held {
+				t.Errorf("planned to drain %v and hold %v, want %s and %s", drain, held, tt.drain, tt.held)
+			}
+			if plan.Capacity.Fits == nil || *plan.Capacity.Fits != tt.fits || strings.Join(plan.Capacity.Unplaced, ",") != tt.unplaced {
+				t.Errorf("unexpected capacity report %s", plan.Capacity)
+			}
+
+			report, err := env.drainer.DrainNodes(context.Background(), "", []string{"worker-1", "worker-2"})
+			if err != nil {
+				t.Fatalf("DrainNodes: %v", err)
+			}
+			if report.String() != plan.Capacity.String() {
+				t.Errorf("drain reported %q, plan %q", report, plan.Capacity)
+			}
+			env.waitForDrained(strings.Split(tt.drain, ",")...)
+		})
+	}
+}
+
+func TestPodRequests(t *testing.T) {
+	pod := sizedPod("app", "worker-1", "500m")
+	pod.Spec.Containers = append(pod.Spec.Containers, corev1.Container{
+		Name:      "sidecar",
+		Resources: corev1.ResourceRequirements{Requests: corev1.ResourceList{corev1.ResourceMemory: resource.MustParse("1Gi")}},
+	})
+	pod.Spec.InitContainers = []corev1.Container{{
+		Name:      "init",
+		Resources: corev1.ResourceRequirements{Requests: corev1.ResourceList{corev1.ResourceCPU: resource.MustParse("2")}},
+	}}
+	pod.Spec.Overhead = corev1.ResourceList{corev1.ResourceCPU: resource.MustParse("100m")}
+
+	requests := podRequests(pod)
+	if cpu := requests.Cpu(); cpu.MilliValue() != 2100 {
+		t.Errorf("cpu = %s, want 2100m", cpu)
+	}
+	if memory := requests.Memory(); memory.Value() != 1<<30 {
+		t.Errorf("memory = %s, want 1Gi", memory)
+	}
+}
@@ -6,6 +6,7 @@
 //   - Uncordons nodes when power is restored
 //   - Preserves control plane nodes (never drains them)
 //   - Handles graceful pod eviction respecting DaemonSets and system pods
+//   - Optionally follows a UPSPolicy custom resource and reports status to it
 //
 // Example usage:
 //
@@ -3,13 +3,15 @@ package nodedrainer
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
+	"sort"
+	"sync"
+	"time"
 
 	mqtt "github.com/eclipse/paho.mqtt.golang"
 	corev1 "k8s.io/api/core/v1"
-	policyv1beta1 "k8s.io/api/policy/v1beta1"
-	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/client-go/kubernetes"
 )
 
@@ -20,12 +22,17 @@ const (
 	UPSDrainerValue = "ups-node-drainer"
 )
 
-// New creates a new NodeDrainer instance
-func New(clientset *kubernetes.Clientset, mqttClient mqtt.Client) *NodeDrainer {
-	return &NodeDrainer{
+// New creates a new NodeDrainer instance. Start must be called before it
+// handles UPS status messages.
+func New(clientset kubernetes.Interface, mqttClient mqtt.Client) *NodeDrainer {
+	nd := &NodeDrainer{
 		clientset:  clientset,
+		cache:      newInformerCache(clientset),
 		mqttClient: mqttClient,
+		recorder:   newEventRecorder(clientset),
 	}
+	nd.metrics = newMetrics(nd)
+	return nd
 }
 
 // Subscribe subscribes to the MQTT topic and starts handling UPS status messages
@@ -34,48 +41,126 @@ func (nd *NodeDrainer) Subscribe(config *Config) error {
 		config = DefaultConfig()
 	}
 
-	// Store config in the drainer instance
-	nd.config = config
+	// Store config in the drainer instance, and carry on with the cycles a
+	// previous run left open before readings arrive
+	nd.mutex.Lock()
+	nd.storeConfig(config)
+	nd.reloadAuditRecords()
+	nd.mutex.Unlock()
 
-	token := nd.mqttClient.Subscribe(config.MQTTTopic, config.QoS, func(client mqtt.Client, msg mqtt.Message) {
-		var status UPSStatus
-		if err := json.Unmarshal(msg.Payload(), &status); err != nil {
-			log.Printf("Failed to parse UPS status: %v", err)
-			return
-		}
+	nd.subscribeMutex.Lock()
+	err := nd.subscribe(config)
+	nd.subscribeMutex.Unlock()
+	if err != nil {
+		return err
+	}
 
-		log.Printf("Received UPS status: %+v", status)
-		nd.lastStatus = &status
-		nd.handleUPSStatus(&status)
-	})
+	// Replace whatever state a previous run left retained
+	nd.mutex.RLock()
+	nd.publishState()
+	nd.mutex.RUnlock()
+	return nil
+}
+
+// Configure sets the configuration without subscribing to MQTT, for callers
+// that only plan actions
+func (nd *NodeDrainer) Configure(config *Config) {
+	nd.mutex.Lock()
+	defer nd.mutex.Unlock()
+	nd.storeConfig(config)
+}
 
+// subscribe subscribes to the topics of config. Callers must hold
+// nd.subscribeMutex.
+func (nd *NodeDrainer) subscribe(config *Config) error {
+	token := nd.mqttClient.Subscribe(config.MQTTTopic, config.QoS, nd.onMessage)
 	if token.Wait() && token.Error() != nil {
 		return fmt.Errorf("failed to subscribe to %s: %w", config.MQTTTopic, token.Error())
 	}
+	nd.subscribed = append(nd.subscribed, config.MQTTTopic)
+
+	if config.AvailabilityTopic != "" {
+		token := nd.mqttClient.Subscribe(config.AvailabilityTopic, config.QoS, nd.onAvailability)
+		if token.Wait() && token.Error() != nil {
+			return fmt.Errorf("failed to subscribe to %s: %w", config.AvailabilityTopic, token.Error())
+		}
+		nd.subscribed = append(nd.subscribed, config.AvailabilityTopic)
+	}
+
+	if config.CommandTopic != "" {
+		token := nd.mqttClient.Subscribe(config.CommandTopic, config.QoS, nd.onCommand)
+		if token.Wait() && token.Error() != nil {
+			return fmt.Errorf("failed to subscribe to %s: %w", config.CommandTopic, token.Error())
+		}
+		nd.subscribed = append(nd.subscribed, config.CommandTopic)
+	}
+
+	if nd.active.CompareAndSwap(false, true) {
+		nd.subscribedAt.Store(time.Now().UnixNano())
+	}
+	nd.watchdog.Do(func() {
+		go nd.watchStaleness()
+	})
 
 	log.Printf("Subscribed to MQTT topic: %s with battery drain threshold: %d%%", config.MQTTTopic, config.BatteryDrainThreshold)
 	return nil
 }
 
-// GetLastStatus returns the last received UPS status
+func (nd *NodeDrainer) onMessage(client mqtt.Client, msg mqtt.Message) {
+	nd.mutex.RLock()
+	config := nd.config
+	nd.mutex.RUnlock()
+	if isAvailabilityTopic(config, msg.Topic()) {
+		// Matched by a "#" status topic; onAvailability handles it if subscribed
+		return
+	}
+
+	var status UPSStatus
+	if err := json.Unmarshal(msg.Payload(), &status); err != nil {
+		nd.deadLetter(msg, err)
+		return
+	}
+
+	source := sourceFromTopic(config.MQTTTopic, msg.Topic())
+
+	log.Printf("Received %s status: %+v", upsLabel(source), status)
+	nd.handleUPSStatus(source, &status)
+}
+
+// GetLastStatus returns the most recently received UPS status of any UPS
 func (nd *NodeDrainer) GetLastStatus() *UPSStatus {
 	nd.mutex.RLock()
 	defer nd.mutex.RUnlock()
-	return nd.lastStatus
+
+	var last *upsSource
+	for _, src := range nd.sources {
+		if src.lastStatus != nil && (last == nil || src.lastReceived.After(last.lastReceived)) {
+			last = src
+		}
+	}
+	if last == nil {
+		return nil
+	}
+	return last.lastStatus
 }
 
 // GetDrainedNodes returns the currently drained worker nodes by checking node state
 func (nd *NodeDrainer) GetDrainedNodes() ([]string, error) {
-	ctx := context.Background()
-	nodes, err := nd.clientset.CoreV1().Nodes().List(ctx, metav1.ListOptions{})
+	return nd.drainedNodes("")
+}
+
+// drainedNodes returns the worker nodes powered by the named UPS that are
+// currently drained by us; "" matches every node
+func (nd *NodeDrainer) drainedNodes(source string) ([]string, error) {
+	nodes, err := nd.listNodes(nil)
 	if err != nil {
-		return nil, fmt.Errorf("failed to list nodes: %w", err)
+		return nil, err
 	}
 
 	var drainedNodes []string
-	for _, node := range nodes.Items {
+	for _, node := range nodes {
 		// Skip control plane nodes
-		if nd.isControlPlaneNode(&node) {
+		if nd.isControlPlaneNode(&node) || !nd.fedBy(&node, source) {
 			continue
 		}
 
@@ -90,66 +175,235 @@ func (nd *NodeDrainer) GetDrainedNodes() ([]string, error) {
 	return drainedNodes, nil
 }
 
-func (nd *NodeDrainer) handleUPSStatus(status *UPSStatus) {
+// handleUPSStatus acts on a status message from the named UPS, affecting only
+// the nodes it powers
+func (nd *NodeDrainer) handleUPSStatus(source string, status *UPSStatus) {
 	nd.mutex.Lock()
 	defer nd.mutex.Unlock()
 
-	// Use configured battery threshold
-	threshold := nd.config.BatteryDrainThreshold
+	src := nd.source(source)
+	received := time.Now()
+	if reason, err := nd.validateStatus(src, status, received); err != nil {
+		log.Printf("Rejected %s status: %v", upsLabel(source), err)
+		nd.metrics.rejectedMessages.WithLabelValues(reason).Inc()
+		return
+	}
+	ts, _ := status.Time()
+	nd.markFresh(src, ts)
+
+	src.lastStatus = status
+	src.lastReceived = received
+	// Readings without a timestamp count from when they arrived
+	since := received
+	if !ts.IsZero() {
+		since = ts
+	}
+	nd.trackOnBattery(src, status, since)
+	nd.lastMessage.Store(received.UnixNano())
+	nd.metrics.observeStatus(source, status, received)
+	defer nd.publishState()
+	defer nd.reportPolicyStatus()
+	defer nd.updatePowerRiskConditions(src)
+
+	if override := nd.stageOverride(source); override != nil {
+		nd.applyOverride(src, override)
+		return
+	}
 
-	// Check if we need to drain nodes (ONBATT and battery < threshold)
-	if status.Status == "ONBATT" && status.BatteryLevel < threshold {
-		log.Printf("UPS on battery with %d%% (threshold: %d%%) - ensuring all worker nodes are drained", status.BatteryLevel, threshold)
-		if err := nd.ensureWorkerNodesDrained(); err != nil {
-			log.Printf("Failed to drain worker nodes: %v", err)
+	target, ok := nd.targetStage(status, src.onBatteryFor(received))
+	if !ok {
+		nd.unsettled(src)
+		return
+	}
+	if !nd.settled(src, target) {
+		return
+	}
+	nd.setStage(src, target)
+
+	// In dry-run mode only report what would happen
+	if nd.config.DryRun {
+		plan, err := nd.plan(context.Background(), source, status)
+		if err != nil {
+			log.Printf("Failed to plan actions: %v", err)
+			return
+		}
+		nd.reportPlan(plan)
+		return
+	}
+
+	switch target {
+	case StageDrain:
+		log.Printf("%s reports %s with %d%% battery (threshold: %d%%) - protecting its worker nodes (mode: %s)", upsLabel(source), status.Flags(), status.BatteryLevel, nd.config.BatteryDrainThreshold, nd.config.DrainMode)
+		rec, _ := nd.auditStart(source, AuditTriggerReading, status)
+		if err := nd.protect(source, rec); err != nil {
+			log.Printf("Failed to protect worker nodes: %v", err)
+		}
+		// Nodes still draining are powered off once their drain finished
+		if status.BatteryLevel < nd.config.ShutdownThreshold && src.drain == nil {
+			if err := nd.shutdownDrainedNodes(source, status); err != nil {
+				log.Printf("Failed to power off drained nodes: %v", err)
+			}
+		}
+	case StageNormal:
+		// Power is back, undo whatever we did for this UPS
+		log.Printf("Power restored on %s - restoring workloads and uncordoning nodes drained by UPS drainer", upsLabel(source))
+		nd.cancelDrain(src, "power restored")
+		if err := nd.restoreWorkloads(context.Background(), source); err != nil {
+			log.Printf("Failed to restore scaled-down workloads: %v", err)
 		}
-	} else if status.Status == "ONLINE" {
-		// Power is back, uncordon any nodes that were drained by us
-		log.Println("Power restored - uncordoning nodes drained by UPS drainer")
-		if err := nd.uncordonUPSDrainedNodes(); err != nil {
+		if err := nd.uncordonUPSDrainedNodes(source); err != nil {
 			log.Printf("Failed to uncordon nodes: %v", err)
 		}
+		if err := nd.reconcilePoweredOffNodes(); err != nil {
+			log.Printf("Failed to check powered-off nodes: %v", err)
+		}
+		nd.auditFinish(source)
 	}
 }
 
-func (nd *NodeDrainer) ensureWorkerNodesDrained() error {
-	ctx := context.Background()
+// targetStage returns the stage a UPS reading calls for, taken onBattery into
+// an outage, or false if the reading does not call for any action. Callers
+// must hold nd.mutex.
+func (nd *NodeDrainer) targetStage(status *UPSStatus, onBattery time.Duration) (Stage, bool) {
+	flags := status.Flags()
+	switch flag, action := nd.flagAction(flags); action {
+	case FlagActionDrain:
+		log.Printf("UPS reports %s - draining regardless of battery level", flag)
+		return StageDrain, true
+	case FlagActionHold:
+		log.Printf("UPS reports %s - holding current stage", flag)
+		return "", false
+	}
 
-	nodes, err := nd.clientset.CoreV1().Nodes().List(ctx, metav1.ListOptions{})
+	// Drain when on battery and below the configured threshold, or when the
+	// outage outlasts the runtime triggers
+	if flags.Has(FlagOnBattery) {
+		if status.BatteryLevel < nd.config.BatteryDrainThreshold {
+			return StageDrain, true
+		}
+		if trigger := nd.runtimeTrigger(status, onBattery); trigger != "" {
+			log.Printf("UPS %s - draining at %d%% battery", trigger, status.BatteryLevel)
+			return StageDrain, true
+		}
+		return "", false
+	}
+
+	if flags.Has(FlagOnline) {
+		if status.BatteryLevel < nd.config.BatteryUncordonThreshold {
+			log.Printf("Power restored but battery at %d%% (uncordon threshold: %d%%) - holding current stage", status.BatteryLevel, nd.config.BatteryUncordonThreshold)
+			return "", false
+		}
+		return StageNormal, true
+	}
+
+	log.Printf("UPS status %q is neither %s nor %s - holding current stage", status.Status, FlagOnBattery, FlagOnline)
+	return "", false
+}
+
+// ensureWorkerNodesDrained starts draining the worker nodes powered by the
+// named UPS, attributing the drain's actions to rec. Callers must hold
+// nd.mutex.
+func (nd *NodeDrainer) ensureWorkerNodesDrained(source string, rec *AuditRecord) error {
+	if nd.source(source).drain != nil {
+		log.Printf("Drain of worker nodes on %s still in progress", upsLabel(source))
+		return nil
+	}
+
+	nodes, err := nd.drainCandidates(source)
 	if err != nil {
-		return fmt.Errorf("failed to list nodes: %w", err)
+		return err
 	}
+	nodes, report, err := nd.applySafeguards(nodes)
+	if err != nil {
+		return err
+	}
+	if src := nd.source(source); report.String() != src.capacityReported {
+		src.capacityReported = report.String()
+		nd.reportCapacity(source, report)
+	}
+
+	if len(nodes) == 0 {
+		return nil
+	}
+	nd.startDrain(context.Background(), source, nodes, fmt.Sprintf("UPS on battery below %d%%", nd.config.BatteryDrainThreshold), rec)
+	return nil
+}
+
+// drainNodes drains nodes concurrently, so one slow node does not hold up the
+// rest, and returns the nodes that could not be drained. Drains cancelled
+// through ctx do not count as failed. Callers must not hold nd.mutex.
+func (nd *NodeDrainer) drainNodes(ctx context.Context, nodes []corev1.Node, reason string) []string {
+	var wg sync.WaitGroup
+	var failedMutex sync.Mutex
+	var failed []string
+	for i := range nodes {
+		node := &nodes[i]
+		log.Printf("Draining node: %s", node.Name)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			err := nd.drainNode(ctx, node, reason)
+			if errors.Is(err, context.Canceled) {
+				log.Printf("Drain of node %s cancelled", node.Name)
+				return
+			}
+			if err != nil {
+				log.Printf("Failed to drain node %s: %v", node.Name, err)
+				failedMutex.Lock()
+				failed = append(failed, node.Name)
+				failedMutex.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+
+	sort.Strings(failed)
+	return failed
+}
+
+// drainCandidates returns the worker nodes selected by the policy and powered
+// by the named UPS that are not already drained by us
+func (nd *NodeDrainer) drainCandidates(source string) ([]corev1.Node, error) {
+	nodes, err := nd.listNodes(nd.config.NodeSelector)
+	if err != nil {
+		return nil, err
+	}
+
+	var candidates []corev1.Node
+	for _, node := range nodes {
+		if !nd.fedBy(&node, source) {
+			continue
+		}
 
-	for _, node := range nodes.Items {
 		// Skip control plane nodes
 		if nd.isControlPlaneNode(&node) {
 			log.Printf("Skipping control plane node: %s", node.Name)
 			continue
 		}
-
-		// Check if node is already cordoned and annotated by us
-		isAlreadyDrained := node.Spec.Unschedulable
-		hasDrainerAnnotation := false
-		if node.Annotations != nil {
-			if annotation, exists := node.Annotations[UPSDrainerAnnotation]; exists && annotation == UPSDrainerValue {
-				hasDrainerAnnotation = true
-			}
+		if reason := nd.nodeIgnored(&node); reason != "" {
+			log.Printf("Skipping node %s: %s", node.Name, reason)
+			continue
 		}
-
-		// If already drained by us, skip
-		if isAlreadyDrained && hasDrainerAnnotation {
-			log.Printf("Node %s already drained by UPS drainer", node.Name)
+		if nd.isLastResortNode(&node) {
+			log.Printf("Keeping last resort node %s schedulable", node.Name)
 			continue
 		}
 
-		log.Printf("Draining node: %s", node.Name)
-		if err := nd.drainNode(&node); err != nil {
-			log.Printf("Failed to drain node %s: %v", node.Name, err)
-			continue
+		// Nodes already drained by us are only drained again when their
+		// drain was interrupted or pods came back
+		if cordonedByUs(&node) {
+			reason := nd.resumeReason(&node)
+			if reason == "" {
+				log.Printf("Node %s already drained by UPS drainer", node.Name)
+				continue
+			}
+			log.Printf("Resuming drain of node %s: %s", node.Name, reason)
 		}
+
+		candidates = append(candidates, node)
 	}
 
-	return nil
+	return candidates, nil
 }
 
 func (nd *NodeDrainer) isControlPlaneNode(node *corev1.Node) bool {
@@ -178,107 +432,96 @@ func (nd *NodeDrainer) isControlPlaneNode(node *corev1.Node) bool {
 	return false
 }
 
-func (nd *NodeDrainer) drainNode(node *corev1.Node) error {
-	ctx := context.Background()
-
-	// First, cordon the node and add our annotation
-	nodeCopy := node.DeepCopy()
-	nodeCopy.Spec.Unschedulable = true
-
-	if nodeCopy.Annotations == nil {
-		nodeCopy.Annotations = make(map[string]string)
+// drainNode cordons and drains node until ctx is cancelled; reason is given
+// in the Cordoned event. Callers must not hold nd.mutex.
+func (nd *NodeDrainer) drainNode(ctx context.Context, node *corev1.Node, reason string) error {
+	if err := ctx.Err(); err != nil {
+		return err
 	}
-	nodeCopy.Annotations[UPSDrainerAnnotation] = UPSDrainerValue
 
-	_, err := nd.clientset.CoreV1().Nodes().Update(ctx, nodeCopy, metav1.UpdateOptions{})
-	if err != nil {
+	// First, cordon the node and add our annotations
+	if err := nd.patchNode(ctx, node.Name, drainPhasePatch(node, time.Now())); err != nil {
+		nd.recordRunAction(ctx, Action{Action: ActionCordon, Target: node.Name, Error: err.Error()})
 		return fmt.Errorf("failed to cordon node %s: %w", node.Name, err)
 	}
 
 	log.Printf("Cordoned node: %s", node.Name)
+	nd.recorder.Eventf(node, corev1.EventTypeNormal, EventReasonCordoned, "Cordoned by UPS drainer: %s", reason)
+	nd.recordRunAction(ctx, Action{Action: ActionCordon, Target: node.Name, Message: "cordoned"})
 
-	// Get all pods on the node
-	pods, err := nd.clientset.CoreV1().Pods("").List(ctx, metav1.ListOptions{
-		FieldSelector: fmt.Sprintf("spec.nodeName=%s", node.Name),
-	})
+	// Evict pods selected by the pod filters and wait for them to go
+	nd.mutex.RLock()
+	config := nd.config
+	toEvict, skipped, err := nd.evictablePods(node)
+	nd.mutex.RUnlock()
 	if err != nil {
-		return fmt.Errorf("failed to list pods on node %s: %w", node.Name, err)
-	}
-
-	// Evict pods (excluding DaemonSets and system pods)
-	for _, pod := range pods.Items {
-		if nd.shouldEvictPod(&pod) {
-			if err := nd.evictPod(&pod); err != nil {
-				log.Printf("Failed to evict pod %s/%s: %v", pod.Namespace, pod.Name, err)
-			}
-		}
-	}
-
-	return nil
-}
-
-func (nd *NodeDrainer) shouldEvictPod(pod *corev1.Pod) bool {
-	// Skip system namespaces
-	systemNamespaces := []string{"kube-system", "kube-public", "kube-node-lease"}
-	for _, ns := range systemNamespaces {
-		if pod.Namespace == ns {
-			return false
-		}
+		return err
 	}
-
-	// Skip if managed by DaemonSet
-	for _, owner := range pod.OwnerReferences {
-		if owner.Kind == "DaemonSet" {
-			return false
-		}
+	logSkippedPods(node.Name, skipped)
+
+	result := nd.drainPods(ctx, config, node, toEvict)
+	result.Skipped = skipped
+	nd.recordDrainResult(result)
+	if result.Cancelled {
+		// The node stays in the draining phase, so that the drain is resumed
+		// if the UPS calls for it again
+		return fmt.Errorf("drain of node %s: %w", node.Name, ctx.Err())
 	}
 
-	// Skip completed pods
-	if pod.Status.Phase == corev1.PodSucceeded || pod.Status.Phase == corev1.PodFailed {
-		return false
+	phase := DrainPhaseDrained
+	if !result.Completed {
+		phase = DrainPhaseIncomplete
 	}
-
-	// Skip pods with local storage (unless explicitly allowed)
-	for _, volume := range pod.Spec.Volumes {
-		if volume.EmptyDir != nil || volume.HostPath != nil {
-			return false
-		}
+	if err := nd.patchNode(ctx, node.Name, annotationPatch(map[string]interface{}{DrainPhaseAnnotation: phase})); err != nil {
+		log.Printf("Failed to mark drain of node %s %s: %v", node.Name, phase, err)
 	}
-
-	return true
-}
-
-func (nd *NodeDrainer) evictPod(pod *corev1.Pod) error {
-	ctx := context.Background()
-
-	eviction := &policyv1beta1.Eviction{
-		ObjectMeta: metav1.ObjectMeta{
-			Name:      pod.Name,
-			Namespace: pod.Namespace,
-		},
+	if result.Completed {
+		nd.recorder.Eventf(node, corev1.EventTypeNormal, EventReasonDrainCompleted, "Drained in %s: %d pods evicted, %d deleted",
+			result.Duration().Round(time.Second), len(result.Evicted), len(result.Deleted))
+	} else {
+		nd.recorder.Eventf(node, corev1.EventTypeWarning, EventReasonDrainIncomplete, "Drain incomplete after %s: %d pods could not be drained",
+			result.Duration().Round(time.Second), len(result.Failed))
 	}
-
-	err := nd.clientset.PolicyV1beta1().Evictions(pod.Namespace).Evict(ctx, eviction)
-	if err != nil {
+	message := fmt.Sprintf("%d pods evicted, %d deleted, %d skipped", len(result.Evicted), len(result.Deleted), len(result.Skipped))
+	if !result.Completed {
+		err := fmt.Errorf("%d pods on node %s could not be drained", len(result.Failed), node.Name)
+		nd.recordRunAction(ctx, Action{Action: ActionDrain, Target: node.Name, Message: message, Error: err.Error()})
 		return err
 	}
+	nd.recordRunAction(ctx, Action{Action: ActionDrain, Target: node.Name, Message: message})
 
-	log.Printf("Evicted pod: %s/%s", pod.Namespace, pod.Name)
 	return nil
 }
 
-func (nd *NodeDrainer) uncordonUPSDrainedNodes() error {
+// uncordonUPSDrainedNodes uncordons the nodes powered by the named UPS that
+// were drained by us
+func (nd *NodeDrainer) uncordonUPSDrainedNodes(source string) error {
+	_, err := nd.uncordonNodes(source, nil, "power restored")
+	return err
+}
+
+// uncordonNodes uncordons the nodes powered by the named UPS that were drained
+// by us, limited to names unless it is nil, and returns the uncordoned nodes;
+// reason is given in the Uncordoned event
+func (nd *NodeDrainer) uncordonNodes(source string, names map[string]bool, reason string) ([]string, error) {
 	ctx := context.Background()
 
 	// Find all nodes that were drained by us
-	nodes, err := nd.clientset.CoreV1().Nodes().List(ctx, metav1.ListOptions{})
+	nodes, err := nd.listNodes(nil)
 	if err != nil {
-		return fmt.Errorf("failed to list nodes: %w", err)
+		return nil, err
 	}
 
-	for _, node := range nodes.Items {
-		// Skip control plane nodes
-		if nd.isControlPlaneNode(&node) {
+	var uncordoned []string
+	var errs []error
+
+	for _, node := range nodes {
+		// Skip control plane nodes and nodes on other UPSes
+		if nd.isControlPlaneNode(&node) || !nd.fedBy(&node, source) || (names != nil && !names[node.Name]) {
+			continue
+		}
+		if ignored := nd.nodeIgnored(&node); ignored != "" {
+			log.Printf("Not uncordoning node %s: %s", node.Name, ignored)
 			continue
 		}
 
@@ -286,20 +529,22 @@ func (nd *NodeDrainer) uncordonUPSDrainedNodes() error {
 		if node.Annotations != nil {
 			if annotation, exists := node.Annotations[UPSDrainerAnnotation]; exists && annotation == UPSDrainerValue {
 				// Uncordon the node and remove our annotation
-				nodeCopy := node.DeepCopy()
-				nodeCopy.Spec.Unschedulable = false
-				delete(nodeCopy.Annotations, UPSDrainerAnnotation)
-
-				_, err = nd.clientset.CoreV1().Nodes().Update(ctx, nodeCopy, metav1.UpdateOptions{})
-				if err != nil {
+				patch := annotationPatch(map[string]interface{}{UPSDrainerAnnotation: nil, DrainPhaseAnnotation: nil, DrainStartedAnnotation: nil})
+				patch["spec"] = map[string]interface{}{"unschedulable": false}
+				if err := nd.patchNode(ctx, node.Name, patch); err != nil {
 					log.Printf("Failed to uncordon node %s: %v", node.Name, err)
+					nd.recordAction(Action{Action: ActionUncordon, UPS: source, Target: node.Name, Error: err.Error()})
+					errs = append(errs, fmt.Errorf("failed to uncordon node %s: %w", node.Name, err))
 					continue
 				}
 
 				log.Printf("Uncordoned node: %s", node.Name)
+				nd.recorder.Event(&node, corev1.EventTypeNormal, EventReasonUncordoned, "Uncordoned by UPS drainer: "+reason)
+				nd.recordAction(Action{Action: ActionUncordon, UPS: source, Target: node.Name, Message: "uncordoned"})
+				uncordoned = append(uncordoned, node.Name)
 			}
 		}
 	}
 
-	return nil
+	return uncordoned, errors.Join(errs...)
 }
@@ -0,0 +1,493 @@
+package nodedrainer
+
+import (
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+const controlPlaneLabel = "node-role.kubernetes.io/control-plane"
+
+// clusterObjects returns two workers and a control plane node, each running
+// an application pod, plus a DaemonSet pod on worker-1
+func clusterObjects() []runtime.Object {
+	return []runtime.Object{
+		testNode("worker-1", nil),
+		testNode("worker-2", nil),
+		testNode("control-plane", map[string]string{controlPlaneLabel: ""}),
+		testPod("default", "app-1", "worker-1", "ReplicaSet"),
+		testPod("default", "app-2", "worker-2", "ReplicaSet"),
+		testPod("default", "agent", "worker-1", "DaemonSet"),
+		testPod("default", "app-cp", "control-plane", "ReplicaSet"),
+	}
+}
+
+func TestPowerLossDrainsWorkerNodes(t *testing.T) {
+	env := newTestEnv(t, testConfig(), clusterObjects()...)
+
+	env.powerEvent("ONBATT", 30)
+	env.waitForDrained("worker-1", "worker-2")
+
+	for _, name := range []string{"worker-1", "worker-2"} {
+		if node := env.node(name); !drainedByUs(node) {
+			t.Errorf("node %s not drained: unschedulable=%v annotations=%v", name, node.Spec.Unschedulable, node.Annotations)
+		}
+	}
+	if node := env.node("control-plane"); node.Spec.Unschedulable || node.Annotations[UPSDrainerAnnotation] != "" {
+		t.Errorf("control plane node was drained")
+	}
+
+	for _, name := range []string{"app-1", "app-2"} {
+		if env.podExists("default", name) {
+			t.Errorf("pod %s was not evicted", name)
+		}
+	}
+	if !env.podExists("default", "app-cp") {
+		t.Errorf("pod on control plane node was evicted")
+	}
+
+	result := env.drainer.GetDrainResults()["worker-1"]
+	if result == nil {
+		t.Fatalf("no drain result for worker-1")
+	}
+	if !result.Completed || len(result.Evicted) != 1 || result.Evicted[0] != "default/app-1" {
+		t.Errorf("unexpected drain result for worker-1: %+v", result)
+	}
+
+	states := env.drainer.GetUPSStates()
+	if len(states) != 1 || states[0].Stage != StageDrain {
+		t.Errorf("expected a single UPS in stage %s, got %+v", StageDrain, states)
+	}
+}
+
+func TestNodePatchRetriesOnConflict(t *testing.T) {
+	env := newTestEnv(t, testConfig(), clusterObjects()...)
+
+	// The first patch of each node loses a race with another writer
+	var mutex sync.Mutex
+	conflicted := map[string]bool{}
+	env.clientset.PrependReactor("patch", "nodes", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		name := action.(k8stesting.PatchAction).GetName()
+		mutex.Lock()
+		defer mutex.Unlock()
+		if action.GetSubresource() != "" || conflicted[name] {
+			return false, nil, nil
+		}
+		conflicted[name] = true
+		return true, nil, apierrors.NewConflict(schema.GroupResource{Resource: "nodes"}, name, nil)
+	})
+
+	env.powerEvent("ONBATT", 30)
+	env.waitForDrained("worker-1", "worker-2")
+	if env.podExists("default", "app-1") || env.podExists("default", "app-2") {
+		t.Errorf("pods not evicted after the cordon was retried")
+	}
+}
+
+func TestBatteryAboveThresholdDoesNotDrain(t *testing.T) {
+	env := newTestEnv(t, testConfig(), clusterObjects()...)
+
+	env.powerEvent("ONBATT", 80)
+
+	if drained, _ := env.drainer.GetDrainedNodes(); len(drained) != 0 {
+		t.Errorf("nodes drained above threshold: %v", drained)
+	}
+	if env.node("worker-1").Spec.Unschedulable {
+		t.Errorf("worker-1 cordoned above threshold")
+	}
+}
+
+func TestDaemonSetPodsAreSkipped(t *testing.T) {
+	env := newTestEnv(t, testConfig(), clusterObjects()...)
+
+	env.powerEvent("ONBATT", 30)
+	env.waitForDrained("worker-1", "worker-2")
+
+	if !env.podExists("default", "agent") {
+		t.Errorf("DaemonSet pod was evicted")
+	}
+
+	result := env.drainer.GetDrainResults()["worker-1"]
+	if result == nil {
+		t.Fatalf("no drain result for worker-1")
+	}
+	if len(result.Skipped) != 1 || result.Skipped[0].Pod != "default/agent" || result.Skipped[0].Reason != "managed by DaemonSet" {
+		t.Errorf("expected the DaemonSet pod to be skipped, got %+v", result.Skipped)
+	}
+}
+
+func TestPowerRestoredUncordonsNodes(t *testing.T) {
+	env := newTestEnv(t, testConfig(), clusterObjects()...)
+
+	env.powerEvent("ONBATT", 30)
+	env.waitForDrained("worker-1", "worker-2")
+
+	env.powerEvent("ONLINE", 100)
+	env.waitForDrained()
+
+	for _, name := range []string{"worker-1", "worker-2"} {
+		node := env.node(name)
+		if node.Spec.Unschedulable {
+			t.Errorf("node %s still cordoned", name)
+		}
+		if _, ok := node.Annotations[UPSDrainerAnnotation]; ok {
+			t.Errorf("node %s still has the %s annotation", name, UPSDrainerAnnotation)
+		}
+	}
+	if states := env.drainer.GetUPSStates(); states[0].Stage != StageNormal {
+		t.Errorf("expected stage %s after recovery, got %s", StageNormal, states[0].Stage)
+	}
+}
+
+func TestPowerRestoredBelowUncordonThresholdHolds(t *testing.T) {
+	config := testConfig()
+	config.BatteryUncordonThreshold = 90
+	env := newTestEnv(t, config, clusterObjects()...)
+
+	env.powerEvent("ONBATT", 30)
+	env.waitForDrained("worker-1", "worker-2")
+
+	env.powerEvent("ONLINE", 60)
+	if !drainedByUs(env.node("worker-1")) {
+		t.Errorf("worker-1 uncordoned while battery below uncordon threshold")
+	}
+
+	env.powerEvent("ONLINE", 95)
+	env.waitForDrained()
+}
+
+func TestFlappingPowerIsDebounced(t *testing.T) {
+	config := testConfig()
+	config.StableMessages = 3
+	env := newTestEnv(t, config, clusterObjects()...)
+
+	// Alternating readings never accumulate enough consecutive messages
+	for i := 0; i < 3; i++ {
+		env.powerEvent("ONBATT", 30)
+		env.powerEvent("ONLINE", 100)
+	}
+	env.powerEvent("ONBATT", 30)
+
+	if drained, _ := env.drainer.GetDrainedNodes(); len(drained) != 0 {
+		t.Fatalf("nodes drained while power was flapping: %v", drained)
+	}
+	pending := env.drainer.GetPendingTransition("")
+	if pending == nil || pending.Stage != StageDrain || pending.Messages != 1 {
+		t.Fatalf("expected a pending %s transition after one message, got %+v", StageDrain, pending)
+	}
+
+	// A sustained outage is acted on once it is stable
+	env.powerEvent("ONBATT", 29)
+	env.powerEvent("ONBATT", 28)
+	env.waitForDrained("worker-1", "worker-2")
+
+	// Likewise a single recovery reading does not uncordon
+	env.powerEvent("ONLINE", 100)
+	if drained, _ := env.drainer.GetDrainedNodes(); len(drained) != 2 {
+		t.Errorf("nodes uncordoned after a single recovery reading: %v", drained)
+	}
+}
+
+func TestReadingWithoutTargetInterruptsTransition(t *testing.T) {
+	config := testConfig()
+	config.StableMessages = 2
+	env := newTestEnv(t, config, clusterObjects()...)
+
+	// The reading above the threshold calls for no stage, so the two low
+	// readings around it are not consecutive
+	env.powerEvent("ONBATT", 30)
+	env.powerEvent("ONBATT", 80)
+	if pending := env.drainer.GetPendingTransition(""); pending != nil {
+		t.Errorf("transition still pending after a reading without target: %+v", pending)
+	}
+	env.powerEvent("ONBATT", 30)
+	if drained, _ := env.drainer.GetDrainedNodes(); len(drained) != 0 {
+		t.Fatalf("nodes drained after non-consecutive readings: %v", drained)
+	}
+
+	env.powerEvent("ONBATT", 29)
+	env.waitForDrained("worker-1", "worker-2")
+}
+
+func TestMinDrainDurationDelaysUncordon(t *testing.T) {
+	config := testConfig()
+	config.MinDrainDuration = time.Hour
+	env := newTestEnv(t, config, clusterObjects()...)
+
+	env.powerEvent("ONBATT", 30)
+	env.waitForDrained("worker-1", "worker-2")
+
+	env.powerEvent("ONLINE", 100)
+	if drained, _ := env.drainer.GetDrainedNodes(); len(drained) != 2 {
+		t.Errorf("nodes uncordoned before MinDrainDuration: %v", drained)
+	}
+}
+
+func TestOutOfOrderReadingsAreRejected(t *testing.T) {
+	env := newTestEnv(t, testConfig(), clusterObjects()...)
+
+	newer := env.powerEvent("ONLINE", 100)
+	older := UPSStatus{
+		Timestamp:    time.Now().Add(-time.Minute).UTC().Format(time.RFC3339Nano),
+		BatteryLevel: 10,
+		Status:       "ONBATT",
+	}
+	env.drainer.handleUPSStatus("", &older)
+
+	if last := env.drainer.GetLastStatus(); *last != newer {
+		t.Errorf("out-of-order reading replaced the last status: %+v", last)
+	}
+	if drained, _ := env.drainer.GetDrainedNodes(); len(drained) != 0 {
+		t.Errorf("out-of-order reading drained nodes: %v", drained)
+	}
+}
+
+func TestMultipleUPSesDrainOnlyTheirNodes(t *testing.T) {
+	config := testConfig()
+	config.MQTTTopic = "test/ups/+/status"
+	env := newTestEnv(t, config,
+		testNode("rack-a-1", map[string]string{DefaultSourceLabel: "rack-a"}),
+		testNode("rack-a-2", map[string]string{DefaultSourceLabel: "rack-a"}),
+		testNode("rack-b-1", map[string]string{DefaultSourceLabel: "rack-b"}),
+	)
+
+	env.publish("test/ups/rack-b/status", UPSStatus{BatteryLevel: 100, Status: "ONLINE"})
+	env.publish("test/ups/rack-a/status", UPSStatus{BatteryLevel: 30, Status: "ONBATT"})
+	env.waitForDrained("rack-a-1", "rack-a-2")
+
+	if env.node("rack-b-1").Spec.Unschedulable {
+		t.Errorf("node on a healthy UPS was cordoned")
+	}
+
+	states := env.drainer.GetUPSStates()
+	if len(states) != 2 || states[0].Name != "rack-a" || states[0].Stage != StageDrain || states[1].Stage != StageNormal {
+		t.Errorf("unexpected UPS states: %+v", states)
+	}
+}
+
+func TestEvictionFailureLeavesDrainIncomplete(t *testing.T) {
+	env := newTestEnv(t, testConfig(), clusterObjects()...)
+	env.failEviction("app-1", apierrors.NewForbidden(schema.GroupResource{Resource: "pods"}, "app-1", nil))
+
+	env.powerEvent("ONBATT", 30)
+	env.waitForDrained("worker-1", "worker-2")
+
+	result := env.drainer.GetDrainResults()["worker-1"]
+	if result == nil {
+		t.Fatalf("no drain result for worker-1")
+	}
+	if result.Completed {
+		t.Errorf("drain of worker-1 reported complete despite a failed eviction")
+	}
+	if _, ok := result.Failed["default/app-1"]; !ok {
+		t.Errorf("expected default/app-1 to be reported failed, got %+v", result.Failed)
+	}
+	if !env.podExists("default", "app-1") {
+		t.Errorf("pod with failed eviction was removed")
+	}
+
+	// The node stays cordoned and the other node drains normally
+	if !drainedByUs(env.node("worker-1")) {
+		t.Errorf("worker-1 not left cordoned")
+	}
+	if result := env.drainer.GetDrainResults()["worker-2"]; result == nil || !result.Completed {
+		t.Errorf("drain of worker-2 not completed: %+v", result)
+	}
+
+	events := env.events()
+	assertEvent(t, events, corev1.EventTypeWarning, EventReasonEvictionFailed)
+	assertEvent(t, events, corev1.EventTypeWarning, EventReasonDrainIncomplete)
+}
+
+func TestEvictionBlockedByDisruptionBudgetTimesOut(t *testing.T) {
+	config := testConfig()
+	config.DrainTimeout = 2 * time.Second
+	env := newTestEnv(t, config, clusterObjects()...)
+	env.failEviction("app-1", apierrors.NewTooManyRequests("Cannot evict pod as it would violate the pod's disruption budget.", 0))
+
+	env.powerEvent("ONBATT", 30)
+	env.waitForDrained("worker-1", "worker-2")
+
+	result := env.drainer.GetDrainResults()["worker-1"]
+	if result == nil || result.Completed {
+		t.Fatalf("expected an incomplete drain of worker-1, got %+v", result)
+	}
+	if reason := result.Failed["default/app-1"]; !strings.Contains(reason, "timed out") {
+		t.Errorf("expected default/app-1 to time out, got %q", reason)
+	}
+}
+
+func TestDeleteAfterTimeoutRemovesBlockedPods(t *testing.T) {
+	config := testConfig()
+	config.DrainTimeout = 2 * time.Second
+	config.DeleteAfterTimeout = true
+	env := newTestEnv(t, config, clusterObjects()...)
+	env.failEviction("app-1", apierrors.NewTooManyRequests("Cannot evict pod as it would violate the pod's disruption budget.", 0))
+
+	env.powerEvent("ONBATT", 30)
+	env.waitForDrained("worker-1", "worker-2")
+
+	result := env.drainer.GetDrainResults()["worker-1"]
+	if result == nil || !result.Completed || len(result.Deleted) != 1 || result.Deleted[0] != "default/app-1" {
+		t.Errorf("expected default/app-1 to be deleted after the timeout, got %+v", result)
+	}
+	if env.podExists("default", "app-1") {
+		t.Errorf("blocked pod was not deleted")
+	}
+}
+
+func TestPowerRestoredCancelsDrain(t *testing.T) {
+	config := testConfig()
+	config.DrainTimeout = time.Hour
+	env := newTestEnv(t, config, clusterObjects()...)
+	env.failEviction("app-1", apierrors.NewTooManyRequests("Cannot evict pod as it would violate the pod's disruption budget.", 0))
+
+	env.send(config.MQTTTopic, UPSStatus{Timestamp: time.Now().UTC().Format(time.RFC3339Nano), BatteryLevel: 30, Status: "ONBATT"})
+	env.waitForDrained("worker-1", "worker-2")
+	if !env.draining() {
+		t.Fatalf("expected the drain blocked by the disruption budget to be under way")
+	}
+
+	// Readings are handled while the drain waits, and the recovery stops it
+	env.powerEvent("ONLINE", 100)
+	env.waitForDrained()
+
+	result := env.drainer.GetDrainResults()["worker-1"]
+	if result == nil || !result.Cancelled || result.Completed {
+		t.Fatalf("expected a cancelled drain of worker-1, got %+v", result)
+	}
+	if !env.podExists("default", "app-1") {
+		t.Errorf("pod of the cancelled drain was removed")
+	}
+}
+
+func TestIsControlPlaneNode(t *testing.T) {
+	nd := &NodeDrainer{}
+	tests := []struct {
+		name string
+		node *corev1.Node
+		want bool
+	}{
+		{"worker", testNode("n", map[string]string{"node-role.kubernetes.io/worker": ""}), false},
+		{"control-plane label", testNode("n", map[string]string{controlPlaneLabel: ""}), true},
+		{"master label", testNode("n", map[string]string{"node-role.kubernetes.io/master": ""}), true},
+		{"control-plane taint", &corev1.Node{Spec: corev1.NodeSpec{Taints: []corev1.Taint{
+			{Key: controlPlaneLabel, Effect: corev1.TaintEffectNoSchedule},
+		}}}, true},
+		{"master taint", &corev1.Node{Spec: corev1.NodeSpec{Taints: []corev1.Taint{
+			{Key: "node-role.kubernetes.io/master", Effect: corev1.TaintEffectNoSchedule},
+		}}}, true},
+		{"unrelated taint", &corev1.Node{Spec: corev1.NodeSpec{Taints: []corev1.Taint{
+			{Key: "dedicated", Value: "gpu", Effect: corev1.TaintEffectNoSchedule},
+		}}}, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := nd.isControlPlaneNode(tt.node); got != tt.want {
+				t.Errorf("isControlPlaneNode() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPodSkipReason(t *testing.T) {
+	withVolume := func(pod *corev1.Pod, volume corev1.Volume) *corev1.Pod {
+		pod.Spec.Volumes = append(pod.Spec.Volumes, volume)
+		return pod
+	}
+	mirror := testPod("default", "static", "n", "")
+	mirror.Annotations = map[string]string{mirrorPodAnnotation: "hash"}
+	completed := testPod("default", "job", "n", "Job")
+	completed.Status.Phase = corev1.PodSucceeded
+	optedOut := testPod("default", "db", "n", "StatefulSet")
+	optedOut.Annotations = map[string]string{EvictOrderAnnotation: EvictOrderNever}
+
+	tests := []struct {
+		name string
+		pod  *corev1.Pod
+		want string
+	}{
+		{"replicaset pod", testPod("default", "app", "n", "ReplicaSet"), ""},
+		{"unmanaged pod", testPod("default", "bare", "n", ""), ""},
+		{"daemonset pod", testPod("default", "agent", "n", "DaemonSet"), "managed by DaemonSet"},
+		{"mirror pod", mirror, "static (mirror) pod"},
+		{"completed pod", completed, "completed"},
+		{"excluded namespace", testPod("kube-system", "dns", "n", "ReplicaSet"), "namespace excluded"},
+		{"opted out", optedOut, "opted out with " + EvictOrderAnnotation},
+		{"emptyDir", withVolume(testPod("default", "cache", "n", "ReplicaSet"), corev1.Volume{
+			Name: "scratch", VolumeSource: corev1.VolumeSource{EmptyDir: &corev1.EmptyDirVolumeSource{}},
+		}), "emptyDir volume scratch (deleteEmptyDirData is off)"},
+	}
+
+	nd := &NodeDrainer{config: DefaultConfig()}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := nd.podSkipReason(tt.pod); got != tt.want {
+				t.Errorf("podSkipReason() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestEvictionWaves(t *testing.T) {
+	priority := func(name string, p int32) corev1.Pod {
+		return corev1.Pod{ObjectMeta: metav1.ObjectMeta{Name: name}, Spec: corev1.PodSpec{Priority: &p}}
+	}
+	ordered := priority("ordered", 1000)
+	ordered.Annotations = map[string]string{EvictOrderAnnotation: "-5"}
+
+	pods := []corev1.Pod{priority("db", 1000), priority("web", 0), ordered, priority("batch", 0), priority("cache", 100)}
+	sortByEvictionOrder(pods)
+
+	var got []string
+	for _, wave := range evictionWaves(pods) {
+		var names []string
+		for _, pod := range wave {
+			names = append(names, pod.Name)
+		}
+		got = append(got, strings.Join(names, ","))
+	}
+	want := []string{"ordered", "web,batch", "cache", "db"}
+	if strings.Join(got, " ") != strings.Join(want, " ") {
+		t.Errorf("evictionWaves() = %v, want %v", got, want)
+	}
+}
+
+func TestSourceFromTopic(t *testing.T) {
+	tests := []struct {
+		pattern, topic, want string
+	}{
+		{"ups/status", "ups/status", ""},
+		{"ups/+/status", "ups/rack-a/status", "rack-a"},
+		{"+/ups/+", "site-1/ups/rack-a", "site-1/rack-a"},
+		{"ups/#", "ups/site-1/rack-a", "site-1/rack-a"},
+	}
+
+	for _, tt := range tests {
+		if got := sourceFromTopic(tt.pattern, tt.topic); got != tt.want {
+			t.Errorf("sourceFromTopic(%q, %q) = %q, want %q", tt.pattern, tt.topic, got, tt.want)
+		}
+	}
+}
+
+// assertEvent fails the test unless events contains one of the given type and reason
+func assertEvent(t *testing.T, events []string, eventType, reason string) {
+	t.Helper()
+
+	prefix := eventType + " " + reason + " "
+	for _, event := range events {
+		if strings.HasPrefix(event, prefix) {
+			return
+		}
+	}
+	t.Errorf("no %s %s event recorded, got %v", eventType, reason, events)
+}
@@ -0,0 +1,104 @@
+package nodedrainer
+
+import (
+	"context"
+	"log"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+// drainRun is a drain of worker nodes of one UPS under way in the background.
+// Drains wait for pods to terminate for up to DrainTimeout, so they run
+// without holding nd.mutex: readings, overrides and status queries are
+// handled meanwhile, and a recovery or pause cancels the drain.
+type drainRun struct {
+	cancel context.CancelFunc
+	done   chan struct{}
+
+	// stopped is why the drain was cancelled, empty unless cancelDrain
+	// stopped it. It is guarded by nd.mutex.
+	stopped string
+	// cancelled and failed are set before done is closed
+	cancelled bool
+	failed    []string
+}
+
+// startDrain drains nodes of the named UPS in the background until ctx is
+// cancelled, attributing the drain's actions to rec. Callers must hold
+// nd.mutex and check that no drain of the UPS is under way.
+func (nd *NodeDrainer) startDrain(ctx context.Context, source string, nodes []corev1.Node, reason string, rec *AuditRecord) *drainRun {
+	ctx, cancel := context.WithCancel(ctx)
+	run := &drainRun{cancel: cancel, done: make(chan struct{})}
+	src := nd.source(source)
+	src.drain = run
+
+	go nd.runDrain(withAuditRecord(ctx, rec), src, run, nodes, reason, rec)
+	return run
+}
+
+// runDrain drains nodes and then follows up on the drain with nd.mutex held
+func (nd *NodeDrainer) runDrain(ctx context.Context, src *upsSource, run *drainRun, nodes []corev1.Node, reason string, rec *AuditRecord) {
+	defer close(run.done)
+	defer run.cancel()
+
+	run.failed = nd.drainNodes(ctx, nodes, reason)
+	run.cancelled = ctx.Err() != nil
+
+	nd.mutex.Lock()
+	defer nd.mutex.Unlock()
+	if src.drain == run {
+		src.drain = nil
+	}
+	nd.saveAuditRecord(rec)
+	nd.drainFinished(src, run)
+	nd.reportPolicyStatus()
+	nd.publishState()
+}
+
+// drainFinished follows up on a drain of src that ended: nodes cordoned while
+// a drain cancelled by a recovery wound down are uncordoned, and drained nodes
+// are powered off if the battery fell below ShutdownThreshold meanwhile.
+// Callers must hold nd.mutex.
+func (nd *NodeDrainer) drainFinished(src *upsSource, run *drainRun) {
+	if nd.config.DryRun {
+		return
+	}
+
+	switch {
+	case run.stopped != "" && src.stage == StageNormal:
+		if err := nd.uncordonUPSDrainedNodes(src.name); err != nil {
+			log.Printf("Failed to uncordon nodes: %v", err)
+		}
+	case !run.cancelled && src.stage == StageDrain && src.lastStatus != nil && src.lastStatus.BatteryLevel < nd.config.ShutdownThreshold:
+		if err := nd.shutdownDrainedNodes(src.name, src.lastStatus); err != nil {
+			log.Printf("Failed to power off drained nodes: %v", err)
+		}
+	}
+}
+
+// cancelDrain stops the drain of src under way, if any. Pods evicted already
+// stay evicted; the nodes stay cordoned until uncordoned. Callers must hold
+// nd.mutex.
+func (nd *NodeDrainer) cancelDrain(src *upsSource, reason string) {
+	run := src.drain
+	if run == nil {
+		return
+	}
+	log.Printf("Cancelling drain of worker nodes on %s: %s", upsLabel(src.name), reason)
+	run.stopped = reason
+	run.cancel()
+	src.drain = nil
+}
+
+// recordRunAction is recordAction for drains, which run without holding
+// nd.mutex. The action goes to the audit record of the drain run under ctx
+// and names its UPS.
+func (nd *NodeDrainer) recordRunAction(ctx context.Context, action Action) {
+	rec := auditRecordOf(ctx)
+	if rec != nil && action.UPS == "" {
+		action.UPS = rec.UPS
+	}
+	nd.mutex.RLock()
+	defer nd.mutex.RUnlock()
+	nd.recordAuditedAction(action, rec)
+}
@@ -0,0 +1,144 @@
+package nodedrainer
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/scheme"
+	typedcorev1 "k8s.io/client-go/kubernetes/typed/core/v1"
+	"k8s.io/client-go/tools/record"
+)
+
+// Event reasons recorded on nodes, pods and workloads
+const (
+	EventReasonCordoned        = "Cordoned"
+	EventReasonUncordoned      = "Uncordoned"
+	EventReasonDrainCompleted  = "DrainCompleted"
+	EventReasonDrainIncomplete = "DrainIncomplete"
+	EventReasonPoweringOff     = "PoweringOff"
+	EventReasonEvicted         = "Evicted"
+	EventReasonEvictionFailed  = "EvictionFailed"
+	EventReasonScaledDown      = "ScaledDown"
+	EventReasonScaledUp        = "ScaledUp"
+)
+
+// NodeConditionUPSPowerRisk is set on nodes to reflect the current UPS state
+const NodeConditionUPSPowerRisk corev1.NodeConditionType = "UPSPowerRisk"
+
+// newEventRecorder returns a recorder that writes Kubernetes Events as the drainer
+func newEventRecorder(clientset kubernetes.Interface) record.EventRecorder {
+	broadcaster := record.NewBroadcaster()
+	broadcaster.StartRecordingToSink(&typedcorev1.EventSinkImpl{
+		Interface: clientset.CoreV1().Events(""),
+	})
+	return broadcaster.NewRecorder(scheme.Scheme, corev1.EventSource{Component: UPSDrainerValue})
+}
+
+// powerRiskCondition derives the UPSPowerRisk condition from the last reading of a UPS
+func powerRiskCondition(src *upsSource) corev1.NodeCondition {
+	status := src.lastStatus
+	condition := corev1.NodeCondition{
+		Type:    NodeConditionUPSPowerRisk,
+		Message: fmt.Sprintf("%s status %s, battery %d%%, stage %s", upsLabel(src.name), status.Status, status.BatteryLevel, src.stage),
+	}
+
+	flags := status.Flags()
+	switch {
+	case src.stage == StageDrain:
+		condition.Status = corev1.ConditionTrue
+		condition.Reason = "DrainTriggered"
+	case flags.Has(FlagCommLost):
+		condition.Status = corev1.ConditionUnknown
+		condition.Reason = "CommunicationLost"
+	case flags.Has(FlagLowBattery), flags.Has(FlagShuttingDown):
+		condition.Status = corev1.ConditionTrue
+		condition.Reason = "LowBattery"
+	case flags.Has(FlagOnBattery):
+		condition.Status = corev1.ConditionTrue
+		condition.Reason = "OnBattery"
+	case flags.Has(FlagOnline):
+		condition.Status = corev1.ConditionFalse
+		condition.Reason = "OnlinePower"
+	default:
+		condition.Status = corev1.ConditionUnknown
+		condition.Reason = "UnknownUPSStatus"
+	}
+
+	return condition
+}
+
+// updatePowerRiskConditions sets the UPSPowerRisk condition on every node
+// selected by the policy and powered by src. A node is only patched when the
+// status or reason of its condition changes, so that readings do not cost an
+// API call per node. Callers must hold nd.mutex.
+func (nd *NodeDrainer) updatePowerRiskConditions(src *upsSource) {
+	if nd.config.DryRun {
+		return
+	}
+	ctx := context.Background()
+
+	nodes, err := nd.listNodes(nd.config.NodeSelector)
+	if err != nil {
+		log.Printf("Failed to list nodes for %s condition: %v", NodeConditionUPSPowerRisk, err)
+		return
+	}
+
+	if nd.powerRisk == nil {
+		nd.powerRisk = make(map[string]string)
+	}
+	desired := powerRiskCondition(src)
+	key := string(desired.Status) + "/" + desired.Reason
+	now := metav1.Now()
+
+	for _, node := range nodes {
+		if !nd.fedBy(&node, src.name) || nd.powerRisk[node.Name] == key {
+			continue
+		}
+
+		condition := desired
+		condition.LastHeartbeatTime = now
+		condition.LastTransitionTime = now
+
+		// The cache may lag behind our patches, but tells the condition set
+		// by a previous run
+		if existing := findNodeCondition(&node, NodeConditionUPSPowerRisk); existing != nil {
+			if existing.Status == condition.Status {
+				if existing.Reason == condition.Reason {
+					nd.powerRisk[node.Name] = key
+					continue
+				}
+				condition.LastTransitionTime = existing.LastTransitionTime
+			}
+		}
+
+		patch, err := json.Marshal(map[string]interface{}{
+			"status": map[string]interface{}{
+				"conditions": []corev1.NodeCondition{condition},
+			},
+		})
+		if err != nil {
+			log.Printf("Failed to encode %s condition: %v", NodeConditionUPSPowerRisk, err)
+			return
+		}
+
+		if _, err := nd.clientset.CoreV1().Nodes().PatchStatus(ctx, node.Name, patch); err != nil {
+			log.Printf("Failed to set %s condition on node %s: %v", NodeConditionUPSPowerRisk, node.Name, err)
+			continue
+		}
+		nd.powerRisk[node.Name] = key
+	}
+}
+
+func findNodeCondition(node *corev1.Node, conditionType corev1.NodeConditionType) *corev1.NodeCondition {
+	for i := range node.Status.Conditions {
+		if node.Status.Conditions[i].Type == conditionType {
+			return &node.Status.Conditions[i]
+		}
+	}
+	return nil
+}
@@ -0,0 +1,52 @@
+package nodedrainer
+
+import (
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+// statusPatches counts the patches of node status sent so far
+func (e *testEnv) statusPatches() int {
+	n := 0
+	for _, action := range e.clientset.Actions() {
+		if action.GetVerb() == "patch" && action.GetSubresource() == "status" {
+			n++
+		}
+	}
+	return n
+}
+
+// expectPowerRisk checks the UPSPowerRisk condition of the named nodes
+func (e *testEnv) expectPowerRisk(status corev1.ConditionStatus, reason string, names ...string) {
+	e.t.Helper()
+
+	for _, name := range names {
+		condition := findNodeCondition(e.node(name), NodeConditionUPSPowerRisk)
+		if condition == nil || condition.Status != status || condition.Reason != reason {
+			e.t.Errorf("node %s: expected %s condition %s (%s), got %+v", name, NodeConditionUPSPowerRisk, status, reason, condition)
+		}
+	}
+}
+
+func TestPowerRiskConditionSetAndCleared(t *testing.T) {
+	env := newTestEnv(t, testConfig(), clusterObjects()...)
+
+	env.powerEvent("ONLINE", 100)
+	env.expectPowerRisk(corev1.ConditionFalse, "OnlinePower", "worker-1", "worker-2")
+
+	// Readings that leave the condition as it is do not patch nodes
+	patches := env.statusPatches()
+	env.powerEvent("ONLINE", 99)
+	if n := env.statusPatches(); n != patches {
+		t.Errorf("unchanged condition patched %d times", n-patches)
+	}
+
+	env.powerEvent("ONBATT", 30)
+	env.waitForDrained("worker-1", "worker-2")
+	env.expectPowerRisk(corev1.ConditionTrue, "DrainTriggered", "worker-1", "worker-2")
+
+	env.powerEvent("ONLINE", 100)
+	env.waitForDrained()
+	env.expectPowerRisk(corev1.ConditionFalse, "OnlinePower", "worker-1", "worker-2")
+}
@@ -0,0 +1,249 @@
+package nodedrainer
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	policyv1 "k8s.io/api/policy/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const (
+	// evictionBackoffInitial is the first wait after a PDB-blocked eviction
+	evictionBackoffInitial = time.Second
+	// evictionBackoffMax caps the wait between eviction retries
+	evictionBackoffMax = 30 * time.Second
+)
+
+// DrainResult summarizes the outcome of draining a single node
+type DrainResult struct {
+	Node      string
+	Started   time.Time
+	Finished  time.Time
+	Evicted   []string
+	Deleted   []string
+	Failed    map[string]string
+	Skipped   []SkippedPod
+	Completed bool
+	// Cancelled is set when the drain was stopped before it finished, e.g.
+	// because power was restored
+	Cancelled bool
+}
+
+// Duration returns how long the drain took
+func (r *DrainResult) Duration() time.Duration {
+	return r.Finished.Sub(r.Started)
+}
+
+// drainPods evicts the given pods in waves of equal eviction order and waits
+// for each wave to terminate before starting the next. Evictions blocked by a
+// PodDisruptionBudget are retried with exponential backoff. Pods still
+// present at the deadline, including those of waves never started, are
+// deleted if DeleteAfterTimeout is set. Cancelling ctx stops the drain and
+// leaves the remaining pods in place.
+func (nd *NodeDrainer) drainPods(ctx context.Context, config *Config, node *corev1.Node, pods []corev1.Pod) *DrainResult {
+	result := &DrainResult{
+		Node:    node.Name,
+		Started: time.Now(),
+		Failed:  make(map[string]string),
+	}
+	deadline := result.Started.Add(config.DrainTimeout)
+	nd.evictionsPending(pods)
+
+	waves := evictionWaves(pods)
+	var remaining []corev1.Pod
+	for i, wave := range waves {
+		if len(remaining) > 0 || ctx.Err() != nil {
+			// The deadline passed, or the drain was cancelled, during an earlier wave
+			remaining = append(remaining, wave...)
+			continue
+		}
+		if len(waves) > 1 {
+			log.Printf("Draining node %s: wave %d of %d (eviction order %d, %d pods)",
+				node.Name, i+1, len(waves), evictionOrder(&wave[0]), len(wave))
+		}
+		remaining = nd.drainWave(ctx, node, wave, deadline, result)
+	}
+
+	if ctx.Err() != nil {
+		for _, pod := range remaining {
+			nd.evictionResolved(&pod)
+		}
+		result.Finished = time.Now()
+		result.Cancelled = true
+		return result
+	}
+
+	for _, pod := range remaining {
+		nd.evictionResolved(&pod)
+		if !config.DeleteAfterTimeout {
+			nd.recorder.Eventf(&pod, corev1.EventTypeWarning, EventReasonEvictionFailed, "UPS drainer timed out after %s waiting for pod to leave node %s", config.DrainTimeout, node.Name)
+			result.Failed[podKey(&pod)] = "timed out waiting for pod to terminate"
+			nd.recordRunAction(ctx, Action{Action: ActionEvict, Target: podKey(&pod), Error: result.Failed[podKey(&pod)]})
+			continue
+		}
+
+		log.Printf("Drain deadline exceeded, deleting pod %s/%s", pod.Namespace, pod.Name)
+		err := nd.clientset.CoreV1().Pods(pod.Namespace).Delete(ctx, pod.Name, metav1.DeleteOptions{})
+		if err != nil && !apierrors.IsNotFound(err) {
+			result.Failed[podKey(&pod)] = err.Error()
+			nd.recordRunAction(ctx, Action{Action: ActionDelete, Target: podKey(&pod), Error: err.Error()})
+			continue
+		}
+		result.Deleted = append(result.Deleted, podKey(&pod))
+		nd.recordRunAction(ctx, Action{Action: ActionDelete, Target: podKey(&pod), Message: "deleted after drain timeout"})
+	}
+
+	result.Finished = time.Now()
+	result.Completed = len(result.Failed) == 0
+	return result
+}
+
+// drainWave evicts pods and waits for them to terminate until deadline or
+// until ctx is cancelled. It returns the pods still present by then.
+func (nd *NodeDrainer) drainWave(ctx context.Context, node *corev1.Node, pods []corev1.Pod, deadline time.Time, result *DrainResult) []corev1.Pod {
+	backoff := evictionBackoffInitial
+	toEvict := pods
+	var terminating []corev1.Pod
+
+	for {
+		var blocked []corev1.Pod
+		for i, pod := range toEvict {
+			if ctx.Err() != nil {
+				return append(append(blocked, toEvict[i:]...), terminating...)
+			}
+			err := nd.evictPod(ctx, &pod)
+			nd.metrics.evictionAttempts.Inc()
+			switch {
+			case err != nil && ctx.Err() != nil:
+				// Cancelled while the eviction was under way
+				blocked = append(blocked, pod)
+			case err == nil || apierrors.IsNotFound(err):
+				nd.metrics.evictions.WithLabelValues("succeeded").Inc()
+				terminating = append(terminating, pod)
+			case apierrors.IsTooManyRequests(err):
+				nd.metrics.evictions.WithLabelValues("blocked").Inc()
+				log.Printf("Eviction of pod %s/%s blocked by disruption budget, will retry", pod.Namespace, pod.Name)
+				blocked = append(blocked, pod)
+			default:
+				nd.metrics.evictions.WithLabelValues("failed").Inc()
+				log.Printf("Failed to evict pod %s/%s: %v", pod.Namespace, pod.Name, err)
+				nd.recorder.Eventf(&pod, corev1.EventTypeWarning, EventReasonEvictionFailed, "UPS drainer could not evict pod from node %s: %v", node.Name, err)
+				result.Failed[podKey(&pod)] = err.Error()
+				nd.evictionResolved(&pod)
+				nd.recordRunAction(ctx, Action{Action: ActionEvict, Target: podKey(&pod), Error: err.Error()})
+			}
+		}
+		toEvict = blocked
+		if ctx.Err() != nil {
+			return append(toEvict, terminating...)
+		}
+
+		var stillRunning []corev1.Pod
+		for _, pod := range terminating {
+			gone, err := nd.podTerminated(ctx, &pod)
+			if err != nil {
+				log.Printf("Failed to check pod %s/%s: %v", pod.Namespace, pod.Name, err)
+			}
+			if gone {
+				result.Evicted = append(result.Evicted, podKey(&pod))
+				nd.evictionResolved(&pod)
+			} else {
+				stillRunning = append(stillRunning, pod)
+			}
+		}
+		terminating = stillRunning
+
+		if len(toEvict) == 0 && len(terminating) == 0 {
+			return nil
+		}
+		if !time.Now().Add(backoff).Before(deadline) {
+			return append(toEvict, terminating...)
+		}
+
+		select {
+		case <-ctx.Done():
+			return append(toEvict, terminating...)
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+		if backoff > evictionBackoffMax {
+			backoff = evictionBackoffMax
+		}
+	}
+}
+
+// podTerminated reports whether the pod is gone from its node. A pod that was
+// recreated under the same name (e.g. by a StatefulSet) counts as gone.
+func (nd *NodeDrainer) podTerminated(ctx context.Context, pod *corev1.Pod) (bool, error) {
+	current, err := nd.clientset.CoreV1().Pods(pod.Namespace).Get(ctx, pod.Name, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		return true, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return current.UID != pod.UID || current.Spec.NodeName != pod.Spec.NodeName, nil
+}
+
+func (nd *NodeDrainer) evictPod(ctx context.Context, pod *corev1.Pod) error {
+	eviction := &policyv1.Eviction{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      pod.Name,
+			Namespace: pod.Namespace,
+		},
+	}
+
+	err := nd.clientset.PolicyV1().Evictions(pod.Namespace).Evict(ctx, eviction)
+	if err != nil {
+		return err
+	}
+
+	log.Printf("Evicted pod: %s/%s", pod.Namespace, pod.Name)
+	nd.recorder.Eventf(pod, corev1.EventTypeNormal, EventReasonEvicted, "Evicted by UPS drainer from node %s", pod.Spec.NodeName)
+	nd.recordRunAction(ctx, Action{Action: ActionEvict, Target: podKey(pod), Message: "evicted from node " + pod.Spec.NodeName})
+	return nil
+}
+
+// GetDrainResults returns the outcome of the most recent drain of each node
+func (nd *NodeDrainer) GetDrainResults() map[string]*DrainResult {
+	nd.resultsMutex.Lock()
+	defer nd.resultsMutex.Unlock()
+
+	results := make(map[string]*DrainResult, len(nd.drainResults))
+	for name, result := range nd.drainResults {
+		results[name] = result
+	}
+	return results
+}
+
+func (nd *NodeDrainer) recordDrainResult(result *DrainResult) {
+	nd.resultsMutex.Lock()
+	defer nd.resultsMutex.Unlock()
+
+	if nd.drainResults == nil {
+		nd.drainResults = make(map[string]*DrainResult)
+	}
+	nd.drainResults[result.Node] = result
+	nd.metrics.drainDuration.Observe(result.Duration().Seconds())
+
+	switch {
+	case result.Cancelled:
+		log.Printf("Drain of node %s cancelled after %s: %d evicted, %d deleted",
+			result.Node, result.Duration().Round(time.Second), len(result.Evicted), len(result.Deleted))
+	case result.Completed:
+		log.Printf("Drain of node %s completed in %s: %d evicted, %d deleted",
+			result.Node, result.Duration().Round(time.Second), len(result.Evicted), len(result.Deleted))
+	default:
+		log.Printf("Drain of node %s incomplete after %s: %d evicted, %d deleted, %d failed",
+			result.Node, result.Duration().Round(time.Second), len(result.Evicted), len(result.Deleted), len(result.Failed))
+	}
+}
+
+func podKey(pod *corev1.Pod) string {
+	return fmt.Sprintf("%s/%s", pod.Namespace, pod.Name)
+}
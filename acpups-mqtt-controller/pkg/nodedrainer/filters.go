@@ -0,0 +1,135 @@
+package nodedrainer
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/labels"
+)
+
+// mirrorPodAnnotation marks the API mirror of a static pod run by the kubelet
+const mirrorPodAnnotation = "kubernetes.io/config.mirror"
+
+// DefaultExcludeNamespaces are never drained unless the exclusion list is overridden
+var DefaultExcludeNamespaces = []string{"kube-system", "kube-public", "kube-node-lease"}
+
+// SkippedPod is a pod left on a node by a drain, with the reason why
+type SkippedPod struct {
+	Pod    string `json:"pod"`
+	Reason string `json:"reason"`
+}
+
+// evictablePods returns the pods on node that a drain would evict, in
+// eviction order, and the pods it leaves in place
+func (nd *NodeDrainer) evictablePods(node *corev1.Node) ([]corev1.Pod, []SkippedPod, error) {
+	pods, err := nd.podsOnNode(node.Name)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var evictable []corev1.Pod
+	var skipped []SkippedPod
+	for _, pod := range pods {
+		if reason := nd.podSkipReason(&pod); reason != "" {
+			skipped = append(skipped, SkippedPod{Pod: podKey(&pod), Reason: reason})
+			continue
+		}
+		evictable = append(evictable, pod)
+	}
+	sortByEvictionOrder(evictable)
+	return evictable, skipped, nil
+}
+
+// podSkipReason returns why a drain leaves pod in place, or "" if it is
+// evicted. Callers must hold nd.mutex.
+func (nd *NodeDrainer) podSkipReason(pod *corev1.Pod) string {
+	config := nd.config
+
+	// Finished pods hold no resources
+	if pod.Status.Phase == corev1.PodSucceeded || pod.Status.Phase == corev1.PodFailed {
+		return "completed"
+	}
+
+	// Static pods are run by the kubelet and cannot be evicted through the API
+	if _, ok := pod.Annotations[mirrorPodAnnotation]; ok {
+		return "static (mirror) pod"
+	}
+
+	// DaemonSet pods would be recreated on the same node
+	if isDaemonSetPod(pod) {
+		return "managed by DaemonSet"
+	}
+
+	if len(config.IncludeNamespaces) > 0 && !containsString(config.IncludeNamespaces, pod.Namespace) {
+		return "namespace not included"
+	}
+	if containsString(config.ExcludeNamespaces, pod.Namespace) {
+		return "namespace excluded"
+	}
+	if config.PodSelector != nil && !config.PodSelector.Matches(labels.Set(pod.Labels)) {
+		return "does not match pod selector"
+	}
+
+	if reason := nd.evictionExempt(pod); reason != "" {
+		return reason
+	}
+
+	if len(pod.OwnerReferences) == 0 && !config.EvictUnmanagedPods {
+		return "unmanaged (no owner would recreate it)"
+	}
+
+	for _, volume := range pod.Spec.Volumes {
+		if volume.EmptyDir != nil && !config.DeleteEmptyDirData {
+			return fmt.Sprintf("emptyDir volume %s (deleteEmptyDirData is off)", volume.Name)
+		}
+		if volume.HostPath != nil && !config.EvictHostPathPods {
+			return fmt.Sprintf("hostPath volume %s (hostPath eviction is off)", volume.Name)
+		}
+	}
+
+	return ""
+}
+
+// logSkippedPods logs the pods a drain leaves on node, grouped by reason
+func logSkippedPods(node string, skipped []SkippedPod) {
+	if len(skipped) == 0 {
+		return
+	}
+
+	byReason := make(map[string][]string)
+	for _, pod := range skipped {
+		byReason[pod.Reason] = append(byReason[pod.Reason], pod.Pod)
+	}
+	reasons := make([]string, 0, len(byReason))
+	for reason := range byReason {
+		reasons = append(reasons, reason)
+	}
+	sort.Strings(reasons)
+
+	log.Printf("Leaving %d pods on node %s:", len(skipped), node)
+	for _, reason := range reasons {
+		log.Printf("  %s: %s", reason, strings.Join(byReason[reason], ", "))
+	}
+}
+
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+// isDaemonSetPod reports whether pod is managed by a DaemonSet
+func isDaemonSetPod(pod *corev1.Pod) bool {
+	for _, owner := range pod.OwnerReferences {
+		if owner.Kind == "DaemonSet" {
+			return true
+		}
+	}
+	return false
+}
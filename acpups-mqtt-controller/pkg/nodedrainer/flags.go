@@ -0,0 +1,162 @@
+package nodedrainer
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Status flags reported by apcupsd. A status combines several of them, e.g.
+// "ONBATT LOWBATT".
+const (
+	FlagOnline         = "ONLINE"
+	FlagOnBattery      = "ONBATT"
+	FlagLowBattery     = "LOWBATT"
+	FlagCommLost       = "COMMLOST"
+	FlagShuttingDown   = "SHUTTING DOWN"
+	FlagCalibration    = "CAL"
+	FlagTrim           = "TRIM"
+	FlagBoost          = "BOOST"
+	FlagOverload       = "OVERLOAD"
+	FlagReplaceBattery = "REPLACEBATT"
+	FlagNoBattery      = "NOBATT"
+	FlagSlave          = "SLAVE"
+	FlagSlaveDown      = "SLAVEDOWN"
+)
+
+// KnownStatusFlags are the flags apcupsd reports
+var KnownStatusFlags = []string{
+	FlagOnline, FlagOnBattery, FlagLowBattery, FlagCommLost, FlagShuttingDown, FlagCalibration,
+	FlagTrim, FlagBoost, FlagOverload, FlagReplaceBattery, FlagNoBattery, FlagSlave, FlagSlaveDown,
+}
+
+// Actions a status flag rule can take
+const (
+	// FlagActionDrain drains the nodes of the UPS regardless of battery level
+	FlagActionDrain = "drain"
+	// FlagActionHold keeps the current stage while the flag is reported
+	FlagActionHold = "hold"
+	// FlagActionIgnore disables a default rule for the flag
+	FlagActionIgnore = "ignore"
+)
+
+// DefaultFlagActions drain when the UPS is about to run out or to switch off,
+// and hold while the bridge cannot reach the UPS or a calibration runs it on
+// battery on purpose
+var DefaultFlagActions = map[string]string{
+	FlagLowBattery:   FlagActionDrain,
+	FlagShuttingDown: FlagActionDrain,
+	FlagCommLost:     FlagActionHold,
+	FlagCalibration:  FlagActionHold,
+}
+
+// outageFlags only call for action while the UPS runs on battery. On mains
+// power apcupsd keeps reporting LOWBATT while the battery recharges after an
+// outage; BatteryUncordonThreshold covers that case instead.
+var outageFlags = map[string]bool{
+	FlagLowBattery: true,
+}
+
+// StatusFlags is the set of flags in a UPS status
+type StatusFlags map[string]bool
+
+// ParseStatusFlags splits a status such as "ONBATT LOWBATT" into its flags
+func ParseStatusFlags(status string) StatusFlags {
+	flags := make(StatusFlags)
+	status = strings.ToUpper(status)
+
+	// The only flag containing a space
+	if strings.Contains(status, FlagShuttingDown) {
+		flags[FlagShuttingDown] = true
+		status = strings.ReplaceAll(status, FlagShuttingDown, " ")
+	}
+	for _, flag := range strings.Fields(status) {
+		flags[flag] = true
+	}
+	return flags
+}
+
+// Flags returns the flags of the reading's status
+func (s *UPSStatus) Flags() StatusFlags {
+	return ParseStatusFlags(s.Status)
+}
+
+// Has reports whether flag is set
+func (f StatusFlags) Has(flag string) bool {
+	return f[flag]
+}
+
+// String lists the flags in a stable order
+func (f StatusFlags) String() string {
+	return strings.Join(f.sorted(), " ")
+}
+
+func (f StatusFlags) sorted() []string {
+	flags := make([]string, 0, len(f))
+	for flag := range f {
+		flags = append(flags, flag)
+	}
+	sort.Strings(flags)
+	return flags
+}
+
+// ParseFlagActions parses FLAG=action rules, e.g. "LOWBATT=drain"
+func ParseFlagActions(rules []string) (map[string]string, error) {
+	actions := make(map[string]string)
+	for _, rule := range rules {
+		flag, action, ok := strings.Cut(rule, "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid rule %q: must be FLAG=action", rule)
+		}
+		actions[strings.ToUpper(strings.TrimSpace(flag))] = strings.TrimSpace(action)
+	}
+	if err := validateFlagActions(actions); err != nil {
+		return nil, err
+	}
+	return actions, nil
+}
+
+func validateFlagActions(actions map[string]string) error {
+	for flag, action := range actions {
+		if action != FlagActionDrain && action != FlagActionHold && action != FlagActionIgnore {
+			return fmt.Errorf("invalid action %q for flag %s: must be %s, %s or %s", action, flag, FlagActionDrain, FlagActionHold, FlagActionIgnore)
+		}
+	}
+	return nil
+}
+
+// MergeFlagActions returns base with rules added or replaced by overrides
+func MergeFlagActions(base, overrides map[string]string) map[string]string {
+	merged := make(map[string]string, len(base)+len(overrides))
+	for flag, action := range base {
+		merged[flag] = action
+	}
+	for flag, action := range overrides {
+		merged[strings.ToUpper(flag)] = action
+	}
+	return merged
+}
+
+// flagAction returns the flag rule that applies to flags and the flag that
+// triggered it. A drain rule wins over a hold rule so that a low battery is
+// acted on even while another flag holds.
+func (nd *NodeDrainer) flagAction(flags StatusFlags) (string, string) {
+	var held string
+	for _, flag := range flags.sorted() {
+		if outageFlags[flag] && !flags.Has(FlagOnBattery) {
+			continue
+		}
+		switch nd.config.FlagActions[flag] {
+		case FlagActionDrain:
+			return flag, FlagActionDrain
+		case FlagActionHold:
+			if held == "" {
+				held = flag
+			}
+		}
+	}
+	if held != "" {
+		return held, FlagActionHold
+	}
+	return "", ""
+}
@@ -0,0 +1,99 @@
+package nodedrainer
+
+import "testing"
+
+func TestParseStatusFlags(t *testing.T) {
+	tests := []struct {
+		status string
+		want   string
+	}{
+		{"ONLINE", "ONLINE"},
+		{"ONBATT LOWBATT", "LOWBATT ONBATT"},
+		{"  online  replacebatt ", "ONLINE REPLACEBATT"},
+		{"SHUTTING DOWN", "SHUTTING DOWN"},
+		{"ONBATT LOWBATT SHUTTING DOWN", "LOWBATT ONBATT SHUTTING DOWN"},
+		{"CAL ONLINE", "CAL ONLINE"},
+		{"", ""},
+	}
+
+	for _, tt := range tests {
+		if got := ParseStatusFlags(tt.status).String(); got != tt.want {
+			t.Errorf("ParseStatusFlags(%q) = %q, want %q", tt.status, got, tt.want)
+		}
+	}
+}
+
+func TestTargetStageFlags(t *testing.T) {
+	config := testConfig()
+	config.FlagActions = MergeFlagActions(config.FlagActions, map[string]string{
+		FlagOverload:    FlagActionDrain,
+		FlagCalibration: FlagActionIgnore,
+	})
+	nd := &NodeDrainer{config: config}
+
+	tests := []struct {
+		status  string
+		battery int
+		want    Stage
+	}{
+		{"ONBATT", 30, StageDrain},
+		{"ONBATT", 80, ""},
+		{"ONLINE", 100, StageNormal},
+		{"ONLINE TRIM", 100, StageNormal},
+		{"ONBATT LOWBATT", 80, StageDrain},
+		{"ONLINE LOWBATT", 100, StageNormal},
+		{"LOWBATT", 100, ""},
+		{"SHUTTING DOWN", 80, StageDrain},
+		{"COMMLOST", 0, ""},
+		{"ONBATT COMMLOST", 10, ""},
+		{"ONBATT LOWBATT COMMLOST", 10, StageDrain},
+		{"ONLINE OVERLOAD", 100, StageDrain},
+		{"CAL ONBATT", 30, StageDrain},
+		{"REPLACEBATT", 100, ""},
+		{"", 100, ""},
+	}
+
+	for _, tt := range tests {
+		target, _ := nd.targetStage(&UPSStatus{Status: tt.status, BatteryLevel: tt.battery}, 0)
+		if target != tt.want {
+			t.Errorf("targetStage(%q, %d%%) = %q, want %q", tt.status, tt.battery, target, tt.want)
+		}
+	}
+}
+
+func TestLowBatteryDrainsAboveThreshold(t *testing.T) {
+	env := newTestEnv(t, testConfig(), clusterObjects()...)
+
+	env.powerEvent("ONBATT", 80)
+	env.waitForDrained()
+
+	env.powerEvent("ONBATT LOWBATT", 80)
+	env.waitForDrained("worker-1", "worker-2")
+
+	// Losing contact with the UPS keeps the nodes drained
+	env.powerEvent("COMMLOST", 0)
+	if !drainedByUs(env.node("worker-1")) {
+		t.Errorf("worker-1 uncordoned while communication with the UPS was lost")
+	}
+
+	env.powerEvent("ONLINE", 100)
+	env.waitForDrained()
+}
+
+func TestRechargingLowBatteryUncordons(t *testing.T) {
+	env := newTestEnv(t, testConfig(), clusterObjects()...)
+
+	env.powerEvent("ONBATT LOWBATT", 10)
+	env.waitForDrained("worker-1", "worker-2")
+
+	// apcupsd reports LOWBATT on mains power until the battery recharged
+	env.powerEvent("ONLINE LOWBATT", 15)
+	env.waitForDrained()
+	if states := env.drainer.GetUPSStates(); states[0].Stage != StageNormal {
+		t.Errorf("expected stage %s while recharging on mains power, got %s", StageNormal, states[0].Stage)
+	}
+
+	// ...and neither drains again
+	env.powerEvent("ONLINE LOWBATT", 20)
+	env.waitForDrained()
+}
@@ -0,0 +1,322 @@
+package nodedrainer
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	mochi "github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/hooks/auth"
+	"github.com/mochi-mqtt/server/v2/listeners"
+	corev1 "k8s.io/api/core/v1"
+	policyv1 "k8s.io/api/policy/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+	"k8s.io/client-go/tools/record"
+)
+
+const (
+	// testTimeout bounds how long a test waits for the drainer to react
+	testTimeout = 10 * time.Second
+	// testPollInterval is how often conditions are re-checked while waiting
+	testPollInterval = 20 * time.Millisecond
+)
+
+var podsResource = schema.GroupVersionResource{Version: "v1", Resource: "pods"}
+
+// testEnv runs a NodeDrainer against a fake clientset, fed by an in-process
+// MQTT broker
+type testEnv struct {
+	t         *testing.T
+	clientset *fake.Clientset
+	drainer   *NodeDrainer
+	recorder  *record.FakeRecorder
+	publisher mqtt.Client
+	config    *Config
+
+	mutex          sync.Mutex
+	evictionErrors map[string]error
+}
+
+// newTestEnv starts a broker, creates objects in a fake cluster and subscribes
+// a started drainer with config. Everything is torn down with the test.
+func newTestEnv(t *testing.T, config *Config, objects ...runtime.Object) *testEnv {
+	t.Helper()
+
+	broker := startBroker(t)
+	env := &testEnv{
+		t:              t,
+		clientset:      fake.NewSimpleClientset(objects...),
+		recorder:       record.NewFakeRecorder(1000),
+		config:         config,
+		evictionErrors: make(map[string]error),
+	}
+	// The fake clientset accepts evictions without removing the pod
+	env.clientset.PrependReactor("create", "pods", env.evict)
+
+	env.drainer = New(env.clientset, connectClient(t, broker, "drainer"))
+	env.drainer.recorder = env.recorder
+
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	if err := env.drainer.Start(ctx); err != nil {
+		t.Fatalf("Start: %v", err)
+	}
+	if err := env.drainer.Subscribe(config); err != nil {
+		t.Fatalf("Subscribe: %v", err)
+	}
+
+	env.publisher = connectClient(t, broker, "publisher")
+	return env
+}
+
+// subscribe returns the payloads received on topic from now on, including
+// a retained message
+func (e *testEnv) subscribe(topic string) <-chan []byte {
+	e.t.Helper()
+
+	messages := make(chan []byte, 1000)
+	token := e.publisher.Subscribe(topic, 1, func(client mqtt.Client, msg mqtt.Message) {
+		messages <- msg.Payload()
+	})
+	if token.Wait() && token.Error() != nil {
+		e.t.Fatalf("failed to subscribe to %s: %v", topic, token.Error())
+	}
+	return messages
+}
+
+// testConfig returns a configuration suitable for tests: no hysteresis and
+// drains that give up quickly
+func testConfig() *Config {
+	config := DefaultConfig()
+	config.MQTTTopic = "test/ups/status"
+	config.QoS = 1
+	config.DrainTimeout = 5 * time.Second
+	return config
+}
+
+// startBroker runs an MQTT broker on a random local port and returns its URL
+func startBroker(t *testing.T) string {
+	t.Helper()
+
+	server := mochi.New(&mochi.Options{
+		Logger: slog.New(slog.NewTextHandler(io.Discard, nil)),
+	})
+	if err := server.AddHook(new(auth.AllowHook), nil); err != nil {
+		t.Fatalf("failed to add broker auth hook: %v", err)
+	}
+	tcp := listeners.NewTCP("test", "127.0.0.1:0", nil)
+	if err := server.AddListener(tcp); err != nil {
+		t.Fatalf("failed to start broker listener: %v", err)
+	}
+	if err := server.Serve(); err != nil {
+		t.Fatalf("failed to start broker: %v", err)
+	}
+	t.Cleanup(func() { server.Close() })
+
+	return "tcp://" + tcp.Address()
+}
+
+// connectClient connects an MQTT client to the broker at url
+func connectClient(t *testing.T, url, clientID string) mqtt.Client {
+	t.Helper()
+
+	opts := mqtt.NewClientOptions().
+		AddBroker(url).
+		SetClientID(clientID).
+		SetConnectTimeout(testTimeout)
+	client := mqtt.NewClient(opts)
+	if token := client.Connect(); token.Wait() && token.Error() != nil {
+		t.Fatalf("failed to connect %s to broker: %v", clientID, token.Error())
+	}
+	t.Cleanup(func() { client.Disconnect(0) })
+	return client
+}
+
+// publish sends a UPS status to topic and waits until the drainer has
+// handled it
+func (e *testEnv) publish(topic string, status UPSStatus) {
+	e.t.Helper()
+
+	e.send(topic, status)
+	e.waitForDrains()
+}
+
+// send publishes a reading and waits until it is handled, without waiting for
+// the drains it started
+func (e *testEnv) send(topic string, status UPSStatus) {
+	e.t.Helper()
+
+	payload, err := json.Marshal(status)
+	if err != nil {
+		e.t.Fatalf("failed to encode status: %v", err)
+	}
+	if token := e.publisher.Publish(topic, 1, false, payload); token.Wait() && token.Error() != nil {
+		e.t.Fatalf("failed to publish to %s: %v", topic, token.Error())
+	}
+
+	// Readings are handled under nd.mutex, so once the last status is visible
+	// its actions have completed, except for drains they started
+	e.eventually("status "+string(payload)+" handled", func() bool {
+		last := e.drainer.GetLastStatus()
+		return last != nil && *last == status
+	})
+}
+
+// waitForDrains waits until no drain runs in the background
+func (e *testEnv) waitForDrains() {
+	e.t.Helper()
+
+	e.eventually("drains to finish", func() bool {
+		return !e.draining()
+	})
+}
+
+// draining reports whether a drain of any UPS's nodes is under way
+func (e *testEnv) draining() bool {
+	e.drainer.mutex.RLock()
+	defer e.drainer.mutex.RUnlock()
+	for _, src := range e.drainer.sources {
+		if src.drain != nil {
+			return true
+		}
+	}
+	return false
+}
+
+// powerEvent publishes a reading on the configured topic, stamped with the
+// current time so that consecutive readings are never out of order
+func (e *testEnv) powerEvent(state string, battery int) UPSStatus {
+	e.t.Helper()
+
+	status := UPSStatus{
+		Timestamp:    time.Now().UTC().Format(time.RFC3339Nano),
+		BatteryLevel: battery,
+		Status:       state,
+	}
+	e.publish(e.config.MQTTTopic, status)
+	return status
+}
+
+// failEviction makes evictions of the named pod fail with err
+func (e *testEnv) failEviction(name string, err error) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	e.evictionErrors[name] = err
+}
+
+// evict is a reactor that removes evicted pods, like the API server does once
+// they terminate, unless failEviction was called for them
+func (e *testEnv) evict(action k8stesting.Action) (bool, runtime.Object, error) {
+	if action.GetSubresource() != "eviction" {
+		return false, nil, nil
+	}
+	eviction, ok := action.(k8stesting.CreateAction).GetObject().(*policyv1.Eviction)
+	if !ok {
+		return false, nil, nil
+	}
+
+	e.mutex.Lock()
+	err, failing := e.evictionErrors[eviction.Name]
+	e.mutex.Unlock()
+	if failing {
+		return true, nil, err
+	}
+	return true, nil, e.clientset.Tracker().Delete(podsResource, eviction.Namespace, eviction.Name)
+}
+
+// eventually fails the test unless condition becomes true within testTimeout
+func (e *testEnv) eventually(what string, condition func() bool) {
+	e.t.Helper()
+
+	deadline := time.Now().Add(testTimeout)
+	for !condition() {
+		if time.Now().After(deadline) {
+			e.t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(testPollInterval)
+	}
+}
+
+// node returns the current node from the fake API server
+func (e *testEnv) node(name string) *corev1.Node {
+	e.t.Helper()
+
+	node, err := e.clientset.CoreV1().Nodes().Get(context.Background(), name, metav1.GetOptions{})
+	if err != nil {
+		e.t.Fatalf("failed to get node %s: %v", name, err)
+	}
+	return node
+}
+
+// podExists reports whether the pod is still present in the fake API server
+func (e *testEnv) podExists(namespace, name string) bool {
+	_, err := e.clientset.CoreV1().Pods(namespace).Get(context.Background(), name, metav1.GetOptions{})
+	return err == nil
+}
+
+// waitForDrained waits until the drainer's cache shows exactly the named
+// nodes as drained by us
+func (e *testEnv) waitForDrained(names ...string) {
+	e.t.Helper()
+
+	want := strings.Join(names, ",")
+	e.eventually("drained nodes "+want, func() bool {
+		drained, err := e.drainer.GetDrainedNodes()
+		return err == nil && strings.Join(drained, ",") == want
+	})
+}
+
+// events returns the events recorded so far
+func (e *testEnv) events() []string {
+	var events []string
+	for {
+		select {
+		case event := <-e.recorder.Events:
+			events = append(events, event)
+		default:
+			return events
+		}
+	}
+}
+
+// drainedByUs reports whether a node is cordoned and annotated by the drainer
+func drainedByUs(node *corev1.Node) bool {
+	return node.Spec.Unschedulable && node.Annotations[UPSDrainerAnnotation] == UPSDrainerValue
+}
+
+// testNode returns a node with the given labels
+func testNode(name string, labels map[string]string) *corev1.Node {
+	return &corev1.Node{
+		ObjectMeta: metav1.ObjectMeta{Name: name, Labels: labels},
+	}
+}
+
+// testPod returns a pod on node, owned by a controller of ownerKind unless
+// it is empty
+func testPod(namespace, name, node, ownerKind string) *corev1.Pod {
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Namespace: namespace, Name: name},
+		Spec:       corev1.PodSpec{NodeName: node},
+		Status:     corev1.PodStatus{Phase: corev1.PodRunning},
+	}
+	if ownerKind != "" {
+		controller := true
+		pod.OwnerReferences = []metav1.OwnerReference{{
+			APIVersion: "apps/v1",
+			Kind:       ownerKind,
+			Name:       name + "-owner",
+			Controller: &controller,
+		}}
+	}
+	return pod
+}
@@ -0,0 +1,73 @@
+package nodedrainer
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// CheckReady returns an error if the drainer cannot currently follow the
+// UPS: the MQTT client is disconnected, or no status message has arrived
+// within the configured StaleAfter window, or the bridge announced itself
+// offline. A replica that has not subscribed
+// (e.g. a leader election standby) is always ready.
+func (nd *NodeDrainer) CheckReady() error {
+	if !nd.active.Load() {
+		return nil
+	}
+
+	if !nd.mqttClient.IsConnected() {
+		return fmt.Errorf("MQTT client is disconnected")
+	}
+
+	if nd.bridgeOffline.Load() {
+		return fmt.Errorf("UPS bridge reported offline")
+	}
+
+	staleAfter := time.Duration(nd.staleAfter.Load())
+	if since := nd.sinceLastMessage(); staleAfter > 0 && since > staleAfter {
+		return fmt.Errorf("no UPS status message for %s (stale after %s)", since.Round(time.Second), staleAfter)
+	}
+
+	return nil
+}
+
+// LivenessHandler serves the liveness probe. It only reports that the process
+// is serving: a lost broker or UPS bridge is exactly when the controller must
+// keep running to drain, hold or uncordon nodes, so it must not be restarted.
+func (nd *NodeDrainer) LivenessHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, "ok")
+	})
+}
+
+// ReadinessHandler serves CheckReady for the readiness probe
+func (nd *NodeDrainer) ReadinessHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := nd.CheckReady(); err != nil {
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		fmt.Fprintln(w, "ok")
+	})
+}
+
+// sinceLastMessage returns the time since the last UPS status message, or
+// since subscribing if no message has arrived yet
+func (nd *NodeDrainer) sinceLastMessage() time.Duration {
+	last := nd.lastMessage.Load()
+	if last == 0 {
+		last = nd.subscribedAt.Load()
+	}
+	if last == 0 {
+		return 0
+	}
+	return time.Since(time.Unix(0, last))
+}
+
+// storeConfig sets the active configuration. Callers must hold nd.mutex.
+func (nd *NodeDrainer) storeConfig(config *Config) {
+	nd.config = config
+	nd.staleAfter.Store(int64(config.StaleAfter))
+	nd.notifications.configure(config)
+}
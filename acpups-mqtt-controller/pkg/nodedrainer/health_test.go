@@ -0,0 +1,98 @@
+package nodedrainer
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+// get serves a GET request for path with handler and returns the response
+func get(handler http.Handler, path string) *httptest.ResponseRecorder {
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, path, nil))
+	return recorder
+}
+
+// expectReady waits until the readiness probe answers with code and a body
+// containing text
+func (e *testEnv) expectReady(code int, text string) {
+	e.t.Helper()
+
+	handler := e.drainer.ReadinessHandler()
+	e.eventually(fmt.Sprintf("readiness %d %q", code, text), func() bool {
+		response := get(handler, "/readyz")
+		return response.Code == code && strings.Contains(response.Body.String(), text)
+	})
+}
+
+func TestReadinessTransitions(t *testing.T) {
+	config := testConfig()
+	config.StaleAfter = 300 * time.Millisecond
+	config.AvailabilityTopic = config.MQTTTopic + "/availability"
+	env := newTestEnv(t, config, clusterObjects()...)
+
+	env.powerEvent("ONLINE", 100)
+	env.expectReady(http.StatusOK, "ok")
+
+	env.setAvailability("offline")
+	env.expectReady(http.StatusServiceUnavailable, "UPS bridge reported offline")
+	env.setAvailability("online")
+	env.expectReady(http.StatusOK, "ok")
+
+	time.Sleep(config.StaleAfter)
+	env.expectReady(http.StatusServiceUnavailable, "no UPS status message")
+	env.powerEvent("ONLINE", 100)
+	env.expectReady(http.StatusOK, "ok")
+
+	env.drainer.mqttClient.Disconnect(0)
+	env.expectReady(http.StatusServiceUnavailable, "MQTT client is disconnected")
+}
+
+func TestReadinessOfStandby(t *testing.T) {
+	drainer := New(fake.NewSimpleClientset(), nil)
+	if response := get(drainer.ReadinessHandler(), "/readyz"); response.Code != http.StatusOK {
+		t.Errorf("standby not ready: %d %s", response.Code, response.Body)
+	}
+	if response := get(drainer.LivenessHandler(), "/healthz"); response.Code != http.StatusOK {
+		t.Errorf("standby not alive: %d %s", response.Code, response.Body)
+	}
+}
+
+func TestMetricsHandlerExportsSeries(t *testing.T) {
+	env := newTestEnv(t, testConfig(), clusterObjects()...)
+
+	env.powerEvent("ONBATT", 30)
+	env.waitForDrained("worker-1", "worker-2")
+	if token := env.publisher.Publish(env.config.MQTTTopic, 1, false, "not json"); token.Wait() && token.Error() != nil {
+		t.Fatalf("failed to publish: %v", token.Error())
+	}
+
+	handler := env.drainer.MetricsHandler()
+	var body string
+	env.eventually("rejected message counted", func() bool {
+		body = get(handler, "/metrics").Body.String()
+		return strings.Contains(body, `ups_drainer_rejected_messages_total{reason="invalid_payload"} 1`)
+	})
+	for _, series := range []string{
+		`ups_drainer_battery_level_percent{ups=""} 30`,
+		`ups_drainer_ups_status{status="ONBATT",ups=""} 1`,
+		`ups_drainer_ups_status{status="ONLINE",ups=""} 0`,
+		`ups_drainer_stage{stage="Drain",ups=""} 1`,
+		`ups_drainer_stage{stage="Normal",ups=""} 0`,
+		`ups_drainer_evictions_total{result="succeeded"} 2`,
+		`ups_drainer_drain_duration_seconds_count 2`,
+		`ups_drainer_drained_nodes 2`,
+		`ups_drainer_mqtt_connected 1`,
+		`ups_drainer_on_battery_since_timestamp_seconds{ups=""}`,
+		`ups_drainer_seconds_since_last_message`,
+	} {
+		if !strings.Contains(body, "\n"+series+"\n") && !strings.Contains(body, "\n"+series+" ") {
+			t.Errorf("metrics do not contain %s", series)
+		}
+	}
+}
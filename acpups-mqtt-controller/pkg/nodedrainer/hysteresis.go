@@ -0,0 +1,88 @@
+package nodedrainer
+
+import (
+	"fmt"
+	"log"
+	"time"
+)
+
+// PendingTransition describes a stage change that is waiting out hysteresis
+type PendingTransition struct {
+	Stage    Stage
+	Since    time.Time
+	Messages int
+}
+
+// GetPendingTransition returns the stage change currently being debounced for
+// the named UPS, or nil if the requested stage is already in effect
+func (nd *NodeDrainer) GetPendingTransition(source string) *PendingTransition {
+	nd.mutex.RLock()
+	defer nd.mutex.RUnlock()
+
+	src, ok := nd.sources[source]
+	if !ok || src.pending.Stage == "" || src.pending.Stage == src.stage {
+		return nil
+	}
+	pending := src.pending
+	return &pending
+}
+
+// settled records that a reading of src requested target and reports whether the
+// transition may happen now. A transition to a new stage must be requested
+// for at least StableFor and by at least StableMessages consecutive readings,
+// and an uncordon must not follow a drain by less than MinDrainDuration.
+// Callers must hold nd.mutex.
+func (nd *NodeDrainer) settled(src *upsSource, target Stage) bool {
+	now := time.Now()
+	if src.pending.Stage != target {
+		src.pending = PendingTransition{Stage: target, Since: now}
+	}
+	src.pending.Messages++
+	nd.metrics.observeStage(src.name, src.stage, src.pending.Stage)
+
+	// Re-applying the current stage is idempotent and needs no debouncing
+	if target == src.stage {
+		return true
+	}
+
+	elapsed := now.Sub(src.pending.Since)
+	if elapsed < nd.config.StableFor || src.pending.Messages < nd.config.StableMessages {
+		log.Printf("Pending %s transition %s -> %s: held for %s of %s, %d of %d messages", upsLabel(src.name),
+			src.stage, target, elapsed.Round(time.Second), nd.config.StableFor, src.pending.Messages, nd.config.StableMessages)
+		return false
+	}
+
+	if target == StageNormal && src.stage == StageDrain {
+		if drained := now.Sub(src.stageSince); drained < nd.config.MinDrainDuration {
+			log.Printf("Pending %s transition %s -> %s: nodes drained %s ago, minimum is %s", upsLabel(src.name),
+				src.stage, target, drained.Round(time.Second), nd.config.MinDrainDuration)
+			return false
+		}
+	}
+
+	return true
+}
+
+// unsettled drops the pending transition of src after a reading that
+// requested no stage, so that only consecutive readings count towards it.
+// Callers must hold nd.mutex.
+func (nd *NodeDrainer) unsettled(src *upsSource) {
+	src.pending = PendingTransition{}
+	nd.metrics.observeStage(src.name, src.stage, "")
+}
+
+// setStage moves src into stage. Callers must hold nd.mutex.
+func (nd *NodeDrainer) setStage(src *upsSource, stage Stage) {
+	if src.stage != stage {
+		log.Printf("%s stage transition: %s -> %s", upsLabel(src.name), src.stage, stage)
+		message := fmt.Sprintf("%s -> %s", src.stage, stage)
+		previous, previousSince := src.stage, src.stageSince
+		src.stage = stage
+		src.stageSince = time.Now()
+		src.capacityReported = ""
+		nd.recordAction(Action{Action: ActionStage, UPS: src.name, Message: message})
+		nd.notifyStage(src, previous, previousSince)
+	}
+	src.pending = PendingTransition{}
+	nd.metrics.observeStage(src.name, src.stage, "")
+}
@@ -0,0 +1,24 @@
+package nodedrainer
+
+// leaderInfo identifies the replica holding the controller Lease
+type leaderInfo struct {
+	identity string
+	self     bool
+}
+
+// SetLeader records the replica currently holding the controller Lease and
+// whether it is this one
+func (nd *NodeDrainer) SetLeader(identity string, self bool) {
+	nd.leader.Store(&leaderInfo{identity: identity, self: self})
+	nd.metrics.isLeader.Set(boolToFloat(self))
+}
+
+// GetLeader returns the identity of the current leader and whether it is this
+// replica. Without leader election the identity is empty.
+func (nd *NodeDrainer) GetLeader() (string, bool) {
+	info := nd.leader.Load()
+	if info == nil {
+		return "", false
+	}
+	return info.identity, info.self
+}
@@ -0,0 +1,187 @@
+package nodedrainer
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/labels"
+)
+
+// PlanDrain computes what a manual drain of the named nodes would do without
+// modifying the cluster. Without names, every worker node powered by the
+// named UPS that is not drained yet is planned.
+func (nd *NodeDrainer) PlanDrain(ctx context.Context, source string, names []string) (*Plan, error) {
+	nd.mutex.RLock()
+	defer nd.mutex.RUnlock()
+
+	nodes, err := nd.drainTargets(source, names)
+	if err != nil {
+		return nil, err
+	}
+	plan := &Plan{Generated: time.Now(), UPS: source, Stage: StageDrain}
+	nodes, plan.Capacity, err = nd.applySafeguards(nodes)
+	if err != nil {
+		return nil, err
+	}
+	plan.Drain, err = nd.planNodeDrains(ctx, nodes)
+	if err != nil {
+		return nil, err
+	}
+	return plan, nil
+}
+
+// DrainNodes cordons and drains the named nodes, or every worker node powered
+// by the named UPS, regardless of its status, within the capacity safeguards
+// whose outcome it returns. The nodes are annotated like those drained for a
+// power event, so UncordonNodes or the next recovery of their UPS uncordons
+// them. It waits for the drain to finish or ctx to be cancelled.
+func (nd *NodeDrainer) DrainNodes(ctx context.Context, source string, names []string) (*CapacityReport, error) {
+	nd.mutex.Lock()
+	if nd.source(source).drain != nil {
+		nd.mutex.Unlock()
+		return nil, fmt.Errorf("a drain of worker nodes on %s is already in progress", upsLabel(source))
+	}
+	nodes, err := nd.drainTargets(source, names)
+	if err != nil {
+		nd.mutex.Unlock()
+		return nil, err
+	}
+	nodes, report, err := nd.applySafeguards(nodes)
+	if err != nil {
+		nd.mutex.Unlock()
+		return nil, err
+	}
+	nd.reportCapacity(source, report)
+	if len(nodes) == 0 {
+		nd.mutex.Unlock()
+		return report, nil
+	}
+
+	// Join the cycle of a UPS in the Drain stage, or record the drain alone
+	rec, started := nd.auditStart(source, AuditTriggerManualDrain, nil)
+	run := nd.startDrain(ctx, source, nodes, "manual drain", rec)
+	nd.mutex.Unlock()
+
+	<-run.done
+	if started {
+		nd.mutex.Lock()
+		nd.auditFinish(source)
+		nd.mutex.Unlock()
+	}
+
+	if len(run.failed) > 0 {
+		return report, fmt.Errorf("failed to drain nodes: %s", strings.Join(run.failed, ", "))
+	}
+	if run.cancelled {
+		return report, fmt.Errorf("drain cancelled: %w", ctx.Err())
+	}
+	return report, nil
+}
+
+// PlanUncordon lists the nodes a manual uncordon of the named nodes, or of
+// every node powered by the named UPS, would uncordon
+func (nd *NodeDrainer) PlanUncordon(source string, names []string) (*Plan, error) {
+	nd.mutex.RLock()
+	defer nd.mutex.RUnlock()
+
+	nodes, err := nd.uncordonTargets(source, names)
+	if err != nil {
+		return nil, err
+	}
+	return &Plan{Generated: time.Now(), UPS: source, Stage: StageNormal, Uncordon: nodes}, nil
+}
+
+// UncordonNodes uncordons the named nodes, or every node powered by the named
+// UPS, that were drained by us, and returns the uncordoned nodes. It does not
+// stop a UPS that is still in the Drain stage from draining them again.
+func (nd *NodeDrainer) UncordonNodes(source string, names []string) ([]string, error) {
+	nd.mutex.Lock()
+	defer nd.mutex.Unlock()
+
+	nodes, err := nd.uncordonTargets(source, names)
+	if err != nil || len(nodes) == 0 {
+		return nil, err
+	}
+	selected := make(map[string]bool, len(nodes))
+	for _, name := range nodes {
+		selected[name] = true
+	}
+
+	rec, started := nd.auditStart(source, AuditTriggerManualUncordon, nil)
+	uncordoned, err := nd.uncordonNodes(source, selected, "manual uncordon")
+	if started {
+		nd.auditFinish(source)
+	} else {
+		nd.saveAuditRecord(rec)
+	}
+	return uncordoned, err
+}
+
+// drainTargets returns the drain candidates of the named UPS, limited to
+// names if any. Callers must hold nd.mutex.
+func (nd *NodeDrainer) drainTargets(source string, names []string) ([]corev1.Node, error) {
+	candidates, err := nd.drainCandidates(source)
+	if err != nil || len(names) == 0 {
+		return candidates, err
+	}
+
+	nodes := make([]corev1.Node, 0, len(names))
+	for _, name := range names {
+		found := false
+		for i := range candidates {
+			if candidates[i].Name == name {
+				nodes = append(nodes, candidates[i])
+				found = true
+				break
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("node %s cannot be drained: %s", name, nd.notDrainableReason(source, name))
+		}
+	}
+	return nodes, nil
+}
+
+// notDrainableReason explains why the named node is not a drain candidate of
+// the named UPS. Callers must hold nd.mutex.
+func (nd *NodeDrainer) notDrainableReason(source, name string) string {
+	node, err := nd.cache.nodes.Get(name)
+	if err != nil {
+		return "not found"
+	}
+	if nd.isControlPlaneNode(node) {
+		return "control plane node"
+	}
+	if !nd.fedBy(node, source) {
+		return "powered by " + upsLabel(nd.nodeSource(node))
+	}
+	if nd.config.NodeSelector != nil && !nd.config.NodeSelector.Matches(labels.Set(node.Labels)) {
+		return "not selected by the node selector"
+	}
+	if ignored := nd.nodeIgnored(node); ignored != "" {
+		return ignored
+	}
+	if nd.isLastResortNode(node) {
+		return "last resort node"
+	}
+	return "already drained by UPS drainer"
+}
+
+// uncordonTargets returns the nodes of the named UPS drained by us, limited
+// to names if any. Callers must hold nd.mutex.
+func (nd *NodeDrainer) uncordonTargets(source string, names []string) ([]string, error) {
+	drained, err := nd.drainedNodes(source)
+	if err != nil || len(names) == 0 {
+		return drained, err
+	}
+
+	for _, name := range names {
+		if !containsString(drained, name) {
+			return nil, fmt.Errorf("node %s was not drained by UPS drainer", name)
+		}
+	}
+	return names, nil
+}
@@ -0,0 +1,78 @@
+package nodedrainer
+
+import (
+	"context"
+	"strings"
+	"testing"
+)
+
+func TestManualDrainAndUncordon(t *testing.T) {
+	env := newTestEnv(t, testConfig(), clusterObjects()...)
+
+	plan, err := env.drainer.PlanDrain(context.Background(), "", []string{"worker-1"})
+	if err != nil {
+		t.Fatalf("PlanDrain: %v", err)
+	}
+	if len(plan.Drain) != 1 || plan.Drain[0].Node != "worker-1" || strings.Join(plan.Drain[0].Evict, ",") != "default/app-1" {
+		t.Errorf("unexpected plan %+v", plan.Drain)
+	}
+	if !env.podExists("default", "app-1") {
+		t.Fatalf("planning evicted a pod")
+	}
+
+	if _, err := env.drainer.DrainNodes(context.Background(), "", []string{"worker-1"}); err != nil {
+		t.Fatalf("DrainNodes: %v", err)
+	}
+	env.waitForDrained("worker-1")
+	if env.podExists("default", "app-1") {
+		t.Errorf("pod app-1 was not evicted")
+	}
+	if !env.podExists("default", "app-2") {
+		t.Errorf("pod on worker-2 was evicted")
+	}
+
+	plan, err = env.drainer.PlanUncordon("", nil)
+	if err != nil {
+		t.Fatalf("PlanUncordon: %v", err)
+	}
+	if strings.Join(plan.Uncordon, ",") != "worker-1" {
+		t.Errorf("planned to uncordon %v, want worker-1", plan.Uncordon)
+	}
+
+	uncordoned, err := env.drainer.UncordonNodes("", nil)
+	if err != nil {
+		t.Fatalf("UncordonNodes: %v", err)
+	}
+	if strings.Join(uncordoned, ",") != "worker-1" {
+		t.Errorf("uncordoned %v, want worker-1", uncordoned)
+	}
+	env.waitForDrained()
+}
+
+func TestManualDrainRejectsNodes(t *testing.T) {
+	objects := append(clusterObjects(), testNode("worker-3", map[string]string{DefaultSourceLabel: "rack-b"}))
+	env := newTestEnv(t, testConfig(), objects...)
+
+	tests := []struct {
+		ups  string
+		node string
+		err  string
+	}{
+		{"", "control-plane", "control plane node"},
+		{"", "worker-9", "not found"},
+		{"rack-a", "worker-3", "powered by UPS rack-b"},
+	}
+	for _, tt := range tests {
+		if _, err := env.drainer.PlanDrain(context.Background(), tt.ups, []string{tt.node}); err == nil || !strings.Contains(err.Error(), tt.err) {
+			t.Errorf("PlanDrain(%q, %s): expected error containing %q, got %v", tt.ups, tt.node, tt.err, err)
+		}
+		if _, err := env.drainer.DrainNodes(context.Background(), tt.ups, []string{tt.node}); err == nil || !strings.Contains(err.Error(), tt.err) {
+			t.Errorf("DrainNodes(%q, %s): expected error containing %q, got %v", tt.ups, tt.node, tt.err, err)
+		}
+	}
+
+	if _, err := env.drainer.UncordonNodes("", []string{"worker-1"}); err == nil || !strings.Contains(err.Error(), "not drained") {
+		t.Errorf("expected uncordoning an undrained node to fail, got %v", err)
+	}
+	env.waitForDrained()
+}
@@ -0,0 +1,200 @@
+package nodedrainer
+
+import (
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const metricsNamespace = "ups_drainer"
+
+// metrics holds the Prometheus collectors of a NodeDrainer
+type metrics struct {
+	registry *prometheus.Registry
+
+	batteryLevel     *prometheus.GaugeVec
+	upsStatus        *prometheus.GaugeVec
+	runtimeLeft      *prometheus.GaugeVec
+	onBatterySince   *prometheus.GaugeVec
+	lastMessage      *prometheus.GaugeVec
+	stage            *prometheus.GaugeVec
+	pendingStage     *prometheus.GaugeVec
+	evictionAttempts prometheus.Counter
+	evictions        *prometheus.CounterVec
+	drainDuration    prometheus.Histogram
+	isLeader         prometheus.Gauge
+	rejectedMessages *prometheus.CounterVec
+}
+
+func newMetrics(nd *NodeDrainer) *metrics {
+	m := &metrics{
+		registry: prometheus.NewRegistry(),
+		batteryLevel: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Name:      "battery_level_percent",
+			Help:      "Battery level from the last status message of each UPS.",
+		}, []string{"ups"}),
+		upsStatus: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Name:      "ups_status",
+			Help:      "1 for each status flag in the last status message of each UPS, 0 otherwise.",
+		}, []string{"ups", "status"}),
+		runtimeLeft: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Name:      "runtime_left_seconds",
+			Help:      "Estimated runtime on battery from the last status message of each UPS reporting it.",
+		}, []string{"ups"}),
+		onBatterySince: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Name:      "on_battery_since_timestamp_seconds",
+			Help:      "Unix time each UPS currently on battery went on battery.",
+		}, []string{"ups"}),
+		lastMessage: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Name:      "last_message_timestamp_seconds",
+			Help:      "Unix time the last status message of each UPS was received.",
+		}, []string{"ups"}),
+		stage: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Name:      "stage",
+			Help:      "1 for the stage currently in effect for each UPS, 0 otherwise.",
+		}, []string{"ups", "stage"}),
+		pendingStage: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Name:      "pending_stage",
+			Help:      "1 for a stage transition of each UPS currently held back by hysteresis, 0 otherwise.",
+		}, []string{"ups", "stage"}),
+		evictionAttempts: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "eviction_attempts_total",
+			Help:      "Pod evictions attempted.",
+		}),
+		evictions: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "evictions_total",
+			Help:      "Pod eviction attempts by result (succeeded, blocked, failed).",
+		}, []string{"result"}),
+		drainDuration: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Namespace: metricsNamespace,
+			Name:      "drain_duration_seconds",
+			Help:      "Time taken to drain a node.",
+			Buckets:   []float64{5, 15, 30, 60, 120, 300, 600, 1200},
+		}),
+		isLeader: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Name:      "is_leader",
+			Help:      "1 if this replica holds the controller Lease (or leader election is disabled).",
+		}),
+		rejectedMessages: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "rejected_messages_total",
+			Help:      "UPS status messages rejected by reason (invalid_payload, invalid_timestamp, future, out_of_order, stale).",
+		}, []string{"reason"}),
+	}
+
+	for _, result := range []string{"succeeded", "blocked", "failed"} {
+		m.evictions.WithLabelValues(result)
+	}
+
+	m.registry.MustRegister(
+		m.batteryLevel,
+		m.upsStatus,
+		m.runtimeLeft,
+		m.onBatterySince,
+		m.lastMessage,
+		m.stage,
+		m.pendingStage,
+		m.evictionAttempts,
+		m.evictions,
+		m.drainDuration,
+		m.isLeader,
+		m.rejectedMessages,
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Name:      "seconds_since_last_message",
+			Help:      "Seconds since the last UPS status message, or since subscribing if none arrived.",
+		}, func() float64 {
+			return nd.sinceLastMessage().Seconds()
+		}),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Name:      "mqtt_connected",
+			Help:      "1 if the MQTT client is connected.",
+		}, func() float64 {
+			if nd.mqttClient != nil && nd.mqttClient.IsConnected() {
+				return 1
+			}
+			return 0
+		}),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Name:      "drained_nodes",
+			Help:      "Nodes currently cordoned and annotated by the drainer.",
+		}, func() float64 {
+			drained, err := nd.GetDrainedNodes()
+			if err != nil {
+				log.Printf("Failed to collect drained nodes for metrics: %v", err)
+				return 0
+			}
+			return float64(len(drained))
+		}),
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+	)
+
+	return m
+}
+
+// observeStatus records a received status message of the named UPS
+func (m *metrics) observeStatus(source string, status *UPSStatus, received time.Time) {
+	m.batteryLevel.WithLabelValues(source).Set(float64(status.BatteryLevel))
+	m.lastMessage.WithLabelValues(source).Set(float64(received.Unix()))
+
+	// Known flags are exported even when not set, unknown ones only while set
+	m.upsStatus.DeletePartialMatch(prometheus.Labels{"ups": source})
+	for _, known := range KnownStatusFlags {
+		m.upsStatus.WithLabelValues(source, known).Set(0)
+	}
+	for flag := range status.Flags() {
+		m.upsStatus.WithLabelValues(source, flag).Set(1)
+	}
+
+	if runtime := status.Runtime(); runtime > 0 {
+		m.runtimeLeft.WithLabelValues(source).Set(runtime.Seconds())
+	} else {
+		m.runtimeLeft.DeleteLabelValues(source)
+	}
+}
+
+// observeOnBattery records when the named UPS went on battery, zero while online
+func (m *metrics) observeOnBattery(source string, since time.Time) {
+	if since.IsZero() {
+		m.onBatterySince.DeleteLabelValues(source)
+		return
+	}
+	m.onBatterySince.WithLabelValues(source).Set(float64(since.Unix()))
+}
+
+// observeStage records the active and pending stages of the named UPS
+func (m *metrics) observeStage(source string, active Stage, pending Stage) {
+	for _, stage := range []Stage{StageNormal, StageDrain} {
+		m.stage.WithLabelValues(source, string(stage)).Set(boolToFloat(stage == active))
+		m.pendingStage.WithLabelValues(source, string(stage)).Set(boolToFloat(stage == pending && stage != active))
+	}
+}
+
+// MetricsHandler serves the drainer's metrics in the Prometheus exposition format
+func (nd *NodeDrainer) MetricsHandler() http.Handler {
+	return promhttp.HandlerFor(nd.metrics.registry, promhttp.HandlerOpts{})
+}
+
+func boolToFloat(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,164 @@
+package nodedrainer
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/smtp"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// WebhookNotifier posts notifications as JSON to a URL
+type WebhookNotifier struct {
+	URL string
+}
+
+// NewWebhookNotifier returns a notifier posting each Notification as JSON
+func NewWebhookNotifier(url string) *WebhookNotifier {
+	return &WebhookNotifier{URL: url}
+}
+
+func (w *WebhookNotifier) Name() string {
+	return "webhook"
+}
+
+func (w *WebhookNotifier) Notify(ctx context.Context, notification *Notification) error {
+	return sendJSON(ctx, http.MethodPost, w.URL, nil, notification)
+}
+
+// SlackNotifier posts notifications to a Slack-compatible incoming webhook,
+// also accepted by Mattermost, Rocket.Chat and Discord's /slack endpoint
+type SlackNotifier struct {
+	URL string
+}
+
+// NewSlackNotifier returns a notifier posting to an incoming webhook
+func NewSlackNotifier(url string) *SlackNotifier {
+	return &SlackNotifier{URL: url}
+}
+
+func (s *SlackNotifier) Name() string {
+	return "slack"
+}
+
+func (s *SlackNotifier) Notify(ctx context.Context, notification *Notification) error {
+	return sendJSON(ctx, http.MethodPost, s.URL, nil, map[string]string{"text": notification.Text})
+}
+
+// MatrixNotifier sends notifications as messages to a Matrix room
+type MatrixNotifier struct {
+	Homeserver  string
+	RoomID      string
+	AccessToken string
+}
+
+// NewMatrixNotifier returns a notifier sending to roomID on homeserver, e.g.
+// https://matrix.example.org, as the user owning accessToken
+func NewMatrixNotifier(homeserver, roomID, accessToken string) *MatrixNotifier {
+	return &MatrixNotifier{Homeserver: strings.TrimSuffix(homeserver, "/"), RoomID: roomID, AccessToken: accessToken}
+}
+
+func (m *MatrixNotifier) Name() string {
+	return "matrix"
+}
+
+func (m *MatrixNotifier) Notify(ctx context.Context, notification *Notification) error {
+	// The transaction ID makes retries of the same notification idempotent
+	txnID := fmt.Sprintf("ups-drainer-%d", notification.Time.UnixNano())
+	endpoint := fmt.Sprintf("%s/_matrix/client/v3/rooms/%s/send/m.room.message/%s",
+		m.Homeserver, url.PathEscape(m.RoomID), url.PathEscape(txnID))
+	headers := map[string]string{"Authorization": "Bearer " + m.AccessToken}
+	return sendJSON(ctx, http.MethodPut, endpoint, headers, map[string]string{
+		"msgtype": "m.text",
+		"body":    notification.Text,
+	})
+}
+
+// SMTPNotifier sends notifications by email
+type SMTPNotifier struct {
+	// Addr is the host:port of the mail server
+	Addr     string
+	From     string
+	To       []string
+	Username string
+	Password string
+}
+
+// NewSMTPNotifier returns a notifier mailing from to the recipients through
+// the server at addr. The server must offer STARTTLS when a username is set.
+func NewSMTPNotifier(addr, from string, to []string, username, password string) *SMTPNotifier {
+	return &SMTPNotifier{Addr: addr, From: from, To: to, Username: username, Password: password}
+}
+
+func (s *SMTPNotifier) Name() string {
+	return "smtp"
+}
+
+func (s *SMTPNotifier) Notify(ctx context.Context, notification *Notification) error {
+	var auth smtp.Auth
+	if s.Username != "" {
+		host, _, err := net.SplitHostPort(s.Addr)
+		if err != nil {
+			return fmt.Errorf("invalid SMTP address %q: %w", s.Addr, err)
+		}
+		auth = smtp.PlainAuth("", s.Username, s.Password, host)
+	}
+
+	subject := "UPS drainer: " + notification.Event
+	if notification.UPS != "" {
+		subject += " (" + notification.UPS + ")"
+	}
+	var msg bytes.Buffer
+	fmt.Fprintf(&msg, "From: %s\r\n", s.From)
+	fmt.Fprintf(&msg, "To: %s\r\n", strings.Join(s.To, ", "))
+	fmt.Fprintf(&msg, "Subject: %s\r\n", subject)
+	fmt.Fprintf(&msg, "Date: %s\r\n", notification.Time.Format(time.RFC1123Z))
+	msg.WriteString("Content-Type: text/plain; charset=utf-8\r\n\r\n")
+	msg.WriteString(strings.ReplaceAll(notification.Text, "\n", "\r\n"))
+	msg.WriteString("\r\n")
+
+	// net/smtp does not take a context; bound the whole exchange instead
+	done := make(chan error, 1)
+	go func() {
+		done <- smtp.SendMail(s.Addr, auth, s.From, s.To, msg.Bytes())
+	}()
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// sendJSON sends body as JSON and fails unless the response status is 2xx
+func sendJSON(ctx context.Context, method, endpoint string, headers map[string]string, body interface{}) error {
+	payload, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, endpoint, bytes.NewReader(payload))
+	if err != nil {
+		return fmt.Errorf("failed to build request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for name, value := range headers {
+		req.Header.Set(name, value)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("%s returned %s", req.URL.Host, resp.Status)
+	}
+	return nil
+}
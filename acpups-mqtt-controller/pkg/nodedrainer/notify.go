@@ -0,0 +1,236 @@
+package nodedrainer
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log"
+	"sync"
+	"text/template"
+	"time"
+)
+
+// Notification events
+const (
+	// EventDrainStarted is sent when a UPS enters the Drain stage
+	EventDrainStarted = "drain-started"
+	// EventNodeDrained is sent when a node drain completed
+	EventNodeDrained = "node-drained"
+	// EventFailure is sent when cordoning, draining, uncordoning, scaling or
+	// powering off failed
+	EventFailure = "failure"
+	// EventRecovered is sent when a UPS returns to the Normal stage after a drain
+	EventRecovered = "recovered"
+	// EventSuppressed summarizes notifications dropped by the rate limit
+	EventSuppressed = "suppressed"
+)
+
+// DefaultNotifyTemplate renders the text of a notification
+const DefaultNotifyTemplate = `[{{.Event}}] {{if .UPS}}UPS {{.UPS}}: {{end}}{{if .Target}}{{.Target}}: {{end}}{{.Message}}{{if .Error}} - {{.Error}}{{end}}`
+
+// notifyQueueSize bounds the notifications waiting for delivery; further
+// ones are dropped while the backends are slow
+const notifyQueueSize = 100
+
+// Notification is a drain lifecycle message sent to every notifier. Target is
+// the node or workload concerned, if any, and Text the notification rendered
+// with NotifyTemplate.
+type Notification struct {
+	Event   string    `json:"event"`
+	Time    time.Time `json:"time"`
+	UPS     string    `json:"ups,omitempty"`
+	Target  string    `json:"target,omitempty"`
+	Message string    `json:"message"`
+	Error   string    `json:"error,omitempty"`
+	Text    string    `json:"text"`
+}
+
+// Notifier delivers notifications to people, e.g. through a chat service
+type Notifier interface {
+	Name() string
+	Notify(ctx context.Context, notification *Notification) error
+}
+
+// notifications renders, rate limits and delivers notifications in the
+// background so that drains never wait for a notifier
+type notifications struct {
+	mutex     sync.Mutex
+	notifiers []Notifier
+	queue     chan *Notification
+	start     sync.Once
+
+	template *template.Template
+	events   map[string]bool
+	limit    int
+
+	windowStart time.Time
+	sent        int
+	suppressed  int
+}
+
+// AddNotifier registers a notifier for drain lifecycle notifications
+func (nd *NodeDrainer) AddNotifier(notifier Notifier) {
+	n := &nd.notifications
+	n.mutex.Lock()
+	n.notifiers = append(n.notifiers, notifier)
+	n.mutex.Unlock()
+
+	n.start.Do(func() {
+		n.queue = make(chan *Notification, notifyQueueSize)
+		go n.deliver()
+	})
+	log.Printf("Sending notifications to %s", notifier.Name())
+}
+
+// ParseNotifyTemplate parses a notification template; fields are those of
+// Notification
+func ParseNotifyTemplate(text string) (*template.Template, error) {
+	return template.New("notification").Parse(text)
+}
+
+// configure applies the notification settings of config
+func (n *notifications) configure(config *Config) {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+
+	text := config.NotifyTemplate
+	if text == "" {
+		text = DefaultNotifyTemplate
+	}
+	tmpl, err := ParseNotifyTemplate(text)
+	if err != nil {
+		log.Printf("Invalid notification template, using the default: %v", err)
+		tmpl = template.Must(ParseNotifyTemplate(DefaultNotifyTemplate))
+	}
+	n.template = tmpl
+
+	n.events = nil
+	if len(config.NotifyEvents) > 0 {
+		n.events = make(map[string]bool)
+		for _, event := range config.NotifyEvents {
+			n.events[event] = true
+		}
+	}
+	n.limit = config.NotifyRateLimit
+}
+
+// notify queues a notification unless no notifier is registered, its event
+// is not selected or the rate limit is exceeded
+func (nd *NodeDrainer) notify(notification Notification) {
+	n := &nd.notifications
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+
+	if len(n.notifiers) == 0 || (n.events != nil && !n.events[notification.Event]) {
+		return
+	}
+
+	now := time.Now()
+	if now.Sub(n.windowStart) >= time.Minute {
+		n.windowStart = now
+		n.sent = 0
+	}
+	if n.limit > 0 && n.sent >= n.limit {
+		if n.suppressed == 0 {
+			time.AfterFunc(n.windowStart.Add(time.Minute).Sub(now), n.flushSuppressed)
+		}
+		n.suppressed++
+		return
+	}
+	n.sent++
+
+	notification.Time = now
+	n.enqueue(&notification)
+}
+
+// flushSuppressed sends a summary of the notifications dropped by the rate
+// limit once the next window opens
+func (n *notifications) flushSuppressed() {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+
+	if n.suppressed == 0 {
+		return
+	}
+	now := time.Now()
+	n.enqueue(&Notification{
+		Event:   EventSuppressed,
+		Time:    now,
+		Message: fmt.Sprintf("%d notifications suppressed by the rate limit of %d per minute", n.suppressed, n.limit),
+	})
+	n.suppressed = 0
+	n.windowStart = now
+	n.sent = 1
+}
+
+// enqueue renders a notification and hands it to the delivery goroutine.
+// Callers must hold n.mutex.
+func (n *notifications) enqueue(notification *Notification) {
+	if n.template == nil {
+		n.template = template.Must(ParseNotifyTemplate(DefaultNotifyTemplate))
+	}
+	var text bytes.Buffer
+	if err := n.template.Execute(&text, notification); err != nil {
+		log.Printf("Failed to render %s notification: %v", notification.Event, err)
+		notification.Text = notification.Message
+	} else {
+		notification.Text = text.String()
+	}
+
+	select {
+	case n.queue <- notification:
+	default:
+		log.Printf("Notification queue full, dropping %s notification: %s", notification.Event, notification.Text)
+	}
+}
+
+// deliver sends queued notifications to every notifier
+func (n *notifications) deliver() {
+	for notification := range n.queue {
+		n.mutex.Lock()
+		notifiers := n.notifiers
+		n.mutex.Unlock()
+
+		for _, notifier := range notifiers {
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			if err := notifier.Notify(ctx, notification); err != nil {
+				log.Printf("Failed to send %s notification to %s: %v", notification.Event, notifier.Name(), err)
+			}
+			cancel()
+		}
+	}
+}
+
+// notifyStage notifies about a stage transition of src from previous, which
+// was entered at previousSince
+func (nd *NodeDrainer) notifyStage(src *upsSource, previous Stage, previousSince time.Time) {
+	reading := "no recent reading"
+	if status := src.lastStatus; status != nil {
+		reading = fmt.Sprintf("status %s, battery %d%%", status.Status, status.BatteryLevel)
+		if runtime := status.Runtime(); runtime > 0 {
+			reading += fmt.Sprintf(", runtime %s", runtime.Round(time.Second))
+		}
+	}
+
+	switch {
+	case src.stage == StageDrain:
+		nd.notify(Notification{Event: EventDrainStarted, UPS: src.name,
+			Message: fmt.Sprintf("protecting worker nodes (mode: %s) - %s", nd.config.DrainMode, reading)})
+	case src.stage == StageNormal && previous == StageDrain:
+		nd.notify(Notification{Event: EventRecovered, UPS: src.name,
+			Message: fmt.Sprintf("power restored, restoring nodes after %s - %s", time.Since(previousSince).Round(time.Second), reading)})
+	}
+}
+
+// notifyAction notifies about completed node drains and failed actions
+func (nd *NodeDrainer) notifyAction(action *Action) {
+	switch {
+	case action.Error != "" && action.Action != ActionEvict && action.Action != ActionDelete && action.Action != ActionOverride:
+		// Pod eviction failures are summarized by the failed drain of their node
+		nd.notify(Notification{Event: EventFailure, UPS: action.UPS, Target: action.Target,
+			Message: action.Action + " failed", Error: action.Error})
+	case action.Error == "" && action.Action == ActionDrain:
+		nd.notify(Notification{Event: EventNodeDrained, UPS: action.UPS, Target: action.Target,
+			Message: "drained (" + action.Message + ")"})
+	}
+}
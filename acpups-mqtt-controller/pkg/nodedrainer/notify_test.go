@@ -0,0 +1,255 @@
+package nodedrainer
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+// notifyStub is a local HTTP endpoint recording the requests of a notifier
+type notifyStub struct {
+	*httptest.Server
+	status int
+
+	mutex    sync.Mutex
+	requests []stubRequest
+}
+
+type stubRequest struct {
+	method string
+	path   string
+	header http.Header
+	body   []byte
+}
+
+func newNotifyStub(t *testing.T) *notifyStub {
+	stub := &notifyStub{status: http.StatusOK}
+	stub.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		stub.mutex.Lock()
+		stub.requests = append(stub.requests, stubRequest{r.Method, r.URL.EscapedPath(), r.Header.Clone(), body})
+		stub.mutex.Unlock()
+		w.WriteHeader(stub.status)
+	}))
+	t.Cleanup(stub.Close)
+	return stub
+}
+
+func (s *notifyStub) received() []stubRequest {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return append([]stubRequest(nil), s.requests...)
+}
+
+// notifications decodes the requests of a WebhookNotifier
+func (s *notifyStub) notifications(t *testing.T) []Notification {
+	var notifications []Notification
+	for _, req := range s.received() {
+		var notification Notification
+		if err := json.Unmarshal(req.body, &notification); err != nil {
+			t.Fatalf("failed to decode notification: %v", err)
+		}
+		notifications = append(notifications, notification)
+	}
+	return notifications
+}
+
+// waitForEvents waits until notifications of all events were received
+func (e *testEnv) waitForEvents(stub *notifyStub, events ...string) []Notification {
+	var notifications []Notification
+	e.eventually("notifications "+strings.Join(events, ", "), func() bool {
+		notifications = stub.notifications(e.t)
+		for _, event := range events {
+			if findNotification(notifications, event) == nil {
+				return false
+			}
+		}
+		return true
+	})
+	return notifications
+}
+
+func findNotification(notifications []Notification, event string) *Notification {
+	for i := range notifications {
+		if notifications[i].Event == event {
+			return &notifications[i]
+		}
+	}
+	return nil
+}
+
+func TestNotifierRequests(t *testing.T) {
+	notification := &Notification{
+		Event:   EventDrainStarted,
+		Time:    time.Date(2025, 9, 15, 12, 0, 0, 0, time.UTC),
+		UPS:     "rack-a",
+		Message: "protecting worker nodes",
+		Text:    "[drain-started] UPS rack-a: protecting worker nodes",
+	}
+
+	t.Run("webhook", func(t *testing.T) {
+		stub := newNotifyStub(t)
+		if err := NewWebhookNotifier(stub.URL).Notify(context.Background(), notification); err != nil {
+			t.Fatalf("Notify: %v", err)
+		}
+		got := stub.notifications(t)
+		if len(got) != 1 || got[0].Event != EventDrainStarted || got[0].UPS != "rack-a" || got[0].Text != notification.Text {
+			t.Errorf("unexpected notifications %+v", got)
+		}
+	})
+
+	t.Run("slack", func(t *testing.T) {
+		stub := newNotifyStub(t)
+		if err := NewSlackNotifier(stub.URL+"/hooks/abc").Notify(context.Background(), notification); err != nil {
+			t.Fatalf("Notify: %v", err)
+		}
+		req := stub.received()[0]
+		if req.method != http.MethodPost || req.path != "/hooks/abc" || string(req.body) != `{"text":"[drain-started] UPS rack-a: protecting worker nodes"}` {
+			t.Errorf("unexpected request %s %s %s", req.method, req.path, req.body)
+		}
+	})
+
+	t.Run("matrix", func(t *testing.T) {
+		stub := newNotifyStub(t)
+		if err := NewMatrixNotifier(stub.URL+"/", "!room:example.org", "secret").Notify(context.Background(), notification); err != nil {
+			t.Fatalf("Notify: %v", err)
+		}
+		req := stub.received()[0]
+		wantPath := "/_matrix/client/v3/rooms/%21room:example.org/send/m.room.message/ups-drainer-1757937600000000000"
+		if req.method != http.MethodPut || req.path != wantPath {
+			t.Errorf("unexpected request %s %s, want PUT %s", req.method, req.path, wantPath)
+		}
+		if auth := req.header.Get("Authorization"); auth != "Bearer secret" {
+			t.Errorf("Authorization = %q", auth)
+		}
+		var body map[string]string
+		if err := json.Unmarshal(req.body, &body); err != nil || body["msgtype"] != "m.text" || body["body"] != notification.Text {
+			t.Errorf("unexpected body %s", req.body)
+		}
+	})
+
+	t.Run("error status", func(t *testing.T) {
+		stub := newNotifyStub(t)
+		stub.status = http.StatusForbidden
+		err := NewSlackNotifier(stub.URL).Notify(context.Background(), notification)
+		if err == nil || !strings.Contains(err.Error(), "403") {
+			t.Errorf("expected error for status 403, got %v", err)
+		}
+	})
+}
+
+func TestDrainLifecycleNotifications(t *testing.T) {
+	env := newTestEnv(t, testConfig(), clusterObjects()...)
+	stub := newNotifyStub(t)
+	env.drainer.AddNotifier(NewWebhookNotifier(stub.URL))
+
+	env.powerEvent("ONBATT", 30)
+	env.waitForDrained("worker-1", "worker-2")
+	env.eventually("node-drained notifications", func() bool {
+		drained := map[string]bool{}
+		for _, n := range stub.notifications(t) {
+			if n.Event == EventNodeDrained {
+				drained[n.Target] = true
+			}
+		}
+		return drained["worker-1"] && drained["worker-2"]
+	})
+
+	env.powerEvent("ONLINE", 100)
+	notifications := env.waitForEvents(stub, EventRecovered)
+
+	if started := findNotification(notifications, EventDrainStarted); started == nil || !strings.Contains(started.Message, "battery 30%") {
+		t.Errorf("unexpected drain-started notification %+v", started)
+	}
+	if failure := findNotification(notifications, EventFailure); failure != nil {
+		t.Errorf("unexpected failure notification %+v", failure)
+	}
+	if recovered := findNotification(notifications, EventRecovered); !strings.HasPrefix(recovered.Text, "[recovered] ") {
+		t.Errorf("unexpected text %q", recovered.Text)
+	}
+}
+
+func TestFailedDrainNotifies(t *testing.T) {
+	env := newTestEnv(t, testConfig(), clusterObjects()...)
+	stub := newNotifyStub(t)
+	env.drainer.AddNotifier(NewWebhookNotifier(stub.URL))
+	env.failEviction("app-1", apierrors.NewForbidden(schema.GroupResource{Resource: "pods"}, "app-1", nil))
+
+	env.powerEvent("ONBATT", 30)
+	notifications := env.waitForEvents(stub, EventFailure)
+
+	failure := findNotification(notifications, EventFailure)
+	if failure.Target != "worker-1" || failure.Error == "" {
+		t.Errorf("unexpected failure notification %+v", failure)
+	}
+}
+
+func TestNotificationTemplateAndEvents(t *testing.T) {
+	config := testConfig()
+	config.NotifyTemplate = `{{.Event}}|{{.UPS}}|{{.Message}}`
+	config.NotifyEvents = []string{EventRecovered}
+	env := newTestEnv(t, config, clusterObjects()...)
+	stub := newNotifyStub(t)
+	env.drainer.AddNotifier(NewSlackNotifier(stub.URL))
+
+	env.powerEvent("ONBATT", 30)
+	env.waitForDrained("worker-1", "worker-2")
+	env.powerEvent("ONLINE", 100)
+	env.eventually("recovered notification", func() bool { return len(stub.received()) > 0 })
+
+	requests := stub.received()
+	if len(requests) != 1 {
+		t.Fatalf("expected only the recovered notification, got %d requests", len(requests))
+	}
+	var body map[string]string
+	if err := json.Unmarshal(requests[0].body, &body); err != nil {
+		t.Fatalf("failed to decode body: %v", err)
+	}
+	if !strings.HasPrefix(body["text"], "recovered||power restored") {
+		t.Errorf("unexpected text %q", body["text"])
+	}
+}
+
+func TestNotificationRateLimit(t *testing.T) {
+	config := testConfig()
+	config.NotifyRateLimit = 1
+	nd := &NodeDrainer{}
+	nd.notifications.configure(config)
+	stub := newNotifyStub(t)
+	nd.AddNotifier(NewWebhookNotifier(stub.URL))
+
+	for i := 0; i < 3; i++ {
+		nd.notify(Notification{Event: EventFailure, Target: "worker-1", Message: "cordon failed"})
+	}
+	time.Sleep(200 * time.Millisecond)
+	if got := len(stub.received()); got != 1 {
+		t.Fatalf("received %d notifications within the limit, want 1", got)
+	}
+
+	nd.notifications.mutex.Lock()
+	suppressed := nd.notifications.suppressed
+	nd.notifications.mutex.Unlock()
+	if suppressed != 2 {
+		t.Errorf("suppressed %d notifications, want 2", suppressed)
+	}
+
+	// The summary is sent once the window is over
+	nd.notifications.flushSuppressed()
+	deadline := time.Now().Add(testTimeout)
+	for len(stub.received()) < 2 && time.Now().Before(deadline) {
+		time.Sleep(testPollInterval)
+	}
+	summary := findNotification(stub.notifications(t), EventSuppressed)
+	if summary == nil || !strings.HasPrefix(summary.Message, "2 notifications suppressed") {
+		t.Errorf("unexpected summary %+v", summary)
+	}
+}
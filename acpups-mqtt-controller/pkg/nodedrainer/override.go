@@ -0,0 +1,429 @@
+package nodedrainer
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/cache"
+	"sigs.k8s.io/yaml"
+)
+
+const (
+	// OverridePause stops the controller from acting on UPS readings
+	OverridePause = "pause"
+	// OverrideForceDrain protects the nodes of a UPS as if it were on battery
+	OverrideForceDrain = "force-drain"
+	// OverrideForceUncordon keeps the nodes of a UPS uncordoned whatever it reports
+	OverrideForceUncordon = "force-uncordon"
+	// OverrideIgnoreNode stops the controller from draining, uncordoning or
+	// powering off a node
+	OverrideIgnoreNode = "ignore-node"
+	// OverrideClear is a command removing overrides set through the command topic
+	OverrideClear = "clear"
+
+	// IgnoreAnnotation excludes a node like OverrideIgnoreNode. The value is
+	// "true" or an RFC 3339 time until which the node is ignored.
+	IgnoreAnnotation = "ups.k8s.io/ignore"
+
+	// OverridesConfigMapKey is the ConfigMap data key holding the overrides
+	OverridesConfigMapKey = "overrides"
+
+	// Where an override came from
+	OverrideSourceCommand   = "command"
+	OverrideSourceConfigMap = "configmap"
+)
+
+// Override is a manual instruction that takes precedence over UPS readings
+type Override struct {
+	Type string `json:"type"`
+	// UPS limits pause, force-drain and force-uncordon to one UPS; empty
+	// applies to all
+	UPS string `json:"ups,omitempty"`
+	// Node is the node to ignore
+	Node   string `json:"node,omitempty"`
+	Reason string `json:"reason,omitempty"`
+	// Until is when the override expires; unset never expires
+	Until *metav1.Time `json:"until,omitempty"`
+	// For sets Until relative to when a command is received, e.g. "2h"
+	For    string `json:"for,omitempty"`
+	Source string `json:"source,omitempty"`
+}
+
+func (o *Override) String() string {
+	s := o.Type
+	switch {
+	case o.Node != "":
+		s += " node " + o.Node
+	case o.UPS != "":
+		s += " " + upsLabel(o.UPS)
+	}
+	if o.Until != nil {
+		s += " until " + o.Until.UTC().Format(time.RFC3339)
+	}
+	if o.Reason != "" {
+		s += fmt.Sprintf(" (%s)", o.Reason)
+	}
+	return s
+}
+
+// validate checks an override and resolves For into Until relative to now
+func (o *Override) validate(now time.Time) error {
+	switch o.Type {
+	case OverridePause, OverrideForceDrain, OverrideForceUncordon:
+		if o.Node != "" {
+			return fmt.Errorf("%s applies to a UPS, not a node", o.Type)
+		}
+	case OverrideIgnoreNode:
+		if o.Node == "" {
+			return fmt.Errorf("%s requires a node", o.Type)
+		}
+	default:
+		return fmt.Errorf("unknown override type %q", o.Type)
+	}
+
+	if o.For != "" {
+		duration, err := time.ParseDuration(o.For)
+		if err != nil || duration <= 0 {
+			return fmt.Errorf("invalid duration %q", o.For)
+		}
+		until := metav1.NewTime(now.Add(duration))
+		o.Until = &until
+		o.For = ""
+	}
+	return nil
+}
+
+// expired reports whether the override no longer applies at now
+func (o *Override) expired(now time.Time) bool {
+	return o.Until != nil && !now.Before(o.Until.Time)
+}
+
+// GetOverrides returns the overrides currently in effect
+func (nd *NodeDrainer) GetOverrides() []Override {
+	nd.mutex.RLock()
+	defer nd.mutex.RUnlock()
+	return nd.activeOverrides()
+}
+
+// activeOverrides returns the unexpired overrides from the ConfigMap followed
+// by those from commands in the order received. Callers must hold nd.mutex.
+func (nd *NodeDrainer) activeOverrides() []Override {
+	now := time.Now()
+	var active []Override
+	for _, list := range [][]Override{nd.configMapOverrides, nd.commandOverrides} {
+		for _, o := range list {
+			if !o.expired(now) {
+				active = append(active, o)
+			}
+		}
+	}
+	return active
+}
+
+// stageOverride returns the override deciding the stage of the named UPS, or
+// nil if its readings are acted on normally. A pause wins over forcing a
+// stage; of several forced stages the latest wins. Callers must hold nd.mutex.
+func (nd *NodeDrainer) stageOverride(source string) *Override {
+	var found *Override
+	for _, o := range nd.activeOverrides() {
+		if o.Type == OverrideIgnoreNode || (o.UPS != "" && o.UPS != source) {
+			continue
+		}
+		o := o
+		if o.Type == OverridePause {
+			return &o
+		}
+		found = &o
+	}
+	return found
+}
+
+// nodeIgnored returns why the controller must leave node alone, or "" if it
+// may act on it. Callers must hold nd.mutex.
+func (nd *NodeDrainer) nodeIgnored(node *corev1.Node) string {
+	if value, ok := node.Annotations[IgnoreAnnotation]; ok && value != "false" {
+		until, err := time.Parse(time.RFC3339, value)
+		if err != nil {
+			return "annotated with " + IgnoreAnnotation
+		}
+		if time.Now().Before(until) {
+			return fmt.Sprintf("annotated with %s until %s", IgnoreAnnotation, value)
+		}
+	}
+
+	for _, o := range nd.activeOverrides() {
+		if o.Type == OverrideIgnoreNode && o.Node == node.Name {
+			return "ignored by override " + o.String()
+		}
+	}
+	return ""
+}
+
+// applyOverride acts on the stage override of src instead of its readings.
+// Callers must hold nd.mutex.
+func (nd *NodeDrainer) applyOverride(src *upsSource, override *Override) {
+	ctx := context.Background()
+
+	switch override.Type {
+	case OverridePause:
+		log.Printf("%s paused by override %s - not acting on its readings", upsLabel(src.name), override.String())
+		nd.cancelDrain(src, "paused by override "+override.String())
+	case OverrideForceDrain:
+		nd.setStage(src, StageDrain)
+		if nd.config.DryRun {
+			log.Printf("[dry-run] Would protect worker nodes of %s (mode: %s) because of override %s", upsLabel(src.name), nd.config.DrainMode, override.String())
+			return
+		}
+		log.Printf("Protecting worker nodes of %s because of override %s", upsLabel(src.name), override.String())
+		rec, _ := nd.auditStart(src.name, "override "+override.String(), src.lastStatus)
+		if err := nd.protect(src.name, rec); err != nil {
+			log.Printf("Failed to protect worker nodes: %v", err)
+		}
+	case OverrideForceUncordon:
+		nd.setStage(src, StageNormal)
+		if nd.config.DryRun {
+			log.Printf("[dry-run] Would restore workloads and uncordon nodes of %s because of override %s", upsLabel(src.name), override.String())
+			return
+		}
+		log.Printf("Restoring workloads and uncordoning nodes of %s because of override %s", upsLabel(src.name), override.String())
+		nd.cancelDrain(src, "override "+override.String())
+		if err := nd.restoreWorkloads(ctx, src.name); err != nil {
+			log.Printf("Failed to restore scaled-down workloads: %v", err)
+		}
+		if err := nd.uncordonUPSDrainedNodes(src.name); err != nil {
+			log.Printf("Failed to uncordon nodes: %v", err)
+		}
+		nd.auditFinish(src.name)
+	}
+}
+
+// applyOverrides acts on the stage overrides of every known UPS, and of UPSes
+// named by an override, right away rather than with their next reading.
+// Callers must hold nd.mutex.
+func (nd *NodeDrainer) applyOverrides() {
+	if !isTopicPattern(nd.config.MQTTTopic) {
+		nd.source("")
+	} else {
+		for _, o := range nd.activeOverrides() {
+			if o.UPS != "" {
+				nd.source(o.UPS)
+			}
+		}
+	}
+	for _, src := range nd.sources {
+		if override := nd.stageOverride(src.name); override != nil && override.Type != OverridePause {
+			nd.applyOverride(src, override)
+		}
+	}
+}
+
+// onCommand handles an override command from the command topic
+func (nd *NodeDrainer) onCommand(client mqtt.Client, msg mqtt.Message) {
+	var command Override
+	if err := json.Unmarshal(msg.Payload(), &command); err != nil {
+		log.Printf("Failed to parse override command: %v", err)
+		return
+	}
+
+	nd.mutex.Lock()
+	defer nd.mutex.Unlock()
+	defer nd.reportPolicyStatus()
+
+	if command.Type == OverrideClear {
+		nd.clearOverrides(&command)
+		nd.publishState()
+		return
+	}
+
+	if err := command.validate(time.Now()); err != nil {
+		log.Printf("Rejected override command: %v", err)
+		return
+	}
+	command.Source = OverrideSourceCommand
+
+	// A new override replaces an earlier one for the same UPS or node, and a
+	// forced stage replaces the opposite one
+	kept := nd.commandOverrides[:0]
+	for _, o := range nd.commandOverrides {
+		sameScope := o.UPS == command.UPS && o.Node == command.Node
+		if sameScope && (o.Type == command.Type || (forcesStage(o.Type) && forcesStage(command.Type))) {
+			continue
+		}
+		kept = append(kept, o)
+	}
+	nd.commandOverrides = append(kept, command)
+
+	log.Printf("Override set by command: %s", command.String())
+	nd.recordAction(Action{Action: ActionOverride, UPS: command.UPS, Target: command.Node, Message: "set " + command.String()})
+	nd.applyOverrides()
+}
+
+// forcesStage reports whether an override type forces a stage
+func forcesStage(overrideType string) bool {
+	return overrideType == OverrideForceDrain || overrideType == OverrideForceUncordon
+}
+
+// clearOverrides removes the command overrides matching the UPS and node of
+// a clear command; without either it removes all of them. Callers must hold
+// nd.mutex.
+func (nd *NodeDrainer) clearOverrides(command *Override) {
+	kept := nd.commandOverrides[:0]
+	for _, o := range nd.commandOverrides {
+		if (command.UPS == "" || o.UPS == command.UPS) && (command.Node == "" || o.Node == command.Node) {
+			log.Printf("Override cleared by command: %s", o.String())
+			nd.recordAction(Action{Action: ActionOverride, UPS: o.UPS, Target: o.Node, Message: "cleared " + o.String()})
+			continue
+		}
+		kept = append(kept, o)
+	}
+	nd.commandOverrides = kept
+}
+
+// expireOverrides drops expired command overrides and reports every override
+// that expired since the last call. Readings are acted on normally again
+// from the next one on.
+func (nd *NodeDrainer) expireOverrides() {
+	nd.mutex.Lock()
+	defer nd.mutex.Unlock()
+
+	now := time.Now()
+	expired := false
+	for _, list := range [][]Override{nd.configMapOverrides, nd.commandOverrides} {
+		for _, o := range list {
+			if o.expired(now) && o.Until.Time.After(nd.overridesChecked) {
+				log.Printf("Override expired: %s", o.String())
+				nd.recordAction(Action{Action: ActionOverride, UPS: o.UPS, Target: o.Node, Message: "expired " + o.String()})
+				expired = true
+			}
+		}
+	}
+	nd.overridesChecked = now
+
+	kept := nd.commandOverrides[:0]
+	for _, o := range nd.commandOverrides {
+		if !o.expired(now) {
+			kept = append(kept, o)
+		}
+	}
+	nd.commandOverrides = kept
+
+	if expired {
+		nd.reportPolicyStatus()
+	}
+}
+
+// WatchOverrides follows the overrides listed in the named ConfigMap. The
+// overrides key holds a YAML list of overrides; For is not supported there.
+func (nd *NodeDrainer) WatchOverrides(ctx context.Context, namespace, name string) error {
+	factory := informers.NewSharedInformerFactoryWithOptions(nd.clientset, informerResync,
+		informers.WithNamespace(namespace),
+		informers.WithTweakListOptions(func(options *metav1.ListOptions) {
+			options.FieldSelector = fields.OneTermEqualSelector("metadata.name", name).String()
+		}))
+	informer := factory.Core().V1().ConfigMaps().Informer()
+
+	_, err := informer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc: func(obj interface{}) {
+			nd.onOverrideConfigMap(obj, name)
+		},
+		UpdateFunc: func(_, obj interface{}) {
+			nd.onOverrideConfigMap(obj, name)
+		},
+		DeleteFunc: func(interface{}) {
+			log.Printf("Override ConfigMap %s/%s deleted - removing its overrides", namespace, name)
+			nd.setConfigMapOverrides(nil)
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to watch ConfigMap %s/%s: %w", namespace, name, err)
+	}
+
+	factory.Start(ctx.Done())
+	if !cache.WaitForCacheSync(ctx.Done(), informer.HasSynced) {
+		return fmt.Errorf("timed out waiting for ConfigMap %s/%s to sync", namespace, name)
+	}
+
+	log.Printf("Watching overrides in ConfigMap: %s/%s", namespace, name)
+	return nil
+}
+
+// LoadOverrides reads the overrides listed in the named ConfigMap, as
+// WatchOverrides would
+func LoadOverrides(ctx context.Context, clientset kubernetes.Interface, namespace, name string) ([]Override, error) {
+	configMap, err := clientset.CoreV1().ConfigMaps(namespace).Get(ctx, name, metav1.GetOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("failed to get ConfigMap %s/%s: %w", namespace, name, err)
+	}
+	overrides, err := parseOverrides(configMap.Data[OverridesConfigMapKey])
+	if err != nil {
+		return nil, fmt.Errorf("invalid overrides in ConfigMap %s/%s: %w", namespace, name, err)
+	}
+	return overrides, nil
+}
+
+func (nd *NodeDrainer) onOverrideConfigMap(obj interface{}, name string) {
+	configMap, ok := obj.(*corev1.ConfigMap)
+	if !ok || configMap.Name != name {
+		return
+	}
+
+	overrides, err := parseOverrides(configMap.Data[OverridesConfigMapKey])
+	if err != nil {
+		log.Printf("Ignoring invalid overrides in ConfigMap %s/%s: %v", configMap.Namespace, configMap.Name, err)
+		return
+	}
+	nd.setConfigMapOverrides(overrides)
+}
+
+// setConfigMapOverrides replaces the overrides from the ConfigMap
+func (nd *NodeDrainer) setConfigMapOverrides(overrides []Override) {
+	nd.mutex.Lock()
+	defer nd.mutex.Unlock()
+
+	nd.configMapOverrides = overrides
+	var descriptions []string
+	for _, o := range overrides {
+		descriptions = append(descriptions, o.String())
+	}
+	if len(descriptions) == 0 {
+		descriptions = append(descriptions, "none")
+	}
+	log.Printf("Overrides from ConfigMap: %s", strings.Join(descriptions, ", "))
+
+	// Before Subscribe the overrides take effect with the first reading
+	if nd.config == nil {
+		return
+	}
+	nd.recordAction(Action{Action: ActionOverride, Message: "configmap: " + strings.Join(descriptions, ", ")})
+	nd.applyOverrides()
+	nd.reportPolicyStatus()
+}
+
+// parseOverrides decodes the YAML list of overrides kept in a ConfigMap
+func parseOverrides(data string) ([]Override, error) {
+	var overrides []Override
+	if err := yaml.Unmarshal([]byte(data), &overrides); err != nil {
+		return nil, err
+	}
+	for i := range overrides {
+		o := &overrides[i]
+		if o.For != "" {
+			return nil, fmt.Errorf("override %d: for is only supported in commands, use until", i+1)
+		}
+		if err := o.validate(time.Now()); err != nil {
+			return nil, fmt.Errorf("override %d: %w", i+1, err)
+		}
+		o.Source = OverrideSourceConfigMap
+	}
+	return overrides, nil
+}
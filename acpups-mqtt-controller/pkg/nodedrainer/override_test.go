@@ -0,0 +1,166 @@
+package nodedrainer
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// overrideConfig returns a test configuration accepting override commands
+func overrideConfig() *Config {
+	config := testConfig()
+	config.CommandTopic = "test/ups/command"
+	return config
+}
+
+// command publishes an override command and waits until the drainer has
+// the expected number of overrides in effect
+func (e *testEnv) command(override Override, active int) {
+	e.t.Helper()
+
+	payload, err := json.Marshal(override)
+	if err != nil {
+		e.t.Fatalf("failed to encode command: %v", err)
+	}
+	if token := e.publisher.Publish(e.config.CommandTopic, 1, false, payload); token.Wait() && token.Error() != nil {
+		e.t.Fatalf("failed to publish command: %v", token.Error())
+	}
+	e.eventually("command "+string(payload)+" handled", func() bool {
+		return len(e.drainer.GetOverrides()) == active
+	})
+}
+
+func TestPauseOverrideStopsDrain(t *testing.T) {
+	env := newTestEnv(t, overrideConfig(), clusterObjects()...)
+
+	env.command(Override{Type: OverridePause, For: "1h", Reason: "electrical work"}, 1)
+	env.powerEvent("ONBATT", 20)
+
+	if drained, _ := env.drainer.GetDrainedNodes(); len(drained) != 0 {
+		t.Errorf("nodes drained while paused: %v", drained)
+	}
+	overrides := env.drainer.GetOverrides()
+	if overrides[0].Source != OverrideSourceCommand || overrides[0].Until == nil {
+		t.Errorf("expected a command override with an expiry, got %+v", overrides[0])
+	}
+
+	// Once the pause is cleared the next reading is acted on
+	env.command(Override{Type: OverrideClear}, 0)
+	env.powerEvent("ONBATT", 19)
+	env.waitForDrained("worker-1", "worker-2")
+}
+
+func TestForceOverrides(t *testing.T) {
+	env := newTestEnv(t, overrideConfig(), clusterObjects()...)
+	env.powerEvent("ONLINE", 100)
+
+	env.command(Override{Type: OverrideForceDrain}, 1)
+	env.waitForDrained("worker-1", "worker-2")
+
+	// Readings do not undo a forced drain
+	env.powerEvent("ONLINE", 100)
+	if !drainedByUs(env.node("worker-1")) {
+		t.Errorf("worker-1 uncordoned during forced drain")
+	}
+
+	// force-uncordon replaces force-drain and holds through a power loss
+	env.command(Override{Type: OverrideForceUncordon}, 1)
+	env.waitForDrained()
+	env.powerEvent("ONBATT", 20)
+	if drained, _ := env.drainer.GetDrainedNodes(); len(drained) != 0 {
+		t.Errorf("nodes drained during forced uncordon: %v", drained)
+	}
+}
+
+func TestIgnoredNodesAreNotDrained(t *testing.T) {
+	objects := clusterObjects()
+	ignored := testNode("worker-3", nil)
+	ignored.Annotations = map[string]string{IgnoreAnnotation: "true"}
+	expired := testNode("worker-4", nil)
+	expired.Annotations = map[string]string{IgnoreAnnotation: time.Now().Add(-time.Hour).Format(time.RFC3339)}
+	objects = append(objects, ignored, expired)
+
+	env := newTestEnv(t, overrideConfig(), objects...)
+	env.command(Override{Type: OverrideIgnoreNode, Node: "worker-2"}, 1)
+
+	env.powerEvent("ONBATT", 20)
+	env.waitForDrained("worker-1", "worker-4")
+
+	for _, name := range []string{"worker-2", "worker-3"} {
+		if env.node(name).Spec.Unschedulable {
+			t.Errorf("ignored node %s was cordoned", name)
+		}
+	}
+	if !env.podExists("default", "app-2") {
+		t.Errorf("pod on ignored node was evicted")
+	}
+}
+
+func TestOverrideValidation(t *testing.T) {
+	now := time.Now()
+	tests := []struct {
+		name     string
+		override Override
+		valid    bool
+	}{
+		{"pause", Override{Type: OverridePause}, true},
+		{"force-drain for one UPS", Override{Type: OverrideForceDrain, UPS: "rack-a"}, true},
+		{"force-uncordon with a node", Override{Type: OverrideForceUncordon, Node: "worker-1"}, false},
+		{"ignore-node", Override{Type: OverrideIgnoreNode, Node: "worker-1"}, true},
+		{"ignore-node without a node", Override{Type: OverrideIgnoreNode}, false},
+		{"unknown type", Override{Type: "drain"}, false},
+		{"duration", Override{Type: OverridePause, For: "30m"}, true},
+		{"invalid duration", Override{Type: OverridePause, For: "soon"}, false},
+		{"negative duration", Override{Type: OverridePause, For: "-1h"}, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			o := tt.override
+			err := o.validate(now)
+			if (err == nil) != tt.valid {
+				t.Fatalf("validate() error = %v, want valid %v", err, tt.valid)
+			}
+			if err == nil && tt.override.For != "" {
+				if o.For != "" || o.Until == nil || !o.Until.Time.Equal(metav1.NewTime(now.Add(30*time.Minute)).Time) {
+					t.Errorf("duration not resolved into until: %+v", o)
+				}
+			}
+		})
+	}
+}
+
+func TestParseOverrides(t *testing.T) {
+	overrides, err := parseOverrides(`
+- type: pause
+  ups: rack-a
+  until: "2030-01-01T00:00:00Z"
+  reason: switchboard replacement
+- type: ignore-node
+  node: worker-3
+`)
+	if err != nil {
+		t.Fatalf("parseOverrides: %v", err)
+	}
+	if len(overrides) != 2 {
+		t.Fatalf("expected 2 overrides, got %+v", overrides)
+	}
+	if o := overrides[0]; o.Type != OverridePause || o.UPS != "rack-a" || o.Until == nil || o.Until.Year() != 2030 || o.Source != OverrideSourceConfigMap {
+		t.Errorf("unexpected pause override: %+v", o)
+	}
+	if o := overrides[1]; o.Type != OverrideIgnoreNode || o.Node != "worker-3" {
+		t.Errorf("unexpected ignore-node override: %+v", o)
+	}
+
+	for _, data := range []string{
+		"- type: pause\n  for: 2h\n",
+		"- type: ignore-node\n",
+		"type: pause\n",
+	} {
+		if _, err := parseOverrides(data); err == nil {
+			t.Errorf("parseOverrides(%q) accepted invalid overrides", data)
+		}
+	}
+}
@@ -0,0 +1,174 @@
+package nodedrainer
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// apcupsdDateLayout is the format of apcupsd's DATE field
+const apcupsdDateLayout = "2006-01-02 15:04:05 -0700"
+
+// payloadFields maps the UPSStatus fields to their keys in the two payload
+// versions: the bridge's own JSON (acpups-mqtt's ups.Data, kept in step with
+// these keys) and the raw apcupsd status fields, such as
+// {"STATUS": "ONBATT", "BCHARGE": "45.0 Percent"}
+var payloadFields = []struct {
+	field   string
+	bridge  string
+	apcupsd string
+}{
+	{"timestamp", "timestamp", "DATE"},
+	{"battery level", "battery_level", "BCHARGE"},
+	{"input voltage", "input_voltage", "LINEV"},
+	{"load", "load", "LOADPCT"},
+	{"status", "status", "STATUS"},
+	{"time left", "time_left", "TIMELEFT"},
+}
+
+// DeadLetter is published to DeadLetterTopic for a UPS status message that
+// could not be decoded
+type DeadLetter struct {
+	Time    time.Time `json:"time"`
+	Topic   string    `json:"topic"`
+	Error   string    `json:"error"`
+	Payload string    `json:"payload"`
+}
+
+// UnmarshalJSON decodes either payload version. Numbers may be integers,
+// floats or strings with a unit such as "99.5 Percent"; fractional battery
+// levels, voltages and loads are rounded down.
+func (s *UPSStatus) UnmarshalJSON(data []byte) error {
+	var raw map[string]json.RawMessage
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return err
+	}
+
+	// Raw apcupsd fields are upper case
+	_, apcupsd := raw["STATUS"]
+	values := make(map[string]json.RawMessage, len(payloadFields))
+	for _, f := range payloadFields {
+		key := f.bridge
+		if apcupsd {
+			key = f.apcupsd
+		}
+		if value, ok := raw[key]; ok && !bytes.Equal(value, []byte("null")) {
+			values[f.field] = value
+		}
+	}
+
+	var status UPSStatus
+	if err := decodeString(values["status"], &status.Status); err != nil {
+		return fmt.Errorf("status: %w", err)
+	}
+	if strings.TrimSpace(status.Status) == "" {
+		return fmt.Errorf("missing status")
+	}
+
+	if err := decodeString(values["timestamp"], &status.Timestamp); err != nil {
+		return fmt.Errorf("timestamp: %w", err)
+	}
+	if apcupsd && status.Timestamp != "" {
+		ts, err := time.Parse(apcupsdDateLayout, status.Timestamp)
+		if err != nil {
+			return fmt.Errorf("timestamp: %w", err)
+		}
+		status.Timestamp = ts.Format(time.RFC3339Nano)
+	}
+
+	for _, f := range []struct {
+		field string
+		value *int
+	}{
+		{"battery level", &status.BatteryLevel},
+		{"input voltage", &status.InputVoltage},
+		{"load", &status.Load},
+	} {
+		number, _, err := decodeNumber(values[f.field])
+		if err != nil {
+			return fmt.Errorf("%s: %w", f.field, err)
+		}
+		*f.value = int(math.Floor(number))
+	}
+
+	timeLeft, unit, err := decodeNumber(values["time left"])
+	if err != nil {
+		return fmt.Errorf("time left: %w", err)
+	}
+	switch {
+	case strings.HasPrefix(unit, "sec"):
+		timeLeft /= 60
+	case strings.HasPrefix(unit, "hour"):
+		timeLeft *= 60
+	}
+	status.TimeLeft = timeLeft
+
+	*s = status
+	return nil
+}
+
+// decodeString decodes a JSON string into value, leaving it unchanged if raw
+// is empty
+func decodeString(raw json.RawMessage, value *string) error {
+	if len(raw) == 0 {
+		return nil
+	}
+	return json.Unmarshal(raw, value)
+}
+
+// decodeNumber decodes a JSON number or a numeric string followed by an
+// optional unit, returned in lower case. An empty raw value is 0.
+func decodeNumber(raw json.RawMessage) (float64, string, error) {
+	if len(raw) == 0 {
+		return 0, "", nil
+	}
+
+	var number float64
+	if err := json.Unmarshal(raw, &number); err == nil {
+		return number, "", nil
+	}
+
+	var str string
+	if err := json.Unmarshal(raw, &str); err != nil {
+		return 0, "", fmt.Errorf("not a number: %s", raw)
+	}
+	fields := strings.Fields(str)
+	if len(fields) == 0 || len(fields) > 2 {
+		return 0, "", fmt.Errorf("not a number: %q", str)
+	}
+	number, err := strconv.ParseFloat(strings.TrimSuffix(fields[0], "%"), 64)
+	if err != nil || math.IsNaN(number) || math.IsInf(number, 0) {
+		return 0, "", fmt.Errorf("not a number: %q", str)
+	}
+	var unit string
+	if len(fields) == 2 {
+		unit = strings.ToLower(fields[1])
+	}
+	return number, unit, nil
+}
+
+// deadLetter reports a UPS status message that could not be decoded and
+// publishes it to DeadLetterTopic
+func (nd *NodeDrainer) deadLetter(msg mqtt.Message, err error) {
+	log.Printf("Failed to parse UPS status on %s: %v", msg.Topic(), err)
+	nd.metrics.rejectedMessages.WithLabelValues("invalid_payload").Inc()
+
+	nd.mutex.RLock()
+	defer nd.mutex.RUnlock()
+	if nd.config.DeadLetterTopic == "" {
+		return
+	}
+	nd.publish(nd.config.DeadLetterTopic, false, &DeadLetter{
+		Time:    time.Now(),
+		Topic:   msg.Topic(),
+		Error:   err.Error(),
+		Payload: string(msg.Payload()),
+	})
+}
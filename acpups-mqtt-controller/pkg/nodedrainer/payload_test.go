@@ -0,0 +1,126 @@
+package nodedrainer
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestDecodeUPSStatus(t *testing.T) {
+	tests := []struct {
+		name    string
+		payload string
+		want    UPSStatus
+		err     string
+	}{
+		{
+			name:    "integers",
+			payload: `{"timestamp":"2025-09-15T12:21:09+02:00","battery_level":99,"input_voltage":230,"load":14,"status":"ONLINE"}`,
+			want:    UPSStatus{Timestamp: "2025-09-15T12:21:09+02:00", BatteryLevel: 99, InputVoltage: 230, Load: 14, Status: "ONLINE"},
+		},
+		{
+			name:    "bridge floats",
+			payload: `{"timestamp":"2025-09-15T12:21:09.845003+02:00","battery_level":99.5,"input_voltage":229.9,"load":14.2,"status":"ONBATT","time_left":42.5}`,
+			want:    UPSStatus{Timestamp: "2025-09-15T12:21:09.845003+02:00", BatteryLevel: 99, InputVoltage: 229, Load: 14, Status: "ONBATT", TimeLeft: 42.5},
+		},
+		{
+			name:    "strings with units",
+			payload: `{"battery_level":"45.0 Percent","input_voltage":"0.0 Volts","load":"14%","status":"ONBATT","time_left":"750 Seconds"}`,
+			want:    UPSStatus{BatteryLevel: 45, Load: 14, Status: "ONBATT", TimeLeft: 12.5},
+		},
+		{
+			name:    "apcupsd fields",
+			payload: `{"DATE":"2025-09-15 12:21:09 +0200","STATUS":"ONBATT LOWBATT","BCHARGE":"9.0 Percent","LINEV":"0.0 Volts","LOADPCT":"14.0 Percent","TIMELEFT":"2.5 Minutes"}`,
+			want:    UPSStatus{Timestamp: "2025-09-15T12:21:09+02:00", BatteryLevel: 9, Load: 14, Status: "ONBATT LOWBATT", TimeLeft: 2.5},
+		},
+		{
+			name:    "null fields",
+			payload: `{"battery_level":null,"status":"ONLINE"}`,
+			want:    UPSStatus{Status: "ONLINE"},
+		},
+		{name: "missing status", payload: `{"battery_level":99}`, err: "missing status"},
+		{name: "not a number", payload: `{"battery_level":"full","status":"ONLINE"}`, err: "battery level: not a number"},
+		{name: "invalid apcupsd date", payload: `{"DATE":"yesterday","STATUS":"ONLINE"}`, err: "timestamp"},
+		{name: "not an object", payload: `"ONLINE"`, err: "cannot unmarshal"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var status UPSStatus
+			err := json.Unmarshal([]byte(tt.payload), &status)
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("expected error containing %q, got %v", tt.err, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if status != tt.want {
+				t.Errorf("decoded %+v, want %+v", status, tt.want)
+			}
+		})
+	}
+}
+
+func TestFloatPayloadDrains(t *testing.T) {
+	env := newTestEnv(t, testConfig(), clusterObjects()...)
+
+	payload := `{"timestamp":"` + time.Now().UTC().Format(time.RFC3339Nano) + `","battery_level":29.5,"input_voltage":0.0,"load":14.2,"status":"ONBATT"}`
+	if token := env.publisher.Publish(env.config.MQTTTopic, 1, false, payload); token.Wait() && token.Error() != nil {
+		t.Fatalf("failed to publish: %v", token.Error())
+	}
+	env.waitForDrained("worker-1", "worker-2")
+}
+
+func TestAvailabilityIsNotHandledAsStatus(t *testing.T) {
+	config := testConfig()
+	config.MQTTTopic = "test/ups/#"
+	env := newTestEnv(t, config, clusterObjects()...)
+
+	// The bridge's default availability topic is matched by the wildcard
+	for _, topic := range []string{"test/ups/rack-a/status/availability", "test/ups/status/availability"} {
+		if token := env.publisher.Publish(topic, 1, false, "online"); token.Wait() && token.Error() != nil {
+			t.Fatalf("failed to publish: %v", token.Error())
+		}
+	}
+	env.publish("test/ups/rack-a/status", UPSStatus{BatteryLevel: 100, Status: "ONLINE"})
+
+	if rejected := testutil.ToFloat64(env.drainer.metrics.rejectedMessages.WithLabelValues("invalid_payload")); rejected != 0 {
+		t.Errorf("%v availability messages rejected as UPS status", rejected)
+	}
+	if states := env.drainer.GetUPSStates(); len(states) != 1 || states[0].Name != "rack-a/status" {
+		t.Errorf("unexpected UPSes %+v", states)
+	}
+}
+
+func TestUndecodableMessagesAreDeadLettered(t *testing.T) {
+	env := newTestEnv(t, testConfig(), clusterObjects()...)
+	letters := env.subscribe(env.config.DeadLetterTopic)
+
+	payload := `{"battery_level":"full","status":"ONBATT"}`
+	if token := env.publisher.Publish(env.config.MQTTTopic, 1, false, payload); token.Wait() && token.Error() != nil {
+		t.Fatalf("failed to publish: %v", token.Error())
+	}
+
+	select {
+	case message := <-letters:
+		var letter DeadLetter
+		if err := json.Unmarshal(message, &letter); err != nil {
+			t.Fatalf("failed to decode dead letter: %v", err)
+		}
+		if letter.Topic != env.config.MQTTTopic || letter.Payload != payload || !strings.Contains(letter.Error, "battery level") {
+			t.Errorf("unexpected dead letter: %+v", letter)
+		}
+	case <-time.After(testTimeout):
+		t.Fatalf("timed out waiting for dead letter")
+	}
+
+	if status := env.drainer.GetLastStatus(); status != nil {
+		t.Errorf("undecodable message was handled: %+v", status)
+	}
+}
@@ -0,0 +1,244 @@
+package nodedrainer
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	policyv1 "k8s.io/api/policy/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+)
+
+// Plan describes the actions a UPS reading would trigger against the current
+// cluster state
+type Plan struct {
+	Generated time.Time  `json:"generated"`
+	UPS       string     `json:"ups,omitempty"`
+	Reading   *UPSStatus `json:"reading,omitempty"`
+	Stage     Stage      `json:"stage,omitempty"`
+	Drain     []NodePlan `json:"drain,omitempty"`
+	PowerOff  []string   `json:"powerOff,omitempty"`
+	ScaleDown []string   `json:"scaleDown,omitempty"`
+	Restore   []string   `json:"restore,omitempty"`
+	Uncordon  []string   `json:"uncordon,omitempty"`
+	// Capacity is the outcome of the capacity safeguards for a drain
+	Capacity *CapacityReport `json:"capacity,omitempty"`
+}
+
+// NodePlan lists what draining a single node would do
+type NodePlan struct {
+	Node    string       `json:"node"`
+	Evict   []string     `json:"evict,omitempty"`
+	Blocked []PodBlocker `json:"blocked,omitempty"`
+	Skipped []SkippedPod `json:"skipped,omitempty"`
+}
+
+// PodBlocker explains why a pod's eviction would not succeed immediately
+type PodBlocker struct {
+	Pod    string `json:"pod"`
+	Reason string `json:"reason"`
+}
+
+// Plan computes the actions a reading of the named UPS would trigger without
+// modifying the cluster. Hysteresis is not taken into account.
+func (nd *NodeDrainer) Plan(ctx context.Context, source string, status *UPSStatus) (*Plan, error) {
+	nd.mutex.RLock()
+	defer nd.mutex.RUnlock()
+	return nd.plan(ctx, source, status)
+}
+
+// plan is Plan for callers already holding nd.mutex
+func (nd *NodeDrainer) plan(ctx context.Context, source string, status *UPSStatus) (*Plan, error) {
+	plan := &Plan{
+		Generated: time.Now(),
+		UPS:       source,
+		Reading:   status,
+	}
+
+	var onBattery time.Duration
+	if src, ok := nd.sources[source]; ok {
+		onBattery = src.onBatteryFor(time.Now())
+	}
+	target, ok := nd.targetStage(status, onBattery)
+	if !ok {
+		return plan, nil
+	}
+	plan.Stage = target
+
+	switch {
+	case target == StageDrain && nd.config.DrainMode == DrainModeScaleDown:
+		workloads, err := nd.scaleDownCandidates(ctx, source)
+		if err != nil {
+			return nil, err
+		}
+		for _, w := range workloads {
+			plan.ScaleDown = append(plan.ScaleDown, fmt.Sprintf("%s (%d replicas)", w.String(), w.replicas))
+		}
+	case target == StageDrain:
+		nodes, err := nd.drainCandidates(source)
+		if err != nil {
+			return nil, err
+		}
+		nodes, plan.Capacity, err = nd.applySafeguards(nodes)
+		if err != nil {
+			return nil, err
+		}
+		plan.Drain, err = nd.planNodeDrains(ctx, nodes)
+		if err != nil {
+			return nil, err
+		}
+
+		// Nodes drained now or earlier are powered off below the shutdown threshold
+		if status.BatteryLevel < nd.config.ShutdownThreshold {
+			drained, err := nd.drainedNodes(source)
+			if err != nil {
+				return nil, err
+			}
+			for _, node := range plan.Drain {
+				plan.PowerOff = append(plan.PowerOff, node.Node)
+			}
+			plan.PowerOff = append(plan.PowerOff, drained...)
+		}
+	case target == StageNormal:
+		workloads, err := nd.scaledWorkloads(ctx, source)
+		if err != nil {
+			return nil, err
+		}
+		for _, w := range workloads {
+			plan.Restore = append(plan.Restore, fmt.Sprintf("%s (%s replicas)", w.String(), w.annotations[OriginalReplicasAnnotation]))
+		}
+
+		drained, err := nd.drainedNodes(source)
+		if err != nil {
+			return nil, err
+		}
+		plan.Uncordon = drained
+	}
+
+	return plan, nil
+}
+
+// planNodeDrains lists what draining each of nodes would do
+func (nd *NodeDrainer) planNodeDrains(ctx context.Context, nodes []corev1.Node) ([]NodePlan, error) {
+	// Disruption budgets are shared across nodes, so track them for the whole plan
+	budgets := newBudgetTracker(nd)
+	var plans []NodePlan
+	for i := range nodes {
+		pods, skipped, err := nd.evictablePods(&nodes[i])
+		if err != nil {
+			return nil, err
+		}
+
+		nodePlan := NodePlan{Node: nodes[i].Name, Skipped: skipped}
+		for j := range pods {
+			pod := &pods[j]
+			reason, err := budgets.admit(ctx, pod)
+			if err != nil {
+				return nil, err
+			}
+			if reason != "" {
+				nodePlan.Blocked = append(nodePlan.Blocked, PodBlocker{Pod: podKey(pod), Reason: reason})
+			} else {
+				nodePlan.Evict = append(nodePlan.Evict, podKey(pod))
+			}
+		}
+		plans = append(plans, nodePlan)
+	}
+	return plans, nil
+}
+
+// reportPlan logs the plan and publishes it to the plan topic
+func (nd *NodeDrainer) reportPlan(plan *Plan) {
+	switch plan.Stage {
+	case StageDrain:
+		if plan.Capacity != nil {
+			log.Printf("[dry-run] Capacity safeguards: %s", plan.Capacity)
+		}
+		for _, node := range plan.Drain {
+			log.Printf("[dry-run] Would cordon node %s and evict %d pods", node.Node, len(node.Evict)+len(node.Blocked))
+			for _, pod := range node.Evict {
+				log.Printf("[dry-run]   evict %s", pod)
+			}
+			for _, blocked := range node.Blocked {
+				log.Printf("[dry-run]   evict %s (blocked: %s)", blocked.Pod, blocked.Reason)
+			}
+			for _, skipped := range node.Skipped {
+				log.Printf("[dry-run]   skip %s (%s)", skipped.Pod, skipped.Reason)
+			}
+		}
+		if len(plan.Drain) == 0 && len(plan.ScaleDown) == 0 {
+			log.Println("[dry-run] No worker nodes left to drain")
+		}
+		for _, node := range plan.PowerOff {
+			log.Printf("[dry-run] Would power off node %s once drained via %s", node, nd.config.ShutdownMethod)
+		}
+		for _, w := range plan.ScaleDown {
+			log.Printf("[dry-run] Would scale down %s to zero", w)
+		}
+	case StageNormal:
+		for _, w := range plan.Restore {
+			log.Printf("[dry-run] Would restore %s", w)
+		}
+		for _, node := range plan.Uncordon {
+			log.Printf("[dry-run] Would uncordon node %s", node)
+		}
+		if len(plan.Uncordon) == 0 {
+			log.Println("[dry-run] No nodes to uncordon")
+		}
+	}
+
+	if nd.config.PlanTopic != "" {
+		nd.publish(nd.config.PlanTopic, false, plan)
+	}
+}
+
+// budgetTracker simulates PodDisruptionBudget consumption across a plan
+type budgetTracker struct {
+	nd       *NodeDrainer
+	budgets  map[string][]policyv1.PodDisruptionBudget
+	consumed map[string]int32
+}
+
+func newBudgetTracker(nd *NodeDrainer) *budgetTracker {
+	return &budgetTracker{
+		nd:       nd,
+		budgets:  make(map[string][]policyv1.PodDisruptionBudget),
+		consumed: make(map[string]int32),
+	}
+}
+
+// admit consumes one disruption from every budget covering pod, returning a
+// reason if any of them has none left
+func (b *budgetTracker) admit(ctx context.Context, pod *corev1.Pod) (string, error) {
+	budgets, ok := b.budgets[pod.Namespace]
+	if !ok {
+		list, err := b.nd.clientset.PolicyV1().PodDisruptionBudgets(pod.Namespace).List(ctx, metav1.ListOptions{})
+		if err != nil {
+			return "", fmt.Errorf("failed to list disruption budgets in %s: %w", pod.Namespace, err)
+		}
+		budgets = list.Items
+		b.budgets[pod.Namespace] = budgets
+	}
+
+	var matching []string
+	for _, pdb := range budgets {
+		selector, err := metav1.LabelSelectorAsSelector(pdb.Spec.Selector)
+		if err != nil || selector.Empty() || !selector.Matches(labels.Set(pod.Labels)) {
+			continue
+		}
+
+		key := pdb.Namespace + "/" + pdb.Name
+		if b.consumed[key] >= pdb.Status.DisruptionsAllowed {
+			return fmt.Sprintf("PodDisruptionBudget %s allows no further disruptions", key), nil
+		}
+		matching = append(matching, key)
+	}
+
+	for _, key := range matching {
+		b.consumed[key]++
+	}
+	return "", nil
+}
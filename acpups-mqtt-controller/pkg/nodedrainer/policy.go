@@ -0,0 +1,600 @@
+package nodedrainer
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"reflect"
+	"strings"
+	"time"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/dynamic/dynamicinformer"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/util/retry"
+)
+
+// policySyncTimeout bounds how long WatchPolicy waits for the UPSPolicy to be
+// listed, e.g. when its CRD is not installed
+const policySyncTimeout = 30 * time.Second
+
+// UPSPolicyResource identifies the cluster-scoped UPSPolicy custom resource
+var UPSPolicyResource = schema.GroupVersionResource{
+	Group:    "ups-drainer.k8s.io",
+	Version:  "v1alpha1",
+	Resource: "upspolicies",
+}
+
+// UPSPolicy is the declarative form of Config, managed with kubectl or GitOps
+type UPSPolicy struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   UPSPolicySpec   `json:"spec"`
+	Status UPSPolicyStatus `json:"status,omitempty"`
+}
+
+// UPSPolicySpec holds the desired drain policy. Unset fields, also within a
+// block such as drain or shutdown, fall back to the controller's environment
+// configuration.
+type UPSPolicySpec struct {
+	Topic                 string                `json:"topic,omitempty"`
+	QoS                   *int                  `json:"qos,omitempty"`
+	BatteryDrainThreshold int                   `json:"batteryDrainThreshold,omitempty"`
+	StatusFlags           map[string]string     `json:"statusFlags,omitempty"`
+	NodeSelector          *metav1.LabelSelector `json:"nodeSelector,omitempty"`
+	SourceLabel           string                `json:"sourceLabel,omitempty"`
+	DefaultSource         string                `json:"defaultSource,omitempty"`
+	Hysteresis            *HysteresisSpec       `json:"hysteresis,omitempty"`
+	Runtime               *RuntimeSpec          `json:"runtime,omitempty"`
+	Capacity              *CapacitySpec         `json:"capacity,omitempty"`
+	Drain                 *DrainSpec            `json:"drain,omitempty"`
+	Staleness             *StalenessSpec        `json:"staleness,omitempty"`
+	Shutdown              *ShutdownSpec         `json:"shutdown,omitempty"`
+	DryRun                bool                  `json:"dryRun,omitempty"`
+}
+
+// HysteresisSpec controls how long a UPS state must hold before it is acted on
+type HysteresisSpec struct {
+	StableSeconds     *int `json:"stableSeconds,omitempty"`
+	StableMessages    *int `json:"stableMessages,omitempty"`
+	UncordonThreshold *int `json:"uncordonThreshold,omitempty"`
+	MinDrainSeconds   *int `json:"minDrainSeconds,omitempty"`
+}
+
+// RuntimeSpec drains on the duration of an outage in addition to the battery level
+type RuntimeSpec struct {
+	MaxOnBatterySeconds *int `json:"maxOnBatterySeconds,omitempty"`
+	MinRuntimeSeconds   *int `json:"minRuntimeSeconds,omitempty"`
+}
+
+// CapacitySpec keeps drains from leaving evicted pods nowhere to go. Check is
+// "off", "warn" or "enforce".
+type CapacitySpec struct {
+	MaxDrainPercent    int                   `json:"maxDrainPercent,omitempty"`
+	LastResortSelector *metav1.LabelSelector `json:"lastResortSelector,omitempty"`
+	Check              string                `json:"check,omitempty"`
+}
+
+// DrainSpec controls how long a node drain may take
+type DrainSpec struct {
+	TimeoutSeconds     *int  `json:"timeoutSeconds,omitempty"`
+	DeleteAfterTimeout *bool `json:"deleteAfterTimeout,omitempty"`
+	PriorityLimit      *int  `json:"priorityLimit,omitempty"`
+
+	// Mode is "evict" or "scale-down"
+	Mode              string                `json:"mode,omitempty"`
+	ScaleDownSelector *metav1.LabelSelector `json:"scaleDownSelector,omitempty"`
+
+	// Pod filters; unset fields keep the environment configuration
+	IncludeNamespaces  []string              `json:"includeNamespaces,omitempty"`
+	ExcludeNamespaces  []string              `json:"excludeNamespaces,omitempty"`
+	PodSelector        *metav1.LabelSelector `json:"podSelector,omitempty"`
+	DeleteEmptyDirData *bool                 `json:"deleteEmptyDirData,omitempty"`
+	EvictHostPath      *bool                 `json:"evictHostPath,omitempty"`
+	EvictUnmanaged     *bool                 `json:"evictUnmanaged,omitempty"`
+}
+
+// StalenessSpec controls what happens when UPS data stops arriving
+type StalenessSpec struct {
+	AfterSeconds      *int   `json:"afterSeconds,omitempty"`
+	Action            string `json:"action,omitempty"`
+	AvailabilityTopic string `json:"availabilityTopic,omitempty"`
+}
+
+// ShutdownSpec controls powering off fully drained nodes
+type ShutdownSpec struct {
+	Threshold  *int   `json:"threshold,omitempty"`
+	Method     string `json:"method,omitempty"`
+	Namespace  string `json:"namespace,omitempty"`
+	Image      string `json:"image,omitempty"`
+	WebhookURL string `json:"webhookURL,omitempty"`
+}
+
+// UPSPolicyStatus is reported by the controller through the status subresource
+type UPSPolicyStatus struct {
+	ObservedGeneration int64             `json:"observedGeneration,omitempty"`
+	LastReading        *UPSReading       `json:"lastReading,omitempty"`
+	LastReadingTime    *metav1.Time      `json:"lastReadingTime,omitempty"`
+	ActiveStage        Stage             `json:"activeStage,omitempty"`
+	Stale              bool              `json:"stale,omitempty"`
+	PendingStage       Stage             `json:"pendingStage,omitempty"`
+	PendingSince       *metav1.Time      `json:"pendingSince,omitempty"`
+	OnBatterySince     *metav1.Time      `json:"onBatterySince,omitempty"`
+	DrainedNodes       []string          `json:"drainedNodes,omitempty"`
+	PoweredOffNodes    []string          `json:"poweredOffNodes,omitempty"`
+	Leader             string            `json:"leader,omitempty"`
+	UPS                []UPSSourceStatus `json:"ups,omitempty"`
+	Overrides          []Override        `json:"overrides,omitempty"`
+}
+
+// UPSSourceStatus is the state of one UPS when following a topic pattern
+type UPSSourceStatus struct {
+	Name            string       `json:"name"`
+	LastReading     *UPSReading  `json:"lastReading,omitempty"`
+	LastReadingTime *metav1.Time `json:"lastReadingTime,omitempty"`
+	Stage           Stage        `json:"stage,omitempty"`
+	Stale           bool         `json:"stale,omitempty"`
+	PendingStage    Stage        `json:"pendingStage,omitempty"`
+	OnBatterySince  *metav1.Time `json:"onBatterySince,omitempty"`
+}
+
+// UPSReading is the last UPS status as shown in the policy status
+type UPSReading struct {
+	Status       string  `json:"status"`
+	BatteryLevel int     `json:"batteryLevel"`
+	InputVoltage int     `json:"inputVoltage"`
+	Load         int     `json:"load"`
+	TimeLeft     float64 `json:"timeLeft,omitempty"`
+	Timestamp    string  `json:"timestamp,omitempty"`
+}
+
+// applyPodFilters layers the spec's pod filters on top of config
+func (d *DrainSpec) applyPodFilters(config *Config) error {
+	if d.IncludeNamespaces != nil {
+		config.IncludeNamespaces = d.IncludeNamespaces
+	}
+	if d.ExcludeNamespaces != nil {
+		config.ExcludeNamespaces = d.ExcludeNamespaces
+	}
+	if d.PodSelector != nil {
+		selector, err := metav1.LabelSelectorAsSelector(d.PodSelector)
+		if err != nil {
+			return fmt.Errorf("invalid podSelector: %w", err)
+		}
+		config.PodSelector = selector
+	}
+	if d.DeleteEmptyDirData != nil {
+		config.DeleteEmptyDirData = *d.DeleteEmptyDirData
+	}
+	if d.EvictHostPath != nil {
+		config.EvictHostPathPods = *d.EvictHostPath
+	}
+	if d.EvictUnmanaged != nil {
+		config.EvictUnmanagedPods = *d.EvictUnmanaged
+	}
+	return nil
+}
+
+func newUPSReading(status *UPSStatus) *UPSReading {
+	return &UPSReading{
+		Status:       status.Status,
+		BatteryLevel: status.BatteryLevel,
+		InputVoltage: status.InputVoltage,
+		Load:         status.Load,
+		TimeLeft:     status.TimeLeft,
+		Timestamp:    status.Timestamp,
+	}
+}
+
+// newUPSSourceStatus reports the state of one UPS
+func newUPSSourceStatus(state UPSState) UPSSourceStatus {
+	source := UPSSourceStatus{
+		Name:  state.Name,
+		Stage: state.Stage,
+		Stale: state.Stale,
+	}
+	if state.LastStatus != nil {
+		received := metav1.NewTime(state.Received)
+		source.LastReading = newUPSReading(state.LastStatus)
+		source.LastReadingTime = &received
+	}
+	if state.Pending != nil {
+		source.PendingStage = state.Pending.Stage
+	}
+	if !state.OnBatterySince.IsZero() {
+		since := metav1.NewTime(state.OnBatterySince)
+		source.OnBatterySince = &since
+	}
+	return source
+}
+
+type policyBinding struct {
+	client     dynamic.ResourceInterface
+	name       string
+	generation int64
+
+	// reported is the status last handed to writeStatus; statuses passes the
+	// latest status to it, so that the API server is not called with
+	// nd.mutex held
+	reported map[string]interface{}
+	statuses chan map[string]interface{}
+}
+
+// Config builds a Config from the spec, layered on top of base, and checks
+// the result
+func (s *UPSPolicySpec) Config(base *Config) (*Config, error) {
+	config := *base
+
+	if s.Topic != "" {
+		config.MQTTTopic = s.Topic
+	}
+	if s.QoS != nil {
+		if *s.QoS < 0 || *s.QoS > 2 {
+			return nil, fmt.Errorf("invalid qos %d: must be 0, 1 or 2", *s.QoS)
+		}
+		config.QoS = byte(*s.QoS)
+	}
+	if s.BatteryDrainThreshold != 0 {
+		config.BatteryDrainThreshold = s.BatteryDrainThreshold
+	}
+	if s.StatusFlags != nil {
+		if err := validateFlagActions(s.StatusFlags); err != nil {
+			return nil, fmt.Errorf("invalid statusFlags: %w", err)
+		}
+		config.FlagActions = MergeFlagActions(base.FlagActions, s.StatusFlags)
+	}
+	if s.NodeSelector != nil {
+		selector, err := metav1.LabelSelectorAsSelector(s.NodeSelector)
+		if err != nil {
+			return nil, fmt.Errorf("invalid nodeSelector: %w", err)
+		}
+		config.NodeSelector = selector
+	}
+	if s.SourceLabel != "" {
+		config.SourceLabel = s.SourceLabel
+	}
+	if s.DefaultSource != "" {
+		config.DefaultSource = s.DefaultSource
+	}
+	if h := s.Hysteresis; h != nil {
+		setSeconds(&config.StableFor, h.StableSeconds)
+		setInt(&config.StableMessages, h.StableMessages)
+		setInt(&config.BatteryUncordonThreshold, h.UncordonThreshold)
+		setSeconds(&config.MinDrainDuration, h.MinDrainSeconds)
+	}
+	if r := s.Runtime; r != nil {
+		setSeconds(&config.MaxOnBattery, r.MaxOnBatterySeconds)
+		setSeconds(&config.MinRuntime, r.MinRuntimeSeconds)
+	}
+	if c := s.Capacity; c != nil {
+		if c.MaxDrainPercent != 0 {
+			config.MaxDrainPercent = c.MaxDrainPercent
+		}
+		if c.LastResortSelector != nil {
+			selector, err := metav1.LabelSelectorAsSelector(c.LastResortSelector)
+			if err != nil {
+				return nil, fmt.Errorf("invalid lastResortSelector: %w", err)
+			}
+			config.LastResortSelector = selector
+		}
+		if c.Check != "" {
+			config.CapacityCheck = c.Check
+		}
+	}
+	if d := s.Drain; d != nil {
+		setSeconds(&config.DrainTimeout, d.TimeoutSeconds)
+		if d.DeleteAfterTimeout != nil {
+			config.DeleteAfterTimeout = *d.DeleteAfterTimeout
+		}
+		setInt(&config.EvictionPriorityLimit, d.PriorityLimit)
+		if err := d.applyPodFilters(&config); err != nil {
+			return nil, err
+		}
+		if d.Mode != "" {
+			config.DrainMode = d.Mode
+		}
+		if d.ScaleDownSelector != nil {
+			selector, err := metav1.LabelSelectorAsSelector(d.ScaleDownSelector)
+			if err != nil {
+				return nil, fmt.Errorf("invalid scaleDownSelector: %w", err)
+			}
+			config.ScaleDownSelector = selector
+		}
+	}
+	if st := s.Staleness; st != nil {
+		setSeconds(&config.StaleAfter, st.AfterSeconds)
+		if st.Action != "" {
+			config.StaleAction = st.Action
+		}
+		if st.AvailabilityTopic != "" {
+			config.AvailabilityTopic = st.AvailabilityTopic
+		}
+	}
+	if sd := s.Shutdown; sd != nil {
+		setInt(&config.ShutdownThreshold, sd.Threshold)
+		if sd.Method != "" {
+			config.ShutdownMethod = sd.Method
+		}
+		if sd.Namespace != "" {
+			config.ShutdownNamespace = sd.Namespace
+		}
+		if sd.Image != "" {
+			config.ShutdownImage = sd.Image
+		}
+		if sd.WebhookURL != "" {
+			config.ShutdownWebhookURL = sd.WebhookURL
+		}
+	}
+	config.DryRun = config.DryRun || s.DryRun
+
+	if err := config.Validate(); err != nil {
+		return nil, err
+	}
+	return &config, nil
+}
+
+// setInt overrides value with the spec field, if set
+func setInt(value *int, field *int) {
+	if field != nil {
+		*value = *field
+	}
+}
+
+// setSeconds overrides value with the spec field in seconds, if set
+func setSeconds(value *time.Duration, field *int) {
+	if field != nil {
+		*value = time.Duration(*field) * time.Second
+	}
+}
+
+// ApplyConfig replaces the active configuration, moving the MQTT subscription
+// when the topic or QoS changed
+func (nd *NodeDrainer) ApplyConfig(config *Config) error {
+	nd.subscribeMutex.Lock()
+	defer nd.subscribeMutex.Unlock()
+
+	nd.mutex.Lock()
+	previous := nd.config
+	nd.storeConfig(config)
+	nd.mutex.Unlock()
+
+	if previous != nil && previous.MQTTTopic == config.MQTTTopic && previous.QoS == config.QoS &&
+		previous.AvailabilityTopic == config.AvailabilityTopic && previous.CommandTopic == config.CommandTopic {
+		return nil
+	}
+
+	if len(nd.subscribed) > 0 {
+		if token := nd.mqttClient.Unsubscribe(nd.subscribed...); token.Wait() && token.Error() != nil {
+			log.Printf("Failed to unsubscribe from %s: %v", strings.Join(nd.subscribed, ", "), token.Error())
+		}
+		nd.subscribed = nil
+	}
+
+	return nd.subscribe(config)
+}
+
+// LoadPolicy reads the named UPSPolicy and returns its spec applied on top of
+// base, as WatchPolicy would
+func LoadPolicy(ctx context.Context, client dynamic.Interface, name string, base *Config) (*Config, error) {
+	u, err := client.Resource(UPSPolicyResource).Get(ctx, name, metav1.GetOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("failed to get UPSPolicy %s: %w", name, err)
+	}
+	var policy UPSPolicy
+	if err := runtime.DefaultUnstructuredConverter.FromUnstructured(u.Object, &policy); err != nil {
+		return nil, fmt.Errorf("failed to decode UPSPolicy %s: %w", name, err)
+	}
+	config, err := policy.Spec.Config(base)
+	if err != nil {
+		return nil, fmt.Errorf("invalid UPSPolicy %s: %w", name, err)
+	}
+	return config, nil
+}
+
+// WatchPolicy binds the drainer to the named UPSPolicy. The policy's spec is
+// applied on top of the configuration passed to Subscribe whenever it changes,
+// and the drainer's state is written back to its status subresource. If the
+// policy cannot be listed within policySyncTimeout, the drainer carries on
+// with the environment configuration.
+func (nd *NodeDrainer) WatchPolicy(ctx context.Context, client dynamic.Interface, name string) error {
+	nd.mutex.Lock()
+	base := DefaultConfig()
+	if nd.config != nil {
+		base = nd.config
+	}
+	binding := &policyBinding{
+		client:   client.Resource(UPSPolicyResource),
+		name:     name,
+		statuses: make(chan map[string]interface{}, 1),
+	}
+	nd.policy = binding
+	nd.mutex.Unlock()
+	go binding.writeStatus(ctx)
+
+	factory := dynamicinformer.NewFilteredDynamicSharedInformerFactory(client, 10*time.Minute, metav1.NamespaceAll, func(options *metav1.ListOptions) {
+		options.FieldSelector = fields.OneTermEqualSelector("metadata.name", name).String()
+	})
+	informer := factory.ForResource(UPSPolicyResource).Informer()
+
+	_, err := informer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc: func(obj interface{}) {
+			nd.onPolicy(obj, base)
+		},
+		UpdateFunc: func(_, obj interface{}) {
+			nd.onPolicy(obj, base)
+		},
+		DeleteFunc: func(interface{}) {
+			log.Printf("UPSPolicy %s deleted - reverting to environment configuration", name)
+			nd.mutex.Lock()
+			nd.policy.generation = 0
+			nd.policy.reported = nil
+			nd.mutex.Unlock()
+			if err := nd.ApplyConfig(base); err != nil {
+				log.Printf("Failed to apply configuration: %v", err)
+			}
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to watch UPSPolicy %s: %w", name, err)
+	}
+
+	factory.Start(ctx.Done())
+	syncCtx, cancel := context.WithTimeout(ctx, policySyncTimeout)
+	defer cancel()
+	if !cache.WaitForCacheSync(syncCtx.Done(), informer.HasSynced) {
+		if ctx.Err() != nil {
+			return fmt.Errorf("timed out waiting for UPSPolicy %s to sync", name)
+		}
+		// The informer keeps retrying and applies the policy once it can be listed
+		log.Printf("UPSPolicy %s not synced after %s, is the CRD installed? Using the environment configuration meanwhile", name, policySyncTimeout)
+		return nil
+	}
+
+	log.Printf("Watching UPSPolicy: %s", name)
+	return nil
+}
+
+func (nd *NodeDrainer) onPolicy(obj interface{}, base *Config) {
+	u, ok := obj.(*unstructured.Unstructured)
+	if !ok {
+		return
+	}
+
+	// Status updates do not bump the generation; only react to spec changes
+	nd.mutex.RLock()
+	applied := nd.policy.generation
+	nd.mutex.RUnlock()
+	if u.GetGeneration() == applied {
+		return
+	}
+
+	var policy UPSPolicy
+	if err := runtime.DefaultUnstructuredConverter.FromUnstructured(u.Object, &policy); err != nil {
+		log.Printf("Failed to decode UPSPolicy %s: %v", u.GetName(), err)
+		return
+	}
+
+	config, err := policy.Spec.Config(base)
+	if err != nil {
+		log.Printf("Ignoring invalid UPSPolicy %s: %v", policy.Name, err)
+		return
+	}
+
+	if err := nd.ApplyConfig(config); err != nil {
+		log.Printf("Failed to apply UPSPolicy %s: %v", policy.Name, err)
+		return
+	}
+	log.Printf("Applied UPSPolicy %s (generation %d): topic=%s threshold=%d%% dryRun=%t",
+		policy.Name, policy.Generation, config.MQTTTopic, config.BatteryDrainThreshold, config.DryRun)
+
+	nd.mutex.Lock()
+	defer nd.mutex.Unlock()
+	nd.policy.generation = policy.Generation
+	nd.reportPolicyStatus()
+}
+
+// reportPolicyStatus writes the drainer's current state to the bound
+// UPSPolicy status in the background, unless it is unchanged. Callers must
+// hold nd.mutex.
+func (nd *NodeDrainer) reportPolicyStatus() {
+	if nd.policy == nil {
+		return
+	}
+	status := UPSPolicyStatus{
+		ObservedGeneration: nd.policy.generation,
+		ActiveStage:        StageNormal,
+	}
+	status.Leader, _ = nd.GetLeader()
+
+	// The top-level fields summarize all UPSes: the most recent reading and
+	// the most severe stage
+	var lastReceived time.Time
+	for _, state := range nd.upsStates() {
+		source := newUPSSourceStatus(state)
+		if state.LastStatus != nil && state.Received.After(lastReceived) {
+			lastReceived = state.Received
+			status.LastReading = source.LastReading
+			status.LastReadingTime = source.LastReadingTime
+		}
+		if state.Pending != nil && status.PendingStage == "" {
+			since := metav1.NewTime(state.Pending.Since)
+			status.PendingStage = state.Pending.Stage
+			status.PendingSince = &since
+		}
+		if state.Stage == StageDrain {
+			status.ActiveStage = StageDrain
+		}
+		if since := source.OnBatterySince; since != nil && (status.OnBatterySince == nil || since.Before(status.OnBatterySince)) {
+			status.OnBatterySince = since
+		}
+		status.Stale = status.Stale || state.Stale
+		if state.Name != "" {
+			status.UPS = append(status.UPS, source)
+		}
+	}
+
+	drained, err := nd.GetDrainedNodes()
+	if err != nil {
+		log.Printf("Failed to collect drained nodes for UPSPolicy status: %v", err)
+	}
+	status.DrainedNodes = drained
+
+	poweredOff, err := nd.GetPoweredOffNodes()
+	if err != nil {
+		log.Printf("Failed to collect powered-off nodes for UPSPolicy status: %v", err)
+	}
+	status.PoweredOffNodes = poweredOff
+	status.Overrides = nd.activeOverrides()
+
+	content, err := runtime.DefaultUnstructuredConverter.ToUnstructured(&status)
+	if err != nil {
+		log.Printf("Failed to encode UPSPolicy status: %v", err)
+		return
+	}
+	if reflect.DeepEqual(content, nd.policy.reported) {
+		return
+	}
+	nd.policy.reported = content
+
+	// Replace a status not written yet; only the latest one matters
+	select {
+	case <-nd.policy.statuses:
+	default:
+	}
+	nd.policy.statuses <- content
+}
+
+// writeStatus writes the statuses passed by reportPolicyStatus to the
+// UPSPolicy until ctx is cancelled
+func (b *policyBinding) writeStatus(ctx context.Context) {
+	for {
+		var content map[string]interface{}
+		select {
+		case <-ctx.Done():
+			return
+		case content = <-b.statuses:
+		}
+
+		err := retry.RetryOnConflict(retry.DefaultRetry, func() error {
+			obj, err := b.client.Get(ctx, b.name, metav1.GetOptions{})
+			if err != nil {
+				return err
+			}
+			if err := unstructured.SetNestedMap(obj.Object, content, "status"); err != nil {
+				return err
+			}
+			_, err = b.client.UpdateStatus(ctx, obj, metav1.UpdateOptions{})
+			return err
+		})
+		if err != nil && !apierrors.IsNotFound(err) {
+			log.Printf("Failed to update UPSPolicy %s status: %v", b.name, err)
+		}
+	}
+}
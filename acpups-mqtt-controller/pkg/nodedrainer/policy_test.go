@@ -0,0 +1,173 @@
+package nodedrainer
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+)
+
+func intPtr(v int) *int    { return &v }
+func boolPtr(v bool) *bool { return &v }
+
+func TestPolicySpecOverridesOnlySetFields(t *testing.T) {
+	base := DefaultConfig()
+	base.BatteryUncordonThreshold = 80
+	base.MinDrainDuration = 10 * time.Minute
+	base.DrainTimeout = 7 * time.Minute
+	base.DeleteAfterTimeout = true
+	base.EvictionPriorityLimit = 1000
+	base.ShutdownThreshold = 20
+	base.MaxOnBattery = 15 * time.Minute
+
+	spec := UPSPolicySpec{
+		Hysteresis: &HysteresisSpec{StableMessages: intPtr(3)},
+		Runtime:    &RuntimeSpec{MinRuntimeSeconds: intPtr(300)},
+		Drain:      &DrainSpec{Mode: DrainModeEvict, DeleteAfterTimeout: boolPtr(false)},
+		Shutdown:   &ShutdownSpec{Image: "busybox"},
+	}
+	config, err := spec.Config(base)
+	if err != nil {
+		t.Fatalf("Config: %v", err)
+	}
+
+	// Fields set in the blocks are applied, explicit zero values included
+	if config.StableMessages != 3 || config.MinRuntime != 5*time.Minute || config.DeleteAfterTimeout || config.ShutdownImage != "busybox" {
+		t.Errorf("set fields not applied: %+v", config)
+	}
+	// The rest of each block keeps the environment configuration
+	if config.BatteryUncordonThreshold != 80 || config.MinDrainDuration != 10*time.Minute {
+		t.Errorf("hysteresis block reset unset fields: uncordon threshold %d, min drain duration %s", config.BatteryUncordonThreshold, config.MinDrainDuration)
+	}
+	if config.MaxOnBattery != 15*time.Minute {
+		t.Errorf("runtime block reset max time on battery to %s", config.MaxOnBattery)
+	}
+	if config.DrainTimeout != 7*time.Minute || config.EvictionPriorityLimit != 1000 {
+		t.Errorf("drain block reset unset fields: timeout %s, priority limit %d", config.DrainTimeout, config.EvictionPriorityLimit)
+	}
+	if config.ShutdownThreshold != 20 {
+		t.Errorf("shutdown block reset threshold to %d", config.ShutdownThreshold)
+	}
+}
+
+func TestPolicySpecValidatesResult(t *testing.T) {
+	tests := []struct {
+		name string
+		spec UPSPolicySpec
+		err  string
+	}{
+		{"threshold", UPSPolicySpec{BatteryDrainThreshold: 120}, "battery drain threshold"},
+		{"uncordon threshold", UPSPolicySpec{Hysteresis: &HysteresisSpec{UncordonThreshold: intPtr(-1)}}, "battery uncordon threshold"},
+		{"negative runtime", UPSPolicySpec{Runtime: &RuntimeSpec{MaxOnBatterySeconds: intPtr(-60)}}, "max time on battery"},
+		{"drain timeout", UPSPolicySpec{Drain: &DrainSpec{TimeoutSeconds: intPtr(0)}}, "drain timeout"},
+		{"drain mode", UPSPolicySpec{Drain: &DrainSpec{Mode: "drop"}}, "drain mode"},
+		{"capacity check", UPSPolicySpec{Capacity: &CapacitySpec{Check: "strict"}}, "capacity check"},
+		{"stale action", UPSPolicySpec{Staleness: &StalenessSpec{Action: "panic"}}, "stale action"},
+		{"shutdown webhook", UPSPolicySpec{Shutdown: &ShutdownSpec{Threshold: intPtr(20), Method: ShutdownMethodWebhook}}, "webhook URL"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := tt.spec.Config(DefaultConfig()); err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("expected error containing %q, got %v", tt.err, err)
+			}
+		})
+	}
+}
+
+// watchPolicy binds the drainer to a UPSPolicy named default with spec, and
+// returns the fake client holding it
+func (e *testEnv) watchPolicy(spec map[string]interface{}) *dynamicfake.FakeDynamicClient {
+	e.t.Helper()
+
+	policy := &unstructured.Unstructured{Object: map[string]interface{}{
+		"apiVersion": "ups-drainer.k8s.io/v1alpha1",
+		"kind":       "UPSPolicy",
+		"metadata":   map[string]interface{}{"name": "default", "generation": int64(1)},
+		"spec":       spec,
+	}}
+	client := dynamicfake.NewSimpleDynamicClientWithCustomListKinds(runtime.NewScheme(),
+		map[schema.GroupVersionResource]string{UPSPolicyResource: "UPSPolicyList"}, policy)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	e.t.Cleanup(cancel)
+	if err := e.drainer.WatchPolicy(ctx, client, "default"); err != nil {
+		e.t.Fatalf("WatchPolicy: %v", err)
+	}
+	return client
+}
+
+// policyStatus returns the status written to the UPSPolicy
+func policyStatus(t *testing.T, client *dynamicfake.FakeDynamicClient) UPSPolicyStatus {
+	t.Helper()
+
+	obj, err := client.Resource(UPSPolicyResource).Get(context.Background(), "default", metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("failed to get UPSPolicy: %v", err)
+	}
+	var policy UPSPolicy
+	if err := runtime.DefaultUnstructuredConverter.FromUnstructured(obj.Object, &policy); err != nil {
+		t.Fatalf("failed to decode UPSPolicy: %v", err)
+	}
+	return policy.Status
+}
+
+func TestWatchPolicyAppliesSpec(t *testing.T) {
+	env := newTestEnv(t, testConfig(), clusterObjects()...)
+	client := env.watchPolicy(map[string]interface{}{"batteryDrainThreshold": int64(20)})
+
+	env.eventually("policy applied", func() bool {
+		env.drainer.mutex.RLock()
+		defer env.drainer.mutex.RUnlock()
+		return env.drainer.config.BatteryDrainThreshold == 20
+	})
+	env.eventually("observed generation reported", func() bool {
+		return policyStatus(t, client).ObservedGeneration == 1
+	})
+
+	// Below the environment's threshold but above the policy's
+	env.powerEvent("ONBATT", 30)
+	env.waitForDrained()
+	env.powerEvent("ONBATT", 15)
+	env.waitForDrained("worker-1", "worker-2")
+}
+
+func TestPolicyStatusReportsState(t *testing.T) {
+	env := newTestEnv(t, testConfig(), clusterObjects()...)
+	client := env.watchPolicy(map[string]interface{}{})
+
+	env.powerEvent("ONBATT", 30)
+	env.waitForDrained("worker-1", "worker-2")
+	// The next reading reports the drained nodes once the cache shows them
+	env.powerEvent("ONBATT", 29)
+	env.eventually("drain reported", func() bool {
+		status := policyStatus(t, client)
+		return status.ActiveStage == StageDrain && strings.Join(status.DrainedNodes, ",") == "worker-1,worker-2" &&
+			status.LastReading != nil && status.LastReading.BatteryLevel == 29
+	})
+
+	// An unchanged status is not passed on to be written again
+	env.eventually("status written", func() bool {
+		return len(env.drainer.policy.statuses) == 0
+	})
+	env.drainer.mutex.Lock()
+	env.drainer.reportPolicyStatus()
+	queued := len(env.drainer.policy.statuses)
+	env.drainer.mutex.Unlock()
+	if queued != 0 {
+		t.Errorf("unchanged status queued for writing")
+	}
+
+	env.powerEvent("ONLINE", 100)
+	env.waitForDrained()
+	env.powerEvent("ONLINE", 99)
+	env.eventually("recovery reported", func() bool {
+		status := policyStatus(t, client)
+		return status.ActiveStage == StageNormal && len(status.DrainedNodes) == 0
+	})
+}
@@ -0,0 +1,67 @@
+package nodedrainer
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+const (
+	// EvictOrderAnnotation overrides the eviction order of a pod. The value is
+	// an integer on the same scale as pod priority, lower values are evicted
+	// first; "never" opts the pod out of UPS eviction.
+	EvictOrderAnnotation = "ups.k8s.io/evict-order"
+	// EvictOrderNever opts a pod out of UPS eviction
+	EvictOrderNever = "never"
+)
+
+// evictionOrder returns the wave a pod is evicted in: its EvictOrderAnnotation
+// if set, its priority otherwise
+func evictionOrder(pod *corev1.Pod) int64 {
+	if value, ok := pod.Annotations[EvictOrderAnnotation]; ok {
+		if order, err := strconv.ParseInt(value, 10, 64); err == nil {
+			return order
+		}
+	}
+	if pod.Spec.Priority != nil {
+		return int64(*pod.Spec.Priority)
+	}
+	return 0
+}
+
+// evictionExempt reports why a pod must never be evicted by the drainer, or
+// "" if it may be. Callers must hold nd.mutex.
+func (nd *NodeDrainer) evictionExempt(pod *corev1.Pod) string {
+	if pod.Annotations[EvictOrderAnnotation] == EvictOrderNever {
+		return "opted out with " + EvictOrderAnnotation
+	}
+	if limit := nd.config.EvictionPriorityLimit; limit > 0 && pod.Spec.Priority != nil && int64(*pod.Spec.Priority) >= int64(limit) {
+		return fmt.Sprintf("priority %d at or above limit %d", *pod.Spec.Priority, limit)
+	}
+	return ""
+}
+
+// sortByEvictionOrder orders pods so that the first to be evicted come first
+func sortByEvictionOrder(pods []corev1.Pod) {
+	sort.SliceStable(pods, func(i, j int) bool {
+		return evictionOrder(&pods[i]) < evictionOrder(&pods[j])
+	})
+}
+
+// evictionWaves splits pods sorted by sortByEvictionOrder into groups of equal
+// eviction order. Each wave is drained before the next one starts, so
+// critical workloads keep running the longest.
+func evictionWaves(pods []corev1.Pod) [][]corev1.Pod {
+	var waves [][]corev1.Pod
+	for i := 0; i < len(pods); {
+		j := i + 1
+		for j < len(pods) && evictionOrder(&pods[j]) == evictionOrder(&pods[i]) {
+			j++
+		}
+		waves = append(waves, pods[i:j])
+		i = j
+	}
+	return waves
+}
@@ -0,0 +1,176 @@
+package nodedrainer
+
+import (
+	"encoding/json"
+	"log"
+	"sort"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+// Actions reported in the action log
+const (
+	ActionStage     = "stage"
+	ActionCordon    = "cordon"
+	ActionEvict     = "evict"
+	ActionDelete    = "delete"
+	ActionDrain     = "drain"
+	ActionUncordon  = "uncordon"
+	ActionScaleDown = "scale-down"
+	ActionRestore   = "restore"
+	ActionPowerOff  = "power-off"
+	ActionOverride  = "override"
+	ActionCapacity  = "capacity"
+)
+
+// Action is an entry of the action log published to ActionTopic
+type Action struct {
+	Time   time.Time `json:"time"`
+	Action string    `json:"action"`
+	// UPS is the UPS the action was taken for, if known
+	UPS     string `json:"ups,omitempty"`
+	Target  string `json:"target,omitempty"`
+	Message string `json:"message,omitempty"`
+	// Error is set when the action failed
+	Error string `json:"error,omitempty"`
+}
+
+// ControllerState is what the drainer publishes, retained, to StateTopic
+type ControllerState struct {
+	Updated time.Time `json:"updated"`
+	// Stage is the most severe stage of any UPS
+	Stage            Stage             `json:"stage"`
+	Stale            bool              `json:"stale"`
+	DryRun           bool              `json:"dryRun"`
+	UPS              []UPSSourceStatus `json:"ups"`
+	DrainedNodes     []string          `json:"drainedNodes"`
+	PendingEvictions []string          `json:"pendingEvictions"`
+	Overrides        []Override        `json:"overrides"`
+	LastAction       *Action           `json:"lastAction,omitempty"`
+	LastError        *Action           `json:"lastError,omitempty"`
+}
+
+// GetState returns the state the drainer publishes to StateTopic
+func (nd *NodeDrainer) GetState() *ControllerState {
+	nd.mutex.RLock()
+	defer nd.mutex.RUnlock()
+	return nd.controllerState()
+}
+
+// controllerState is GetState for callers already holding nd.mutex
+func (nd *NodeDrainer) controllerState() *ControllerState {
+	state := &ControllerState{
+		Updated:          time.Now(),
+		Stage:            StageNormal,
+		UPS:              []UPSSourceStatus{},
+		DrainedNodes:     []string{},
+		PendingEvictions: []string{},
+		Overrides:        []Override{},
+	}
+	if nd.config != nil {
+		state.DryRun = nd.config.DryRun
+	}
+
+	for _, ups := range nd.upsStates() {
+		if ups.Stage == StageDrain {
+			state.Stage = StageDrain
+		}
+		state.Stale = state.Stale || ups.Stale
+		state.UPS = append(state.UPS, newUPSSourceStatus(ups))
+	}
+
+	drained, err := nd.GetDrainedNodes()
+	if err != nil {
+		log.Printf("Failed to collect drained nodes for state: %v", err)
+	}
+	state.DrainedNodes = append(state.DrainedNodes, drained...)
+	state.Overrides = append(state.Overrides, nd.activeOverrides()...)
+
+	nd.actionsMutex.Lock()
+	for pod := range nd.pendingEvictions {
+		state.PendingEvictions = append(state.PendingEvictions, pod)
+	}
+	state.LastAction = nd.lastAction
+	state.LastError = nd.lastError
+	nd.actionsMutex.Unlock()
+	sort.Strings(state.PendingEvictions)
+
+	return state
+}
+
+// publishState publishes the drainer's state, retained, to StateTopic.
+// Callers must hold nd.mutex.
+func (nd *NodeDrainer) publishState() {
+	if nd.config == nil || nd.config.StateTopic == "" {
+		return
+	}
+	nd.publish(nd.config.StateTopic, true, nd.controllerState())
+}
+
+// recordAction remembers an action taken on the cluster, appends it to the
+// action log and publishes the resulting state. Callers must hold nd.mutex.
+func (nd *NodeDrainer) recordAction(action Action) {
+	nd.recordAuditedAction(action, nil)
+}
+
+// recordAuditedAction is recordAction adding the action to rec, or to the open
+// audit record of its UPS if rec is nil. Callers must hold nd.mutex.
+func (nd *NodeDrainer) recordAuditedAction(action Action, rec *AuditRecord) {
+	action.Time = time.Now()
+
+	nd.actionsMutex.Lock()
+	nd.lastAction = &action
+	if action.Error != "" {
+		nd.lastError = &action
+	}
+	nd.actionsMutex.Unlock()
+
+	nd.auditAction(&action, rec)
+	if nd.config.ActionTopic != "" {
+		nd.publish(nd.config.ActionTopic, false, &action)
+	}
+	nd.notifyAction(&action)
+	nd.publishState()
+}
+
+// evictionsPending marks pods as waiting to leave their node
+func (nd *NodeDrainer) evictionsPending(pods []corev1.Pod) {
+	nd.actionsMutex.Lock()
+	defer nd.actionsMutex.Unlock()
+
+	if nd.pendingEvictions == nil {
+		nd.pendingEvictions = make(map[string]bool)
+	}
+	for i := range pods {
+		nd.pendingEvictions[podKey(&pods[i])] = true
+	}
+}
+
+// evictionResolved removes a pod from the pending evictions once it is gone
+// or could not be drained
+func (nd *NodeDrainer) evictionResolved(pod *corev1.Pod) {
+	nd.actionsMutex.Lock()
+	defer nd.actionsMutex.Unlock()
+	delete(nd.pendingEvictions, podKey(pod))
+}
+
+// publish sends v as JSON to topic without waiting for the broker, as it
+// may be called from MQTT message handlers
+func (nd *NodeDrainer) publish(topic string, retained bool, v interface{}) {
+	if nd.mqttClient == nil {
+		return
+	}
+	payload, err := json.Marshal(v)
+	if err != nil {
+		log.Printf("Failed to encode message for %s: %v", topic, err)
+		return
+	}
+
+	token := nd.mqttClient.Publish(topic, nd.config.QoS, retained, payload)
+	go func() {
+		if token.Wait() && token.Error() != nil {
+			log.Printf("Failed to publish to %s: %v", topic, token.Error())
+		}
+	}()
+}
@@ -0,0 +1,103 @@
+package nodedrainer
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+// nextState waits for a state message matching condition
+func nextState(t *testing.T, messages <-chan []byte, condition func(*ControllerState) bool) *ControllerState {
+	t.Helper()
+
+	timeout := time.After(testTimeout)
+	for {
+		select {
+		case payload := <-messages:
+			var state ControllerState
+			if err := json.Unmarshal(payload, &state); err != nil {
+				t.Fatalf("invalid state message %s: %v", payload, err)
+			}
+			if condition(&state) {
+				return &state
+			}
+		case <-timeout:
+			t.Fatalf("timed out waiting for state message")
+		}
+	}
+}
+
+func TestStateIsPublished(t *testing.T) {
+	env := newTestEnv(t, testConfig(), clusterObjects()...)
+	states := env.subscribe(env.config.StateTopic)
+
+	// The state published on subscribing is retained
+	nextState(t, states, func(state *ControllerState) bool {
+		return state.Stage == StageNormal && len(state.DrainedNodes) == 0
+	})
+
+	env.powerEvent("ONBATT", 30)
+	env.waitForDrained("worker-1", "worker-2")
+
+	// Every reading republishes the state
+	env.powerEvent("ONBATT", 29)
+	state := nextState(t, states, func(state *ControllerState) bool {
+		return len(state.UPS) == 1 && state.UPS[0].LastReading != nil && state.UPS[0].LastReading.BatteryLevel == 29
+	})
+	if state.Stage != StageDrain || state.UPS[0].Stage != StageDrain {
+		t.Errorf("expected stage %s, got %+v", StageDrain, state)
+	}
+	if len(state.DrainedNodes) != 2 {
+		t.Errorf("expected two drained nodes, got %v", state.DrainedNodes)
+	}
+	if len(state.PendingEvictions) != 0 {
+		t.Errorf("expected no pending evictions after the drain, got %v", state.PendingEvictions)
+	}
+	if state.LastAction == nil {
+		t.Errorf("no last action in state")
+	}
+}
+
+func TestActionsArePublished(t *testing.T) {
+	env := newTestEnv(t, testConfig(), clusterObjects()...)
+	env.failEviction("app-2", apierrors.NewForbidden(schema.GroupResource{Resource: "pods"}, "app-2", nil))
+	actions := env.subscribe(env.config.ActionTopic)
+
+	env.powerEvent("ONBATT", 30)
+	env.waitForDrained("worker-1", "worker-2")
+
+	want := map[string]bool{
+		ActionStage + " ":                         true,
+		ActionCordon + " worker-1":                true,
+		ActionCordon + " worker-2":                true,
+		ActionEvict + " default/app-1":            true,
+		ActionDrain + " worker-1":                 true,
+		"error " + ActionEvict + " default/app-2": true,
+		"error " + ActionDrain + " worker-2":      true,
+	}
+	timeout := time.After(testTimeout)
+	for len(want) > 0 {
+		select {
+		case payload := <-actions:
+			var action Action
+			if err := json.Unmarshal(payload, &action); err != nil {
+				t.Fatalf("invalid action message %s: %v", payload, err)
+			}
+			key := action.Action + " " + action.Target
+			if action.Error != "" {
+				key = "error " + key
+			}
+			delete(want, key)
+		case <-timeout:
+			t.Fatalf("timed out waiting for actions %v", want)
+		}
+	}
+
+	state := env.drainer.GetState()
+	if state.LastError == nil || state.LastError.Target != "worker-2" && state.LastError.Target != "default/app-2" {
+		t.Errorf("expected the failed drain of worker-2 as last error, got %+v", state.LastError)
+	}
+}
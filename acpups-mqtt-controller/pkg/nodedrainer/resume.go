@@ -0,0 +1,165 @@
+package nodedrainer
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+const (
+	// DrainPhaseAnnotation tracks the progress of the drain of a node
+	// cordoned by us, so that a restarted controller can tell interrupted
+	// drains from completed ones
+	DrainPhaseAnnotation = "ups-drainer.k8s.io/drain-phase"
+	// DrainStartedAnnotation records when the drain of a node first started,
+	// in RFC 3339 format
+	DrainStartedAnnotation = "ups-drainer.k8s.io/drain-started-at"
+)
+
+// Drain phases
+const (
+	// DrainPhaseDraining is set when a node is cordoned, before its pods are evicted
+	DrainPhaseDraining = "draining"
+	// DrainPhaseDrained is set once every evictable pod left the node
+	DrainPhaseDrained = "drained"
+	// DrainPhaseIncomplete is set when a drain gave up on some pods
+	DrainPhaseIncomplete = "incomplete"
+)
+
+// AuditTriggerResume starts the audit record of drains resumed on startup
+const AuditTriggerResume = "resumed drain"
+
+// cordonedByUs reports whether node is cordoned and annotated by us
+func cordonedByUs(node *corev1.Node) bool {
+	return node.Spec.Unschedulable && node.Annotations[UPSDrainerAnnotation] == UPSDrainerValue
+}
+
+// resumeReason explains why node, cordoned by us, must be drained again, or
+// returns "" if it need not be: its drain was interrupted before it finished,
+// or evictable pods are running on it again. A drain that gave up on some
+// pods is retried once DrainTimeout passed, a cancelled one right away.
+// Callers must hold nd.mutex.
+func (nd *NodeDrainer) resumeReason(node *corev1.Node) string {
+	// Powered-off nodes cannot evict anything
+	if _, ok := node.Annotations[PoweredOffAnnotation]; ok {
+		return ""
+	}
+
+	nd.resultsMutex.Lock()
+	last := nd.drainResults[node.Name]
+	nd.resultsMutex.Unlock()
+	if last != nil && !last.Completed && !last.Cancelled && time.Since(last.Finished) < nd.config.DrainTimeout {
+		return ""
+	}
+
+	// Without a drain of its own, a node still draining was left behind by a
+	// previous run of the controller
+	if last == nil && node.Annotations[DrainPhaseAnnotation] == DrainPhaseDraining {
+		if started, err := time.Parse(time.RFC3339, node.Annotations[DrainStartedAnnotation]); err == nil {
+			return fmt.Sprintf("drain started %s ago was interrupted", time.Since(started).Round(time.Second))
+		}
+		return "drain was interrupted"
+	}
+
+	pods, _, err := nd.evictablePods(node)
+	if err != nil {
+		log.Printf("Failed to check pods left on node %s: %v", node.Name, err)
+		return ""
+	}
+	left := 0
+	for i := range pods {
+		// Pods already terminating are on their way out
+		if pods[i].DeletionTimestamp == nil {
+			left++
+		}
+	}
+	if left > 0 {
+		return fmt.Sprintf("%d evictable pods are running on it", left)
+	}
+	return ""
+}
+
+// drainPhasePatch returns the patch cordoning node for a drain and marking
+// it as draining, keeping the start time of a resumed drain
+func drainPhasePatch(node *corev1.Node, now time.Time) map[string]interface{} {
+	annotations := map[string]interface{}{
+		UPSDrainerAnnotation: UPSDrainerValue,
+		DrainPhaseAnnotation: DrainPhaseDraining,
+	}
+	if !cordonedByUs(node) || node.Annotations[DrainStartedAnnotation] == "" {
+		annotations[DrainStartedAnnotation] = now.UTC().Format(time.RFC3339)
+	}
+	patch := annotationPatch(annotations)
+	patch["spec"] = map[string]interface{}{"unschedulable": true}
+	return patch
+}
+
+// ResumeInterruptedDrains drains the nodes cordoned by us whose drain was
+// interrupted, e.g. by a restart of the controller, or that run evictable
+// pods again. It is called when the controller starts acting and waits for
+// the drains to finish or ctx to be cancelled; UPS readings are handled
+// meanwhile.
+func (nd *NodeDrainer) ResumeInterruptedDrains(ctx context.Context) error {
+	nd.mutex.Lock()
+	nodes, err := nd.listNodes(nil)
+	if err != nil {
+		nd.mutex.Unlock()
+		return err
+	}
+
+	bySource := make(map[string][]corev1.Node)
+	for i := range nodes {
+		node := &nodes[i]
+		if !cordonedByUs(node) || nd.isControlPlaneNode(node) || nd.nodeIgnored(node) != "" {
+			continue
+		}
+		reason := nd.resumeReason(node)
+		if reason == "" {
+			continue
+		}
+		if nd.config.DryRun {
+			log.Printf("[dry-run] Would resume drain of node %s: %s", node.Name, reason)
+			continue
+		}
+		log.Printf("Resuming drain of node %s: %s", node.Name, reason)
+
+		// Attribute the drain to the UPS powering the node when following several
+		source := ""
+		if isTopicPattern(nd.config.MQTTTopic) {
+			source = nd.nodeSource(node)
+		}
+		// A drain under way for the UPS covers the node already
+		if nd.source(source).drain != nil {
+			continue
+		}
+		bySource[source] = append(bySource[source], *node)
+	}
+
+	sources := make([]string, 0, len(bySource))
+	for source := range bySource {
+		sources = append(sources, source)
+	}
+	sort.Strings(sources)
+
+	runs := make([]*drainRun, 0, len(sources))
+	for _, source := range sources {
+		rec, _ := nd.auditStart(source, AuditTriggerResume, nil)
+		runs = append(runs, nd.startDrain(ctx, source, bySource[source], "resuming interrupted drain", rec))
+	}
+	nd.mutex.Unlock()
+
+	var failed []string
+	for _, run := range runs {
+		<-run.done
+		failed = append(failed, run.failed...)
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("failed to resume drain of nodes: %s", strings.Join(failed, ", "))
+	}
+	return nil
+}
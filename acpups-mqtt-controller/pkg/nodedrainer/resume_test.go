@@ -0,0 +1,127 @@
+package nodedrainer
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+const interruptedAt = "2025-09-15T12:00:00Z"
+
+// interruptedObjects returns the test cluster with worker-1 left cordoned in
+// the middle of a drain by a previous run
+func interruptedObjects() []runtime.Object {
+	objects := clusterObjects()
+	node := objects[0].(*corev1.Node)
+	node.Spec.Unschedulable = true
+	node.Annotations = map[string]string{
+		UPSDrainerAnnotation:   UPSDrainerValue,
+		DrainPhaseAnnotation:   DrainPhaseDraining,
+		DrainStartedAnnotation: interruptedAt,
+	}
+	return objects
+}
+
+func TestResumeInterruptedDrains(t *testing.T) {
+	env := newTestEnv(t, testConfig(), interruptedObjects()...)
+
+	if err := env.drainer.ResumeInterruptedDrains(context.Background()); err != nil {
+		t.Fatalf("ResumeInterruptedDrains: %v", err)
+	}
+	if env.podExists("default", "app-1") {
+		t.Errorf("pod app-1 left on the interrupted node was not evicted")
+	}
+	if !env.podExists("default", "app-2") {
+		t.Errorf("pod on worker-2 was evicted")
+	}
+	node := env.node("worker-1")
+	if phase := node.Annotations[DrainPhaseAnnotation]; phase != DrainPhaseDrained {
+		t.Errorf("drain phase = %q, want %q", phase, DrainPhaseDrained)
+	}
+	if started := node.Annotations[DrainStartedAnnotation]; started != interruptedAt {
+		t.Errorf("drain start = %q, want the original %q", started, interruptedAt)
+	}
+	if env.node("worker-2").Spec.Unschedulable {
+		t.Errorf("worker-2 was cordoned")
+	}
+
+	records := env.auditRecords()
+	if len(records) != 1 || records[0].Trigger != AuditTriggerResume || targets(records[0].Evictions) != "evict default/app-1" {
+		t.Errorf("unexpected audit records %+v", records)
+	}
+}
+
+func TestResumedDrainIsNotHeld(t *testing.T) {
+	config := testConfig()
+	config.MaxDrainPercent = 50
+	env := newTestEnv(t, config, interruptedObjects()...)
+
+	plan, err := env.drainer.PlanDrain(context.Background(), "", nil)
+	if err != nil {
+		t.Fatalf("PlanDrain: %v", err)
+	}
+	if len(plan.Drain) != 1 || plan.Drain[0].Node != "worker-1" {
+		t.Errorf("expected only worker-1 to be drained, got %+v", plan.Drain)
+	}
+	if len(plan.Capacity.Held) != 1 || plan.Capacity.Held[0].Node != "worker-2" {
+		t.Errorf("expected worker-2 to be held, got %+v", plan.Capacity.Held)
+	}
+}
+
+func TestDrainedNodesAreRevalidated(t *testing.T) {
+	env := newTestEnv(t, testConfig(), clusterObjects()...)
+
+	env.powerEvent("ONBATT", 30)
+	env.waitForDrained("worker-1", "worker-2")
+	node := env.node("worker-1")
+	if node.Annotations[DrainPhaseAnnotation] != DrainPhaseDrained || node.Annotations[DrainStartedAnnotation] == "" {
+		t.Errorf("unexpected drain annotations %v", node.Annotations)
+	}
+
+	// A pod turning up on a drained node is evicted with the next reading
+	pod := testPod("default", "app-3", "worker-1", "ReplicaSet")
+	if _, err := env.clientset.CoreV1().Pods("default").Create(context.Background(), pod, metav1.CreateOptions{}); err != nil {
+		t.Fatalf("failed to create pod: %v", err)
+	}
+	env.eventually("pod app-3 in cache", func() bool {
+		pods, err := env.drainer.podsOnNode("worker-1")
+		return err == nil && len(pods) == 2
+	})
+	env.powerEvent("ONBATT", 25)
+	env.eventually("pod app-3 evicted", func() bool { return !env.podExists("default", "app-3") })
+
+	env.powerEvent("ONLINE", 100)
+	env.waitForDrained()
+	env.eventually("drain annotations removed", func() bool {
+		annotations := env.node("worker-1").Annotations
+		_, phase := annotations[DrainPhaseAnnotation]
+		_, started := annotations[DrainStartedAnnotation]
+		return !phase && !started
+	})
+}
+
+func TestIncompleteDrainIsRetriedAfterTimeout(t *testing.T) {
+	config := testConfig()
+	config.DrainTimeout = time.Hour
+	env := newTestEnv(t, config, clusterObjects()...)
+	env.drainer.recordDrainResult(&DrainResult{Node: "worker-1", Started: time.Now(), Finished: time.Now()})
+
+	node := env.node("worker-1")
+	node.Spec.Unschedulable = true
+	node.Annotations = map[string]string{UPSDrainerAnnotation: UPSDrainerValue, DrainPhaseAnnotation: DrainPhaseIncomplete}
+	env.drainer.mutex.RLock()
+	defer env.drainer.mutex.RUnlock()
+	if reason := env.drainer.resumeReason(node); reason != "" {
+		t.Errorf("incomplete drain retried before the drain timeout: %s", reason)
+	}
+
+	finished := time.Now().Add(-2 * time.Hour)
+	env.drainer.recordDrainResult(&DrainResult{Node: "worker-1", Started: finished, Finished: finished})
+	if reason := env.drainer.resumeReason(node); reason != "1 evictable pods are running on it" {
+		t.Errorf("unexpected resume reason %q", reason)
+	}
+}
@@ -0,0 +1,49 @@
+package nodedrainer
+
+import (
+	"fmt"
+	"log"
+	"time"
+)
+
+// Runtime returns the estimated runtime left on battery, or 0 if the reading
+// does not report it
+func (s *UPSStatus) Runtime() time.Duration {
+	return time.Duration(s.TimeLeft * float64(time.Minute))
+}
+
+// trackOnBattery records when src went on battery: with the first ONBATT
+// reading after it was last online. Readings reporting neither, such as
+// COMMLOST, keep the current state. Callers must hold nd.mutex.
+func (nd *NodeDrainer) trackOnBattery(src *upsSource, status *UPSStatus, at time.Time) {
+	flags := status.Flags()
+	switch {
+	case flags.Has(FlagOnBattery) && src.onBatterySince.IsZero():
+		src.onBatterySince = at
+		log.Printf("%s on battery since %s", upsLabel(src.name), at.Format(time.RFC3339))
+	case flags.Has(FlagOnline) && !src.onBatterySince.IsZero():
+		log.Printf("%s back on mains power after %s on battery", upsLabel(src.name), at.Sub(src.onBatterySince).Round(time.Second))
+		src.onBatterySince = time.Time{}
+	}
+	nd.metrics.observeOnBattery(src.name, src.onBatterySince)
+}
+
+// onBatteryFor returns how long src has been on battery at now, 0 if it is not
+func (src *upsSource) onBatteryFor(now time.Time) time.Duration {
+	if src.onBatterySince.IsZero() {
+		return 0
+	}
+	return now.Sub(src.onBatterySince)
+}
+
+// runtimeTrigger returns why a reading taken onBattery into an outage calls
+// for a drain under MaxOnBattery or MinRuntime, or "" if it does not
+func (nd *NodeDrainer) runtimeTrigger(status *UPSStatus, onBattery time.Duration) string {
+	if runtime := status.Runtime(); nd.config.MinRuntime > 0 && runtime > 0 && runtime < nd.config.MinRuntime {
+		return fmt.Sprintf("estimated runtime %s below %s", runtime.Round(time.Second), nd.config.MinRuntime)
+	}
+	if nd.config.MaxOnBattery > 0 && onBattery > nd.config.MaxOnBattery {
+		return fmt.Sprintf("on battery for %s, longer than %s", onBattery.Round(time.Second), nd.config.MaxOnBattery)
+	}
+	return ""
+}
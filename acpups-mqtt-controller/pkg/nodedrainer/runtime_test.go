@@ -0,0 +1,74 @@
+package nodedrainer
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRuntimeTriggers(t *testing.T) {
+	config := testConfig()
+	config.MaxOnBattery = 15 * time.Minute
+	config.MinRuntime = 10 * time.Minute
+	nd := &NodeDrainer{config: config}
+
+	tests := []struct {
+		name      string
+		status    UPSStatus
+		onBattery time.Duration
+		want      Stage
+	}{
+		{"plenty of runtime", UPSStatus{Status: "ONBATT", BatteryLevel: 80, TimeLeft: 40}, time.Minute, ""},
+		{"runtime below minimum", UPSStatus{Status: "ONBATT", BatteryLevel: 80, TimeLeft: 9.5}, time.Minute, StageDrain},
+		{"runtime not reported", UPSStatus{Status: "ONBATT", BatteryLevel: 80}, time.Minute, ""},
+		{"long outage", UPSStatus{Status: "ONBATT", BatteryLevel: 80, TimeLeft: 40}, 16 * time.Minute, StageDrain},
+		{"online with low runtime", UPSStatus{Status: "ONLINE", BatteryLevel: 100, TimeLeft: 5}, 0, StageNormal},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if target, _ := nd.targetStage(&tt.status, tt.onBattery); target != tt.want {
+				t.Errorf("targetStage() = %q, want %q", target, tt.want)
+			}
+		})
+	}
+}
+
+func TestLowRuntimeDrains(t *testing.T) {
+	config := testConfig()
+	config.MinRuntime = 10 * time.Minute
+	env := newTestEnv(t, config, clusterObjects()...)
+
+	env.publish(config.MQTTTopic, UPSStatus{Timestamp: time.Now().UTC().Format(time.RFC3339Nano), BatteryLevel: 90, Status: "ONBATT", TimeLeft: 25})
+	env.waitForDrained()
+
+	env.publish(config.MQTTTopic, UPSStatus{Timestamp: time.Now().UTC().Format(time.RFC3339Nano), BatteryLevel: 85, Status: "ONBATT", TimeLeft: 8})
+	env.waitForDrained("worker-1", "worker-2")
+}
+
+func TestTimeOnBatteryDrains(t *testing.T) {
+	config := testConfig()
+	config.MaxOnBattery = 15 * time.Minute
+	config.StaleAfter = 0
+	env := newTestEnv(t, config, clusterObjects()...)
+
+	// The outage started with a reading taken 20 minutes ago, and has lasted
+	// too long by the time it is received
+	start := time.Now().Add(-20 * time.Minute).UTC()
+	env.publish(config.MQTTTopic, UPSStatus{Timestamp: start.Format(time.RFC3339Nano), BatteryLevel: 95, Status: "ONBATT"})
+	env.waitForDrained("worker-1", "worker-2")
+	if since := env.drainer.GetUPSStates()[0].OnBatterySince; !since.Equal(start) {
+		t.Errorf("on battery since %s, want %s", since, start)
+	}
+
+	// Later readings keep the start of the outage
+	env.powerEvent("ONBATT", 90)
+	if since := env.drainer.GetUPSStates()[0].OnBatterySince; !since.Equal(start) {
+		t.Errorf("on battery since %s after a second reading, want %s", since, start)
+	}
+
+	env.powerEvent("ONLINE", 100)
+	env.waitForDrained()
+	if since := env.drainer.GetUPSStates()[0].OnBatterySince; !since.IsZero() {
+		t.Errorf("still on battery since %s after power returned", since)
+	}
+}
@@ -0,0 +1,282 @@
+package nodedrainer
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"strconv"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+const (
+	// DrainModeEvict cordons the nodes of a failing UPS and evicts their pods
+	DrainModeEvict = "evict"
+	// DrainModeScaleDown scales selected workloads to zero instead of evicting
+	DrainModeScaleDown = "scale-down"
+
+	// OriginalReplicasAnnotation records the replica count of a scaled-down workload
+	OriginalReplicasAnnotation = "ups-drainer.k8s.io/original-replicas"
+	// ScaledDownForAnnotation names the UPS a workload was scaled down for
+	ScaledDownForAnnotation = "ups-drainer.k8s.io/scaled-down-for"
+)
+
+// workload is a Deployment or StatefulSet that can be scaled down
+type workload struct {
+	ref         corev1.ObjectReference
+	replicas    int32
+	annotations map[string]string
+	selector    *metav1.LabelSelector
+}
+
+func (w *workload) String() string {
+	return fmt.Sprintf("%s %s/%s", w.ref.Kind, w.ref.Namespace, w.ref.Name)
+}
+
+// protect applies the configured drain mode for the named UPS, attributing
+// its actions to rec. Callers must hold nd.mutex.
+func (nd *NodeDrainer) protect(source string, rec *AuditRecord) error {
+	if nd.config.DrainMode == DrainModeScaleDown {
+		return nd.scaleDownWorkloads(context.Background(), source)
+	}
+	return nd.ensureWorkerNodesDrained(source, rec)
+}
+
+// scaleDownWorkloads scales the workloads matching ScaleDownSelector to zero,
+// recording their replica counts for restoreWorkloads. Callers must hold nd.mutex.
+func (nd *NodeDrainer) scaleDownWorkloads(ctx context.Context, source string) error {
+	workloads, err := nd.scaleDownCandidates(ctx, source)
+	if err != nil {
+		return err
+	}
+
+	for _, w := range workloads {
+		annotations := map[string]interface{}{
+			OriginalReplicasAnnotation: strconv.Itoa(int(w.replicas)),
+		}
+		if source != "" {
+			annotations[ScaledDownForAnnotation] = source
+		}
+		patch := map[string]interface{}{
+			"metadata": map[string]interface{}{"annotations": annotations},
+			"spec":     map[string]interface{}{"replicas": 0},
+		}
+		if err := nd.patchWorkload(ctx, &w, patch); err != nil {
+			log.Printf("Failed to scale down %s: %v", w.String(), err)
+			nd.recordAction(Action{Action: ActionScaleDown, UPS: source, Target: w.String(), Error: err.Error()})
+			continue
+		}
+
+		log.Printf("Scaled down %s from %d replicas for %s", w.String(), w.replicas, upsLabel(source))
+		nd.recorder.Eventf(&w.ref, corev1.EventTypeNormal, EventReasonScaledDown, "Scaled down from %d replicas by UPS drainer: %s on battery", w.replicas, upsLabel(source))
+		nd.recordAction(Action{Action: ActionScaleDown, UPS: source, Target: w.String(), Message: fmt.Sprintf("scaled down from %d replicas", w.replicas)})
+	}
+
+	return nil
+}
+
+// scaleDownCandidates returns the running workloads matching ScaleDownSelector
+// that are not already scaled down by us. With several UPSes only workloads
+// with pods on nodes fed by the named UPS are returned. Callers must hold
+// nd.mutex.
+func (nd *NodeDrainer) scaleDownCandidates(ctx context.Context, source string) ([]workload, error) {
+	if nd.config.ScaleDownSelector == nil {
+		return nil, nil
+	}
+
+	workloads, err := nd.listWorkloads(ctx, nd.config.ScaleDownSelector.String())
+	if err != nil {
+		return nil, err
+	}
+
+	var pods []corev1.Pod
+	if source != "" {
+		if pods, err = nd.podsFedBy(source); err != nil {
+			return nil, err
+		}
+	}
+
+	var candidates []workload
+	for _, w := range workloads {
+		if _, scaled := w.annotations[OriginalReplicasAnnotation]; scaled || w.replicas == 0 {
+			continue
+		}
+		if source != "" && !w.runsAnyOf(pods) {
+			continue
+		}
+		candidates = append(candidates, w)
+	}
+	return candidates, nil
+}
+
+// podsFedBy returns the pods on the nodes fed by the named UPS. Callers must
+// hold nd.mutex.
+func (nd *NodeDrainer) podsFedBy(source string) ([]corev1.Pod, error) {
+	nodes, err := nd.listNodes(nil)
+	if err != nil {
+		return nil, err
+	}
+
+	var pods []corev1.Pod
+	for _, node := range nodes {
+		if !nd.fedBy(&node, source) {
+			continue
+		}
+		onNode, err := nd.podsOnNode(node.Name)
+		if err != nil {
+			return nil, err
+		}
+		pods = append(pods, onNode...)
+	}
+	return pods, nil
+}
+
+// runsAnyOf reports whether one of pods belongs to the workload, going by its
+// namespace and pod selector
+func (w *workload) runsAnyOf(pods []corev1.Pod) bool {
+	if w.selector == nil {
+		return false
+	}
+	selector, err := metav1.LabelSelectorAsSelector(w.selector)
+	if err != nil || selector.Empty() {
+		return false
+	}
+	for _, pod := range pods {
+		if pod.Namespace == w.ref.Namespace && selector.Matches(labels.Set(pod.Labels)) {
+			return true
+		}
+	}
+	return false
+}
+
+// restoreWorkloads scales the workloads scaled down for the named UPS back to
+// their original replica counts. Callers must hold nd.mutex.
+func (nd *NodeDrainer) restoreWorkloads(ctx context.Context, source string) error {
+	workloads, err := nd.scaledWorkloads(ctx, source)
+	if err != nil {
+		return err
+	}
+
+	for _, w := range workloads {
+		replicas, err := strconv.Atoi(w.annotations[OriginalReplicasAnnotation])
+		if err != nil {
+			log.Printf("Not restoring %s: invalid %s annotation %q", w.String(), OriginalReplicasAnnotation, w.annotations[OriginalReplicasAnnotation])
+			continue
+		}
+
+		patch := map[string]interface{}{
+			"metadata": map[string]interface{}{"annotations": map[string]interface{}{
+				OriginalReplicasAnnotation: nil,
+				ScaledDownForAnnotation:    nil,
+			}},
+			"spec": map[string]interface{}{"replicas": replicas},
+		}
+		if err := nd.patchWorkload(ctx, &w, patch); err != nil {
+			log.Printf("Failed to restore %s: %v", w.String(), err)
+			nd.recordAction(Action{Action: ActionRestore, UPS: source, Target: w.String(), Error: err.Error()})
+			continue
+		}
+
+		log.Printf("Restored %s to %d replicas", w.String(), replicas)
+		nd.recorder.Eventf(&w.ref, corev1.EventTypeNormal, EventReasonScaledUp, "Restored to %d replicas by UPS drainer: power restored", replicas)
+		nd.recordAction(Action{Action: ActionRestore, UPS: source, Target: w.String(), Message: fmt.Sprintf("restored to %d replicas", replicas)})
+	}
+
+	return nil
+}
+
+// scaledWorkloads returns the workloads we scaled down for the named UPS; ""
+// matches every UPS. The selector is not applied, so workloads are restored
+// even if it changed in the meantime.
+func (nd *NodeDrainer) scaledWorkloads(ctx context.Context, source string) ([]workload, error) {
+	workloads, err := nd.listWorkloads(ctx, "")
+	if err != nil {
+		return nil, err
+	}
+
+	var scaled []workload
+	for _, w := range workloads {
+		if _, ok := w.annotations[OriginalReplicasAnnotation]; !ok {
+			continue
+		}
+		if source != "" && w.annotations[ScaledDownForAnnotation] != source {
+			continue
+		}
+		scaled = append(scaled, w)
+	}
+	return scaled, nil
+}
+
+// listWorkloads lists the Deployments and StatefulSets in all namespaces
+// matching labelSelector
+func (nd *NodeDrainer) listWorkloads(ctx context.Context, labelSelector string) ([]workload, error) {
+	listOptions := metav1.ListOptions{LabelSelector: labelSelector}
+	var workloads []workload
+
+	deployments, err := nd.clientset.AppsV1().Deployments(metav1.NamespaceAll).List(ctx, listOptions)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list deployments: %w", err)
+	}
+	for _, d := range deployments.Items {
+		workloads = append(workloads, workload{
+			ref:         workloadRef("Deployment", &d.ObjectMeta),
+			replicas:    replicasOrDefault(d.Spec.Replicas),
+			annotations: d.Annotations,
+			selector:    d.Spec.Selector,
+		})
+	}
+
+	statefulSets, err := nd.clientset.AppsV1().StatefulSets(metav1.NamespaceAll).List(ctx, listOptions)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list statefulsets: %w", err)
+	}
+	for _, s := range statefulSets.Items {
+		workloads = append(workloads, workload{
+			ref:         workloadRef("StatefulSet", &s.ObjectMeta),
+			replicas:    replicasOrDefault(s.Spec.Replicas),
+			annotations: s.Annotations,
+			selector:    s.Spec.Selector,
+		})
+	}
+
+	return workloads, nil
+}
+
+func (nd *NodeDrainer) patchWorkload(ctx context.Context, w *workload, patch map[string]interface{}) error {
+	data, err := json.Marshal(patch)
+	if err != nil {
+		return err
+	}
+
+	switch w.ref.Kind {
+	case "Deployment":
+		_, err = nd.clientset.AppsV1().Deployments(w.ref.Namespace).Patch(ctx, w.ref.Name, types.MergePatchType, data, metav1.PatchOptions{})
+	case "StatefulSet":
+		_, err = nd.clientset.AppsV1().StatefulSets(w.ref.Namespace).Patch(ctx, w.ref.Name, types.MergePatchType, data, metav1.PatchOptions{})
+	default:
+		err = fmt.Errorf("unsupported workload kind %s", w.ref.Kind)
+	}
+	return err
+}
+
+func workloadRef(kind string, meta *metav1.ObjectMeta) corev1.ObjectReference {
+	return corev1.ObjectReference{
+		APIVersion: "apps/v1",
+		Kind:       kind,
+		Namespace:  meta.Namespace,
+		Name:       meta.Name,
+		UID:        meta.UID,
+	}
+}
+
+// replicasOrDefault returns the replica count of a spec, which defaults to 1
+func replicasOrDefault(replicas *int32) int32 {
+	if replicas == nil {
+		return 1
+	}
+	return *replicas
+}
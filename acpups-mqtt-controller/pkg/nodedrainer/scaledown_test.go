@@ -0,0 +1,62 @@
+package nodedrainer
+
+import (
+	"context"
+	"testing"
+
+	appsv1 "k8s.io/api/apps/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+)
+
+// testDeployment returns a Deployment labeled tier=optional whose pods are
+// labeled app=name
+func testDeployment(name string, replicas int32) *appsv1.Deployment {
+	return &appsv1.Deployment{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: name, Labels: map[string]string{"tier": "optional"}},
+		Spec: appsv1.DeploymentSpec{
+			Replicas: &replicas,
+			Selector: &metav1.LabelSelector{MatchLabels: map[string]string{"app": name}},
+		},
+	}
+}
+
+func TestScaleDownOnlyAffectsWorkloadsOnTheUPS(t *testing.T) {
+	config := testConfig()
+	config.MQTTTopic = "test/ups/+/status"
+	config.DrainMode = DrainModeScaleDown
+	config.ScaleDownSelector = labels.SelectorFromSet(labels.Set{"tier": "optional"})
+
+	webA := testPod("default", "web-a-1", "rack-a-1", "ReplicaSet")
+	webA.Labels = map[string]string{"app": "web-a"}
+	webB := testPod("default", "web-b-1", "rack-b-1", "ReplicaSet")
+	webB.Labels = map[string]string{"app": "web-b"}
+	env := newTestEnv(t, config,
+		testNode("rack-a-1", map[string]string{DefaultSourceLabel: "rack-a"}),
+		testNode("rack-b-1", map[string]string{DefaultSourceLabel: "rack-b"}),
+		testDeployment("web-a", 3), webA,
+		testDeployment("web-b", 2), webB,
+	)
+
+	env.publish("test/ups/rack-b/status", UPSStatus{BatteryLevel: 100, Status: "ONLINE"})
+	env.publish("test/ups/rack-a/status", UPSStatus{BatteryLevel: 30, Status: "ONBATT"})
+
+	deployment := func(name string) *appsv1.Deployment {
+		d, err := env.clientset.AppsV1().Deployments("default").Get(context.Background(), name, metav1.GetOptions{})
+		if err != nil {
+			t.Fatalf("failed to get deployment %s: %v", name, err)
+		}
+		return d
+	}
+	if d := deployment("web-a"); *d.Spec.Replicas != 0 || d.Annotations[ScaledDownForAnnotation] != "rack-a" {
+		t.Errorf("web-a on rack-a not scaled down for rack-a: replicas %d, annotations %v", *d.Spec.Replicas, d.Annotations)
+	}
+	if d := deployment("web-b"); *d.Spec.Replicas != 2 || d.Annotations[OriginalReplicasAnnotation] != "" {
+		t.Errorf("web-b on the healthy rack-b was scaled down: replicas %d, annotations %v", *d.Spec.Replicas, d.Annotations)
+	}
+
+	env.publish("test/ups/rack-a/status", UPSStatus{BatteryLevel: 100, Status: "ONLINE"})
+	if d := deployment("web-a"); *d.Spec.Replicas != 3 {
+		t.Errorf("web-a not restored to 3 replicas after recovery, has %d", *d.Spec.Replicas)
+	}
+}
@@ -0,0 +1,282 @@
+package nodedrainer
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const (
+	// PoweredOffAnnotation records when the controller powered off a node
+	PoweredOffAnnotation = "ups-drainer.k8s.io/powered-off-at"
+	// shutdownNodeLabel marks shutdown Jobs with the node they target
+	shutdownNodeLabel = "ups-drainer.k8s.io/node"
+
+	// ShutdownMethodJob powers nodes off with a privileged Job pinned to the node
+	ShutdownMethodJob = "job"
+	// ShutdownMethodWebhook powers nodes off by calling an HTTP endpoint
+	ShutdownMethodWebhook = "webhook"
+
+	// PowerOffAllowedAnnotation set to "true" on a pod that drains leave in
+	// place lets its node be powered off with the pod still running
+	PowerOffAllowedAnnotation = "ups.k8s.io/allow-power-off"
+)
+
+// shutdownCommand runs in the host's namespaces of the node being powered off
+var shutdownCommand = []string{"nsenter", "-t", "1", "-m", "-u", "-i", "-n", "-p", "--", "systemctl", "poweroff"}
+
+// shutdownDrainedNodes powers off every node on the named UPS that we drained
+// and that no longer runs pods a power-off would kill, see powerOffBlockers.
+// Callers must hold nd.mutex.
+func (nd *NodeDrainer) shutdownDrainedNodes(source string, status *UPSStatus) error {
+	ctx := context.Background()
+
+	nodes, err := nd.listNodes(nil)
+	if err != nil {
+		return err
+	}
+
+	for _, node := range nodes {
+		if node.Annotations[UPSDrainerAnnotation] != UPSDrainerValue || !nd.fedBy(&node, source) {
+			continue
+		}
+		if _, done := node.Annotations[PoweredOffAnnotation]; done {
+			continue
+		}
+		if reason := nd.nodeIgnored(&node); reason != "" {
+			log.Printf("Not powering off node %s: %s", node.Name, reason)
+			continue
+		}
+
+		blockers, err := nd.powerOffBlockers(&node)
+		if err != nil {
+			log.Printf("Failed to check whether node %s is drained: %v", node.Name, err)
+			continue
+		}
+		if len(blockers) > 0 {
+			log.Printf("Not powering off node %s: %d pods still running: %s", node.Name, len(blockers), strings.Join(blockers, ", "))
+			continue
+		}
+
+		log.Printf("Battery at %d%% (shutdown threshold: %d%%) - powering off node %s via %s",
+			status.BatteryLevel, nd.config.ShutdownThreshold, node.Name, nd.config.ShutdownMethod)
+		if err := nd.powerOffNode(ctx, &node, status); err != nil {
+			log.Printf("Failed to power off node %s: %v", node.Name, err)
+			nd.recordAction(Action{Action: ActionPowerOff, UPS: source, Target: node.Name, Error: err.Error()})
+			continue
+		}
+		nd.recorder.Eventf(&node, corev1.EventTypeNormal, EventReasonPoweringOff, "Powering off via %s: battery at %d%% (shutdown threshold: %d%%)",
+			nd.config.ShutdownMethod, status.BatteryLevel, nd.config.ShutdownThreshold)
+		nd.recordAction(Action{Action: ActionPowerOff, UPS: source, Target: node.Name, Message: fmt.Sprintf("powering off via %s at %d%% battery", nd.config.ShutdownMethod, status.BatteryLevel)})
+
+		patch := annotationPatch(map[string]interface{}{PoweredOffAnnotation: time.Now().UTC().Format(time.RFC3339)})
+		if err := nd.patchNode(ctx, node.Name, patch); err != nil {
+			log.Printf("Failed to record power-off of node %s: %v", node.Name, err)
+		}
+	}
+
+	return nil
+}
+
+// powerOffBlockers returns the pods still running on node that powering it off
+// would kill: not only those left to evict, but also those the drain filters
+// leave in place, such as pods opted out of eviction or with emptyDir data,
+// unless they carry PowerOffAllowedAnnotation. Completed, DaemonSet and static
+// pods do not count. Callers must hold nd.mutex.
+func (nd *NodeDrainer) powerOffBlockers(node *corev1.Node) ([]string, error) {
+	pods, err := nd.podsOnNode(node.Name)
+	if err != nil {
+		return nil, err
+	}
+
+	var blockers []string
+	for _, pod := range pods {
+		if pod.Status.Phase == corev1.PodSucceeded || pod.Status.Phase == corev1.PodFailed {
+			continue
+		}
+		if _, ok := pod.Annotations[mirrorPodAnnotation]; ok {
+			continue
+		}
+		if isDaemonSetPod(&pod) {
+			continue
+		}
+		if pod.Annotations[PowerOffAllowedAnnotation] == "true" {
+			continue
+		}
+		blockers = append(blockers, podKey(&pod))
+	}
+	return blockers, nil
+}
+
+func (nd *NodeDrainer) powerOffNode(ctx context.Context, node *corev1.Node, status *UPSStatus) error {
+	switch nd.config.ShutdownMethod {
+	case ShutdownMethodWebhook:
+		return nd.callShutdownWebhook(ctx, node, status)
+	case ShutdownMethodJob, "":
+		return nd.createShutdownJob(ctx, node)
+	default:
+		return fmt.Errorf("unknown shutdown method %q", nd.config.ShutdownMethod)
+	}
+}
+
+// createShutdownJob runs a privileged pod on the node that powers the host off
+func (nd *NodeDrainer) createShutdownJob(ctx context.Context, node *corev1.Node) error {
+	backoffLimit := int32(0)
+	ttl := int32(3600)
+	privileged := true
+
+	job := &batchv1.Job{
+		ObjectMeta: metav1.ObjectMeta{
+			GenerateName: "ups-poweroff-",
+			Namespace:    nd.config.ShutdownNamespace,
+			Labels: map[string]string{
+				"app.kubernetes.io/managed-by": UPSDrainerValue,
+				shutdownNodeLabel:              node.Name,
+			},
+		},
+		Spec: batchv1.JobSpec{
+			BackoffLimit:            &backoffLimit,
+			TTLSecondsAfterFinished: &ttl,
+			Template: corev1.PodTemplateSpec{
+				Spec: corev1.PodSpec{
+					// Bypass the scheduler, the node is cordoned
+					NodeName:      node.Name,
+					HostPID:       true,
+					RestartPolicy: corev1.RestartPolicyNever,
+					Tolerations: []corev1.Toleration{
+						{Operator: corev1.TolerationOpExists},
+					},
+					Containers: []corev1.Container{
+						{
+							Name:    "poweroff",
+							Image:   nd.config.ShutdownImage,
+							Command: shutdownCommand,
+							SecurityContext: &corev1.SecurityContext{
+								Privileged: &privileged,
+							},
+						},
+					},
+				},
+			},
+		},
+	}
+
+	created, err := nd.clientset.BatchV1().Jobs(job.Namespace).Create(ctx, job, metav1.CreateOptions{})
+	if err != nil {
+		return fmt.Errorf("failed to create shutdown job: %w", err)
+	}
+
+	log.Printf("Created shutdown job %s/%s for node %s", created.Namespace, created.Name, node.Name)
+	return nil
+}
+
+// callShutdownWebhook asks an external system (e.g. an IPMI/BMC gateway) to
+// power the node off. A {node} placeholder in the URL is replaced by the node name.
+func (nd *NodeDrainer) callShutdownWebhook(ctx context.Context, node *corev1.Node, status *UPSStatus) error {
+	endpoint := strings.ReplaceAll(nd.config.ShutdownWebhookURL, "{node}", url.PathEscape(node.Name))
+
+	body, err := json.Marshal(map[string]interface{}{
+		"node":          node.Name,
+		"action":        "poweroff",
+		"battery_level": status.BatteryLevel,
+	})
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("failed to build shutdown request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("shutdown webhook failed: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("shutdown webhook returned %s", resp.Status)
+	}
+
+	log.Printf("Shutdown webhook accepted power-off of node %s", node.Name)
+	return nil
+}
+
+// GetPoweredOffNodes returns the nodes powered off by the controller that have
+// not come back online yet
+func (nd *NodeDrainer) GetPoweredOffNodes() ([]string, error) {
+	nodes, err := nd.listNodes(nil)
+	if err != nil {
+		return nil, err
+	}
+
+	var poweredOff []string
+	for _, node := range nodes {
+		if _, exists := node.Annotations[PoweredOffAnnotation]; exists {
+			poweredOff = append(poweredOff, node.Name)
+		}
+	}
+	return poweredOff, nil
+}
+
+// reconcilePoweredOffNodes clears the power-off annotation from nodes that
+// have reported Ready since they were powered off, and logs the ones that
+// still need to be powered back on
+func (nd *NodeDrainer) reconcilePoweredOffNodes() error {
+	ctx := context.Background()
+
+	nodes, err := nd.listNodes(nil)
+	if err != nil {
+		return err
+	}
+
+	var pending []string
+	for _, node := range nodes {
+		value, exists := node.Annotations[PoweredOffAnnotation]
+		if !exists {
+			continue
+		}
+
+		poweredOffAt, err := time.Parse(time.RFC3339, value)
+		if err == nil && !nodeReadySince(&node, poweredOffAt) {
+			pending = append(pending, node.Name)
+			continue
+		}
+
+		if err := nd.patchNode(ctx, node.Name, annotationPatch(map[string]interface{}{PoweredOffAnnotation: nil})); err != nil {
+			log.Printf("Failed to clear power-off annotation from node %s: %v", node.Name, err)
+			continue
+		}
+		log.Printf("Node %s is back online after power-off", node.Name)
+	}
+
+	if len(pending) > 0 {
+		log.Printf("Nodes powered off by UPS drainer that need to be powered back on: %s", strings.Join(pending, ", "))
+	}
+	return nil
+}
+
+// nodeReadySince reports whether the node has posted a Ready heartbeat after t
+func nodeReadySince(node *corev1.Node, t time.Time) bool {
+	for _, condition := range node.Status.Conditions {
+		if condition.Type == corev1.NodeReady {
+			return condition.Status == corev1.ConditionTrue && condition.LastHeartbeatTime.After(t)
+		}
+	}
+	return false
+}
@@ -0,0 +1,31 @@
+package nodedrainer
+
+import (
+	"testing"
+)
+
+func TestPowerOffSparesNodesWithPodsLeftInPlace(t *testing.T) {
+	config := testConfig()
+	config.ShutdownThreshold = 20
+
+	// Both pods are opted out of eviction; only the one on worker-1 may be
+	// killed by a power-off
+	cache := testPod("default", "cache", "worker-1", "StatefulSet")
+	cache.Annotations = map[string]string{EvictOrderAnnotation: EvictOrderNever, PowerOffAllowedAnnotation: "true"}
+	db := testPod("default", "db", "worker-2", "StatefulSet")
+	db.Annotations = map[string]string{EvictOrderAnnotation: EvictOrderNever}
+	env := newTestEnv(t, config, append(clusterObjects(), cache, db)...)
+
+	env.powerEvent("ONBATT", 10)
+	env.waitForDrained("worker-1", "worker-2")
+
+	if _, ok := env.node("worker-1").Annotations[PoweredOffAnnotation]; !ok {
+		t.Errorf("worker-1 not powered off despite only DaemonSet and allowed pods left")
+	}
+	if _, ok := env.node("worker-2").Annotations[PoweredOffAnnotation]; ok {
+		t.Errorf("worker-2 powered off while running default/db, which was left in place")
+	}
+	if !env.podExists("default", "db") {
+		t.Errorf("pod opted out of eviction was removed")
+	}
+}
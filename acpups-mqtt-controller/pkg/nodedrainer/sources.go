@@ -0,0 +1,182 @@
+package nodedrainer
+
+import (
+	"sort"
+	"strings"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+// DefaultSourceLabel is the node label (or annotation) naming the UPS that powers a node
+const DefaultSourceLabel = "ups.k8s.io/source"
+
+// availabilitySuffix is appended to the status topic by the bridge for its
+// default availability topic
+const availabilitySuffix = "/availability"
+
+// upsSource tracks the readings and stage of a single UPS. With a plain MQTT
+// topic there is one source named "" that powers every selected node.
+type upsSource struct {
+	name string
+
+	lastStatus    *UPSStatus
+	lastReceived  time.Time
+	lastTimestamp time.Time
+	staleHandled  bool
+	offline       bool
+
+	stage      Stage
+	stageSince time.Time
+	pending    PendingTransition
+
+	// onBatterySince is when the UPS went on battery, zero while online
+	onBatterySince time.Time
+
+	// capacityReported is the last capacity safeguards outcome reported
+	// during the current stage, so repeated readings do not repeat it
+	capacityReported string
+
+	// drain is the drain of the UPS's nodes under way, nil if none
+	drain *drainRun
+}
+
+// UPSState is a snapshot of the state tracked for one UPS
+type UPSState struct {
+	// Name is the UPS name taken from the topic, empty with a single UPS
+	Name       string
+	LastStatus *UPSStatus
+	Received   time.Time
+	Stage      Stage
+	Pending    *PendingTransition
+	Stale      bool
+	// OnBatterySince is when the UPS went on battery, zero while online
+	OnBatterySince time.Time
+}
+
+// source returns the state of the named UPS, creating it on first use.
+// Callers must hold nd.mutex.
+func (nd *NodeDrainer) source(name string) *upsSource {
+	if src, ok := nd.sources[name]; ok {
+		return src
+	}
+	if nd.sources == nil {
+		nd.sources = make(map[string]*upsSource)
+	}
+	src := &upsSource{name: name, stage: StageNormal}
+	nd.sources[name] = src
+	nd.metrics.observeStage(name, src.stage, "")
+	return src
+}
+
+// GetUPSStates returns the state of every UPS heard from, ordered by name
+func (nd *NodeDrainer) GetUPSStates() []UPSState {
+	nd.mutex.RLock()
+	defer nd.mutex.RUnlock()
+	return nd.upsStates()
+}
+
+// upsStates is GetUPSStates for callers already holding nd.mutex
+func (nd *NodeDrainer) upsStates() []UPSState {
+	states := make([]UPSState, 0, len(nd.sources))
+	for _, src := range nd.sources {
+		state := UPSState{
+			Name:       src.name,
+			LastStatus: src.lastStatus,
+			Received:   src.lastReceived,
+			Stage:      src.stage,
+			Stale:      src.staleHandled,
+
+			OnBatterySince: src.onBatterySince,
+		}
+		if src.pending.Stage != "" && src.pending.Stage != src.stage {
+			pending := src.pending
+			state.Pending = &pending
+		}
+		states = append(states, state)
+	}
+	sort.Slice(states, func(i, j int) bool {
+		return states[i].Name < states[j].Name
+	})
+	return states
+}
+
+// sourceFromTopic extracts the UPS name from a topic received on a
+// subscription pattern: the levels matched by "+" (and "#") wildcards, joined
+// by "/". A pattern without wildcards yields "".
+func sourceFromTopic(pattern, topic string) string {
+	patternLevels := strings.Split(pattern, "/")
+	topicLevels := strings.Split(topic, "/")
+
+	var parts []string
+	for i, level := range patternLevels {
+		if i >= len(topicLevels) {
+			break
+		}
+		switch level {
+		case "+":
+			parts = append(parts, topicLevels[i])
+		case "#":
+			parts = append(parts, strings.Join(topicLevels[i:], "/"))
+			return strings.Join(parts, "/")
+		}
+	}
+	return strings.Join(parts, "/")
+}
+
+// isAvailabilityTopic reports whether topic carries a bridge's availability
+// rather than a UPS status: the configured availability topic, or the
+// bridge's default of the status topic followed by availabilitySuffix
+func isAvailabilityTopic(config *Config, topic string) bool {
+	if config.AvailabilityTopic != "" && topicMatches(config.AvailabilityTopic, topic) {
+		return true
+	}
+	return strings.HasSuffix(topic, availabilitySuffix)
+}
+
+// topicMatches reports whether topic matches the MQTT topic filter
+func topicMatches(filter, topic string) bool {
+	filterLevels := strings.Split(filter, "/")
+	topicLevels := strings.Split(topic, "/")
+	for i, level := range filterLevels {
+		if level == "#" {
+			return true
+		}
+		if i >= len(topicLevels) || (level != "+" && level != topicLevels[i]) {
+			return false
+		}
+	}
+	return len(filterLevels) == len(topicLevels)
+}
+
+// isTopicPattern reports whether topic subscribes to several UPSes
+func isTopicPattern(topic string) bool {
+	return strings.ContainsAny(topic, "+#")
+}
+
+// nodeSource returns the UPS a node declares through the source label, or
+// the source annotation, falling back to the configured default.
+// Callers must hold nd.mutex.
+func (nd *NodeDrainer) nodeSource(node *corev1.Node) string {
+	if source, ok := node.Labels[nd.config.SourceLabel]; ok {
+		return source
+	}
+	if source, ok := node.Annotations[nd.config.SourceLabel]; ok {
+		return source
+	}
+	return nd.config.DefaultSource
+}
+
+// fedBy reports whether node is powered by the named UPS. The single UPS of
+// a plain topic powers every node. Callers must hold nd.mutex.
+func (nd *NodeDrainer) fedBy(node *corev1.Node, source string) bool {
+	return source == "" || nd.nodeSource(node) == source
+}
+
+// upsLabel formats a UPS name for log messages
+func upsLabel(source string) string {
+	if source == "" {
+		return "UPS"
+	}
+	return "UPS " + source
+}
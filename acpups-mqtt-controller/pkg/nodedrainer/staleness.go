@@ -0,0 +1,193 @@
+package nodedrainer
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+const (
+	// StaleActionHold keeps the current stage while UPS data is stale
+	StaleActionHold = "hold"
+	// StaleActionDrain assumes the worst case and drains while UPS data is stale
+	StaleActionDrain = "drain"
+
+	// staleCheckInterval is how often the staleness watchdog runs
+	staleCheckInterval = 15 * time.Second
+)
+
+// Time parses the reading's timestamp. A missing timestamp yields the zero time.
+func (s *UPSStatus) Time() (time.Time, error) {
+	if s.Timestamp == "" {
+		return time.Time{}, nil
+	}
+	return time.Parse(time.RFC3339Nano, s.Timestamp)
+}
+
+// validateStatus checks a reading's timestamp against the receive time and
+// the last accepted reading of the same UPS. It returns a short reason label
+// and an error for readings that must be rejected. Callers must hold nd.mutex.
+func (nd *NodeDrainer) validateStatus(src *upsSource, status *UPSStatus, received time.Time) (string, error) {
+	ts, err := status.Time()
+	if err != nil {
+		return "invalid_timestamp", fmt.Errorf("invalid timestamp %q: %w", status.Timestamp, err)
+	}
+	if ts.IsZero() {
+		return "", nil
+	}
+
+	if ts.After(received.Add(nd.config.MaxClockSkew)) {
+		return "future", fmt.Errorf("timestamp %s is %s in the future", status.Timestamp, ts.Sub(received).Round(time.Second))
+	}
+	// An equal timestamp is a reading published again, e.g. redelivered
+	if ts.Before(src.lastTimestamp) {
+		return "out_of_order", fmt.Errorf("timestamp %s is before the last accepted %s", status.Timestamp, src.lastTimestamp.Format(time.RFC3339Nano))
+	}
+	if age := received.Sub(ts); nd.config.StaleAfter > 0 && age > nd.config.StaleAfter {
+		return "stale", fmt.Errorf("timestamp %s is %s old (stale after %s)", status.Timestamp, age.Round(time.Second), nd.config.StaleAfter)
+	}
+
+	return "", nil
+}
+
+// watchStaleness periodically applies the stale data policy while no fresh
+// UPS status arrives, and expires overrides
+func (nd *NodeDrainer) watchStaleness() {
+	ticker := time.NewTicker(staleCheckInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		nd.checkStaleness()
+		nd.expireOverrides()
+	}
+}
+
+// checkStaleness applies StaleAction to every UPS whose data is stale. With a
+// plain topic the single UPS is checked even before its first message; with a
+// topic pattern only UPSes heard from at least once are known.
+func (nd *NodeDrainer) checkStaleness() {
+	nd.mutex.Lock()
+	defer nd.mutex.Unlock()
+
+	if nd.config == nil {
+		return
+	}
+	if !isTopicPattern(nd.config.MQTTTopic) {
+		nd.source("")
+	}
+
+	handled := false
+	for _, src := range nd.sources {
+		if nd.checkSourceStaleness(src) {
+			handled = true
+		}
+	}
+	if handled {
+		nd.reportPolicyStatus()
+		nd.publishState()
+	}
+}
+
+// checkSourceStaleness applies StaleAction once per stale episode of src and
+// reports whether it did. An episode ends with the next accepted status
+// message of the UPS. Callers must hold nd.mutex.
+func (nd *NodeDrainer) checkSourceStaleness(src *upsSource) bool {
+	var since time.Duration
+	if !src.lastReceived.IsZero() {
+		since = time.Since(src.lastReceived)
+	} else if subscribed := nd.subscribedAt.Load(); subscribed != 0 {
+		since = time.Since(time.Unix(0, subscribed))
+	}
+	if !src.offline && (nd.config.StaleAfter <= 0 || since <= nd.config.StaleAfter) {
+		return false
+	}
+	if src.staleHandled {
+		return false
+	}
+	// Overrides decide the stage, stale or not; the stale action applies once they end
+	if nd.stageOverride(src.name) != nil {
+		return false
+	}
+	src.staleHandled = true
+
+	reason := fmt.Sprintf("No %s status message for %s", upsLabel(src.name), since.Round(time.Second))
+	if src.offline {
+		reason = fmt.Sprintf("Bridge of %s reported offline", upsLabel(src.name))
+	}
+
+	if nd.config.StaleAction != StaleActionDrain {
+		log.Printf("%s - holding current stage %s", reason, src.stage)
+		return true
+	}
+
+	log.Printf("%s - assuming the worst and protecting its worker nodes", reason)
+	nd.setStage(src, StageDrain)
+	if nd.config.DryRun {
+		log.Printf("[dry-run] Would protect worker nodes of %s (mode: %s) because its data is unavailable", upsLabel(src.name), nd.config.DrainMode)
+		return true
+	}
+	rec, _ := nd.auditStart(src.name, reason, src.lastStatus)
+	if err := nd.protect(src.name, rec); err != nil {
+		log.Printf("Failed to protect worker nodes: %v", err)
+	}
+	return true
+}
+
+// onAvailability handles the bridge's availability topic ("online"/"offline").
+// A topic pattern names the UPS the same way as the status topic pattern.
+func (nd *NodeDrainer) onAvailability(client mqtt.Client, msg mqtt.Message) {
+	var offline bool
+	switch payload := strings.ToLower(strings.TrimSpace(string(msg.Payload()))); payload {
+	case "offline":
+		log.Printf("UPS bridge reported offline on %s", msg.Topic())
+		offline = true
+	case "online":
+		log.Printf("UPS bridge reported online on %s", msg.Topic())
+	default:
+		log.Printf("Ignoring unknown availability payload %q on %s", payload, msg.Topic())
+		return
+	}
+
+	nd.mutex.Lock()
+	if source := sourceFromTopic(nd.config.AvailabilityTopic, msg.Topic()); source == "" && isTopicPattern(nd.config.MQTTTopic) {
+		// A single bridge publishing several UPSes
+		for _, src := range nd.sources {
+			src.offline = offline
+		}
+	} else {
+		nd.source(source).offline = offline
+	}
+	nd.updateBridgeOffline()
+	nd.mutex.Unlock()
+
+	if offline {
+		go nd.checkStaleness()
+	}
+}
+
+// markFresh ends a stale episode of src after an accepted status message.
+// Callers must hold nd.mutex.
+func (nd *NodeDrainer) markFresh(src *upsSource, ts time.Time) {
+	if src.staleHandled {
+		log.Printf("%s status messages resumed", upsLabel(src.name))
+	}
+	src.staleHandled = false
+	src.offline = false
+	nd.updateBridgeOffline()
+	if !ts.IsZero() {
+		src.lastTimestamp = ts
+	}
+}
+
+// updateBridgeOffline records whether any UPS bridge is offline for health
+// checks that cannot take nd.mutex. Callers must hold nd.mutex.
+func (nd *NodeDrainer) updateBridgeOffline() {
+	offline := false
+	for _, src := range nd.sources {
+		offline = offline || src.offline
+	}
+	nd.bridgeOffline.Store(offline)
+}
@@ -0,0 +1,100 @@
+package nodedrainer
+
+import (
+	"testing"
+	"time"
+)
+
+// goStale waits until the data of the configured UPS is older than
+// StaleAfter and runs the staleness watchdog
+func (e *testEnv) goStale() {
+	e.t.Helper()
+
+	time.Sleep(e.config.StaleAfter + testPollInterval)
+	e.drainer.checkStaleness()
+	e.waitForDrains()
+}
+
+// setAvailability publishes the bridge's availability, retained like the
+// bridge's last will
+func (e *testEnv) setAvailability(payload string) {
+	e.t.Helper()
+
+	if token := e.publisher.Publish(e.config.AvailabilityTopic, 1, true, payload); token.Wait() && token.Error() != nil {
+		e.t.Fatalf("failed to publish to %s: %v", e.config.AvailabilityTopic, token.Error())
+	}
+}
+
+func TestEqualTimestampsAccepted(t *testing.T) {
+	env := newTestEnv(t, testConfig(), clusterObjects()...)
+
+	timestamp := time.Now().UTC().Format(time.RFC3339Nano)
+	env.publish(env.config.MQTTTopic, UPSStatus{Timestamp: timestamp, BatteryLevel: 100, Status: "ONLINE"})
+	env.publish(env.config.MQTTTopic, UPSStatus{Timestamp: timestamp, BatteryLevel: 30, Status: "ONBATT"})
+	env.waitForDrained("worker-1", "worker-2")
+}
+
+func TestStaleActionDrain(t *testing.T) {
+	config := testConfig()
+	config.StaleAfter = 200 * time.Millisecond
+	config.StaleAction = StaleActionDrain
+	env := newTestEnv(t, config, clusterObjects()...)
+
+	env.powerEvent("ONLINE", 100)
+	env.goStale()
+	env.waitForDrained("worker-1", "worker-2")
+	if stage := env.drainer.GetUPSStates()[0].Stage; stage != StageDrain {
+		t.Errorf("expected stage %s while data is stale, got %s", StageDrain, stage)
+	}
+
+	// A fresh reading ends the episode
+	env.powerEvent("ONLINE", 100)
+	env.waitForDrained()
+}
+
+func TestStaleActionOncePerEpisode(t *testing.T) {
+	config := testConfig()
+	config.StaleAfter = 200 * time.Millisecond
+	config.StaleAction = StaleActionDrain
+	env := newTestEnv(t, config, clusterObjects()...)
+
+	env.powerEvent("ONLINE", 100)
+	env.goStale()
+	env.waitForDrained("worker-1", "worker-2")
+
+	// Nodes uncordoned by hand stay uncordoned while the data stays stale
+	if _, err := env.drainer.UncordonNodes("", nil); err != nil {
+		t.Fatalf("UncordonNodes: %v", err)
+	}
+	env.goStale()
+	env.waitForDrained()
+
+	// The next episode drains again
+	env.powerEvent("ONLINE", 100)
+	env.goStale()
+	env.waitForDrained("worker-1", "worker-2")
+}
+
+func TestBridgeOfflineAppliesStaleAction(t *testing.T) {
+	config := testConfig()
+	config.AvailabilityTopic = config.MQTTTopic + "/availability"
+	config.StaleAction = StaleActionDrain
+	env := newTestEnv(t, config, clusterObjects()...)
+
+	env.powerEvent("ONLINE", 100)
+	env.setAvailability("offline")
+	env.waitForDrained("worker-1", "worker-2")
+	if !env.drainer.bridgeOffline.Load() {
+		t.Errorf("bridge not marked offline")
+	}
+
+	// The bridge coming back keeps the stage until it sends a reading
+	env.setAvailability("online")
+	env.eventually("bridge online", func() bool {
+		return !env.drainer.bridgeOffline.Load()
+	})
+	env.waitForDrained("worker-1", "worker-2")
+
+	env.powerEvent("ONLINE", 100)
+	env.waitForDrained()
+}
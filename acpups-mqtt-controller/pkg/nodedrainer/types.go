@@ -1,35 +1,198 @@
 package nodedrainer
 
 import (
+	"errors"
+	"fmt"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"k8s.io/apimachinery/pkg/labels"
 	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/record"
 )
 
-// UPSStatus represents the structure of UPS status messages from MQTT
+// UPSStatus represents the structure of UPS status messages from MQTT. It is
+// decoded leniently from either payload version, see UnmarshalJSON.
 type UPSStatus struct {
 	Timestamp    string `json:"timestamp"`
 	BatteryLevel int    `json:"battery_level"`
 	InputVoltage int    `json:"input_voltage"`
 	Load         int    `json:"load"`
 	Status       string `json:"status"`
+	// TimeLeft is the estimated runtime on battery in minutes; 0 if not reported
+	TimeLeft float64 `json:"time_left,omitempty"`
 }
 
+// Stage describes which protective action the drainer currently has in effect
+type Stage string
+
+const (
+	// StageNormal means no nodes are held drained by the controller
+	StageNormal Stage = "Normal"
+	// StageDrain means worker nodes are being (or have been) drained
+	StageDrain Stage = "Drain"
+)
+
 // NodeDrainer manages Kubernetes node draining based on UPS status
 type NodeDrainer struct {
-	clientset  *kubernetes.Clientset
+	clientset  kubernetes.Interface
+	cache      *informerCache
 	mutex      sync.RWMutex
 	mqttClient mqtt.Client
-	lastStatus *UPSStatus
+	recorder   record.EventRecorder
 	config     *Config
+
+	// subscribeMutex serializes changes of the MQTT subscriptions and guards
+	// subscribed. It is not mutex, which the message handlers need while
+	// the client waits for an unsubscribe to be acknowledged.
+	subscribeMutex sync.Mutex
+	subscribed     []string
+
+	// sources holds the state of each UPS, keyed by name
+	sources map[string]*upsSource
+	// powerRisk holds the status and reason of the UPSPowerRisk condition
+	// last set on each node
+	powerRisk map[string]string
+
+	policy *policyBinding
+
+	audit auditLog
+
+	resultsMutex sync.Mutex
+	drainResults map[string]*DrainResult
+
+	// actionsMutex guards the state published to StateTopic that drains
+	// update concurrently
+	actionsMutex     sync.Mutex
+	lastAction       *Action
+	lastError        *Action
+	pendingEvictions map[string]bool
+
+	// Overrides from the command topic and the override ConfigMap
+	commandOverrides   []Override
+	configMapOverrides []Override
+	overridesChecked   time.Time
+
+	notifications notifications
+
+	leader atomic.Pointer[leaderInfo]
+
+	metrics      *metrics
+	active       atomic.Bool
+	subscribedAt atomic.Int64
+	lastMessage  atomic.Int64
+	staleAfter   atomic.Int64
+
+	watchdog      sync.Once
+	bridgeOffline atomic.Bool
 }
 
 // Config holds configuration options for the NodeDrainer
 type Config struct {
+	// MQTTTopic may contain "+" or "#" wildcards to follow several UPSes, the
+	// levels they match name the UPS
 	MQTTTopic             string
 	QoS                   byte
 	BatteryDrainThreshold int
+	// FlagActions maps apcupsd status flags to FlagActionDrain, FlagActionHold
+	// or FlagActionIgnore
+	FlagActions map[string]string
+	// MaxOnBattery drains once a UPS has been on battery for longer; 0 disables
+	MaxOnBattery time.Duration
+	// MinRuntime drains once the estimated runtime left falls below it; 0 disables
+	MinRuntime time.Duration
+	// NodeSelector limits draining to matching worker nodes; nil selects all
+	NodeSelector labels.Selector
+	// MaxDrainPercent caps the share of selected worker nodes drained at once
+	MaxDrainPercent int
+	// LastResortSelector selects worker nodes that are never drained, so that
+	// evicted pods have somewhere to go; nil selects none
+	LastResortSelector labels.Selector
+	// CapacityCheck is CapacityCheckOff, CapacityCheckWarn or CapacityCheckEnforce
+	CapacityCheck string
+	// SourceLabel is the node label or annotation naming the UPS powering the node
+	SourceLabel string
+	// DefaultSource is the UPS powering nodes without a SourceLabel
+	DefaultSource string
+	// StableFor is how long a new UPS state must persist before it is acted on
+	StableFor time.Duration
+	// StableMessages is how many consecutive messages must request a new state
+	StableMessages int
+	// BatteryUncordonThreshold is the battery level required before uncordoning
+	BatteryUncordonThreshold int
+	// MinDrainDuration is the minimum time between a drain and the following uncordon
+	MinDrainDuration time.Duration
+	// DryRun logs intended actions without modifying the cluster
+	DryRun bool
+	// StaleAfter is how long without a UPS status message before the drainer
+	// reports itself not ready; 0 disables the check
+	StaleAfter time.Duration
+	// StaleAction is StaleActionHold or StaleActionDrain, applied while UPS data is stale
+	StaleAction string
+	// AvailabilityTopic carries the bridge's "online"/"offline" state; empty disables
+	AvailabilityTopic string
+	// MaxClockSkew is how far in the future a reading's timestamp may be
+	MaxClockSkew time.Duration
+	// PlanTopic receives the planned actions in dry-run mode; empty disables publishing
+	PlanTopic string
+	// CommandTopic receives override commands; empty disables them
+	CommandTopic string
+	// StateTopic receives the drainer's state, retained; empty disables publishing
+	StateTopic string
+	// ActionTopic receives an entry for every action taken; empty disables publishing
+	ActionTopic string
+	// NotifyEvents limits notifications to these events; empty sends all
+	NotifyEvents []string
+	// NotifyTemplate is the text/template rendering notifications; empty uses
+	// DefaultNotifyTemplate
+	NotifyTemplate string
+	// NotifyRateLimit is the maximum number of notifications per minute; 0 is unlimited
+	NotifyRateLimit int
+	// DeadLetterTopic receives UPS status messages that could not be decoded;
+	// empty disables publishing
+	DeadLetterTopic string
+	// DrainTimeout bounds how long a node drain waits for pods to terminate
+	DrainTimeout time.Duration
+	// DeleteAfterTimeout deletes pods still present when DrainTimeout expires
+	DeleteAfterTimeout bool
+	// IncludeNamespaces limits eviction to these namespaces; empty includes all
+	IncludeNamespaces []string
+	// ExcludeNamespaces are never evicted from
+	ExcludeNamespaces []string
+	// PodSelector limits eviction to matching pods; nil selects all
+	PodSelector labels.Selector
+	// DeleteEmptyDirData evicts pods with emptyDir volumes, losing their data
+	DeleteEmptyDirData bool
+	// EvictHostPathPods evicts pods with hostPath volumes
+	EvictHostPathPods bool
+	// EvictUnmanagedPods evicts pods without an owner, which are not recreated
+	EvictUnmanagedPods bool
+	// DrainMode is DrainModeEvict or DrainModeScaleDown
+	DrainMode string
+	// ScaleDownSelector selects the Deployments and StatefulSets scaled to zero
+	// in DrainModeScaleDown; nil scales nothing
+	ScaleDownSelector labels.Selector
+	// EvictionPriorityLimit exempts pods at or above this priority from eviction; 0 disables
+	EvictionPriorityLimit int
+	// ShutdownThreshold powers off fully drained nodes below this battery level; 0 disables
+	ShutdownThreshold int
+	// ShutdownMethod is ShutdownMethodJob or ShutdownMethodWebhook
+	ShutdownMethod string
+	// ShutdownNamespace is where shutdown Jobs are created
+	ShutdownNamespace string
+	// ShutdownImage runs the shutdown Job; it needs nsenter
+	ShutdownImage string
+	// ShutdownWebhookURL is called for ShutdownMethodWebhook; {node} is replaced by the node name
+	ShutdownWebhookURL string
+	// AuditConfigMap is the ConfigMap keeping a record of each drain/uncordon
+	// cycle; empty disables the audit trail
+	AuditConfigMap string
+	// AuditNamespace is the namespace of AuditConfigMap
+	AuditNamespace string
+	// AuditMaxRecords is how many of the most recent cycles are kept
+	AuditMaxRecords int
 }
 
 // DefaultConfig returns the default configuration
@@ -38,5 +201,105 @@ func DefaultConfig() *Config {
 		MQTTTopic:             "ups/status",
 		QoS:                   0,
 		BatteryDrainThreshold: 50,
+		FlagActions:           MergeFlagActions(DefaultFlagActions, nil),
+		SourceLabel:           DefaultSourceLabel,
+		MaxDrainPercent:       100,
+		CapacityCheck:         CapacityCheckWarn,
+		DrainTimeout:          5 * time.Minute,
+		DrainMode:             DrainModeEvict,
+		ExcludeNamespaces:     append([]string(nil), DefaultExcludeNamespaces...),
+		EvictUnmanagedPods:    true,
+		StaleAfter:            5 * time.Minute,
+		StaleAction:           StaleActionHold,
+		MaxClockSkew:          time.Minute,
+		PlanTopic:             "ups-drainer/plan",
+		StateTopic:            "ups-drainer/state",
+		ActionTopic:           "ups-drainer/actions",
+		DeadLetterTopic:       "ups-drainer/dead-letter",
+		NotifyRateLimit:       10,
+		ShutdownMethod:        ShutdownMethodJob,
+		ShutdownNamespace:     "default",
+		ShutdownImage:         "alpine:3.20",
+		AuditConfigMap:        "k8s-ups-drainer-audit",
+		AuditNamespace:        "default",
+		AuditMaxRecords:       50,
+	}
+}
+
+// Validate reports settings that are out of range or contradict each other
+func (c *Config) Validate() error {
+	var errs []error
+	if c.MQTTTopic == "" {
+		errs = append(errs, fmt.Errorf("no MQTT topic set"))
+	}
+	if c.QoS > 2 {
+		errs = append(errs, fmt.Errorf("invalid qos %d: must be 0, 1 or 2", c.QoS))
+	}
+	if c.BatteryDrainThreshold < 1 || c.BatteryDrainThreshold > 100 {
+		errs = append(errs, fmt.Errorf("invalid battery drain threshold %d: must be between 1 and 100", c.BatteryDrainThreshold))
+	}
+	if c.BatteryUncordonThreshold < 0 || c.BatteryUncordonThreshold > 100 {
+		errs = append(errs, fmt.Errorf("invalid battery uncordon threshold %d: must be between 0 and 100", c.BatteryUncordonThreshold))
+	}
+	if c.StableMessages < 0 {
+		errs = append(errs, fmt.Errorf("invalid stable message count %d: must not be negative", c.StableMessages))
+	}
+	for _, d := range []struct {
+		name  string
+		value time.Duration
+	}{
+		{"stable duration", c.StableFor},
+		{"min drain duration", c.MinDrainDuration},
+		{"max time on battery", c.MaxOnBattery},
+		{"min runtime left", c.MinRuntime},
+		{"stale after duration", c.StaleAfter},
+	} {
+		if d.value < 0 {
+			errs = append(errs, fmt.Errorf("invalid %s %s: must not be negative", d.name, d.value))
+		}
+	}
+	if c.DrainTimeout <= 0 {
+		errs = append(errs, fmt.Errorf("invalid drain timeout %s: must be positive", c.DrainTimeout))
+	}
+	if c.EvictionPriorityLimit < 0 {
+		errs = append(errs, fmt.Errorf("invalid eviction priority limit %d: must not be negative", c.EvictionPriorityLimit))
+	}
+	if c.MaxDrainPercent < 1 || c.MaxDrainPercent > 100 {
+		errs = append(errs, fmt.Errorf("invalid max drain percentage %d: must be between 1 and 100", c.MaxDrainPercent))
+	}
+	if c.CapacityCheck != CapacityCheckOff && c.CapacityCheck != CapacityCheckWarn && c.CapacityCheck != CapacityCheckEnforce {
+		errs = append(errs, fmt.Errorf("invalid capacity check %q: must be %s, %s or %s", c.CapacityCheck, CapacityCheckOff, CapacityCheckWarn, CapacityCheckEnforce))
+	}
+	if err := validateFlagActions(c.FlagActions); err != nil {
+		errs = append(errs, err)
+	}
+	if c.DrainMode != DrainModeEvict && c.DrainMode != DrainModeScaleDown {
+		errs = append(errs, fmt.Errorf("invalid drain mode %q: must be %s or %s", c.DrainMode, DrainModeEvict, DrainModeScaleDown))
+	}
+	if c.DrainMode == DrainModeScaleDown && c.ScaleDownSelector == nil {
+		errs = append(errs, fmt.Errorf("drain mode %s without a scale-down selector does not protect anything", DrainModeScaleDown))
+	}
+	if c.StaleAction != StaleActionHold && c.StaleAction != StaleActionDrain {
+		errs = append(errs, fmt.Errorf("invalid stale action %q: must be %s or %s", c.StaleAction, StaleActionHold, StaleActionDrain))
+	}
+	if c.ShutdownThreshold < 0 || c.ShutdownThreshold > 100 {
+		errs = append(errs, fmt.Errorf("invalid shutdown threshold %d: must be between 0 and 100", c.ShutdownThreshold))
+	}
+	if c.ShutdownThreshold > 0 {
+		if c.ShutdownMethod != ShutdownMethodJob && c.ShutdownMethod != ShutdownMethodWebhook {
+			errs = append(errs, fmt.Errorf("invalid shutdown method %q: must be %s or %s", c.ShutdownMethod, ShutdownMethodJob, ShutdownMethodWebhook))
+		}
+		if c.ShutdownMethod == ShutdownMethodWebhook && c.ShutdownWebhookURL == "" {
+			errs = append(errs, fmt.Errorf("shutdown method %s requires a webhook URL", ShutdownMethodWebhook))
+		}
+	}
+	if c.AuditConfigMap != "" && c.AuditMaxRecords < 1 {
+		errs = append(errs, fmt.Errorf("invalid audit record limit %d: must be at least 1", c.AuditMaxRecords))
+	}
+	if c.NotifyTemplate != "" {
+		if _, err := ParseNotifyTemplate(c.NotifyTemplate); err != nil {
+			errs = append(errs, fmt.Errorf("invalid notification template: %w", err))
+		}
 	}
+	return errors.Join(errs...)
 }
@@ -0,0 +1,50 @@
+package nodedrainer
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestConfigValidate(t *testing.T) {
+	if err := DefaultConfig().Validate(); err != nil {
+		t.Errorf("default configuration is invalid: %v", err)
+	}
+
+	tests := []struct {
+		name   string
+		modify func(c *Config)
+		err    string
+	}{
+		{"threshold", func(c *Config) { c.BatteryDrainThreshold = 0 }, "battery drain threshold"},
+		{"flag action", func(c *Config) { c.FlagActions = map[string]string{FlagCommLost: "panic"} }, "invalid action"},
+		{"scale-down without selector", func(c *Config) { c.DrainMode = DrainModeScaleDown }, "scale-down selector"},
+		{"shutdown method", func(c *Config) { c.ShutdownThreshold = 20; c.ShutdownMethod = "ssh" }, "shutdown method"},
+		{"shutdown webhook", func(c *Config) { c.ShutdownThreshold = 20; c.ShutdownMethod = ShutdownMethodWebhook }, "webhook URL"},
+		{"template", func(c *Config) { c.NotifyTemplate = "{{.Event" }, "notification template"},
+		{"max drain percent", func(c *Config) { c.MaxDrainPercent = 0 }, "max drain percentage"},
+		{"capacity check", func(c *Config) { c.CapacityCheck = "strict" }, "capacity check"},
+		{"audit records", func(c *Config) { c.AuditMaxRecords = 0 }, "audit record limit"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := DefaultConfig()
+			tt.modify(config)
+			if err := config.Validate(); err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("expected error containing %q, got %v", tt.err, err)
+			}
+		})
+	}
+}
+
+func TestDefaultConfigDoesNotShareDefaults(t *testing.T) {
+	config := DefaultConfig()
+	config.ExcludeNamespaces[0] = "changed"
+	config.FlagActions[FlagLowBattery] = FlagActionIgnore
+
+	if DefaultExcludeNamespaces[0] != "kube-system" || DefaultConfig().ExcludeNamespaces[0] != "kube-system" {
+		t.Errorf("changing a configuration changed the default excluded namespaces: %v", DefaultExcludeNamespaces)
+	}
+	if DefaultFlagActions[FlagLowBattery] != FlagActionDrain {
+		t.Errorf("changing a configuration changed the default flag actions: %v", DefaultFlagActions)
+	}
+}
@@ -19,14 +19,16 @@ type Config struct {
 }
 
 func loadConfig() *Config {
+	topic := getEnv("MQTT_TOPIC", "ups/status")
 	config := &Config{
 		ACPHost: getEnv("ACPHOST", "10.13.1.187:3551"),
 		MQTT: mqtt.Config{
-			Broker:   getEnv("MQTT_BROKER", "tcp://localhost:1883"),
-			Topic:    getEnv("MQTT_TOPIC", "ups/status"),
-			ClientID: getEnv("MQTT_CLIENT_ID", "acpups-client"),
-			User:     getEnv("MQTT_USER", ""),
-			Password: getEnv("MQTT_PASSWORD", ""),
+			Broker:            getEnv("MQTT_BROKER", "tcp://localhost:1883"),
+			Topic:             topic,
+			AvailabilityTopic: getEnv("MQTT_AVAILABILITY_TOPIC", topic+"/availability"),
+			ClientID:          getEnv("MQTT_CLIENT_ID", "acpups-client"),
+			User:              getEnv("MQTT_USER", ""),
+			Password:          getEnv("MQTT_PASSWORD", ""),
 		},
 		Interval: time.Duration(getEnvInt("POLL_INTERVAL", 30)) * time.Second,
 	}
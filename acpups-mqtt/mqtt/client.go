@@ -9,16 +9,18 @@ import (
 )
 
 type Config struct {
-	Broker   string
-	Topic    string
-	ClientID string
-	User     string
-	Password string
+	Broker            string
+	Topic             string
+	AvailabilityTopic string
+	ClientID          string
+	User              string
+	Password          string
 }
 
 type Client struct {
-	client mqtt.Client
-	topic  string
+	client            mqtt.Client
+	topic             string
+	availabilityTopic string
 }
 
 func NewClient(config *Config) *Client {
@@ -36,8 +38,16 @@ func NewClient(config *Config) *Client {
 
 	opts.SetCleanSession(true)
 	opts.SetAutoReconnect(true)
+
+	// Announce availability so subscribers can tell a dead bridge from a quiet UPS
+	if config.AvailabilityTopic != "" {
+		opts.SetWill(config.AvailabilityTopic, "offline", 1, true)
+	}
 	opts.SetOnConnectHandler(func(client mqtt.Client) {
 		log.Println("Connected to MQTT broker")
+		if config.AvailabilityTopic != "" {
+			client.Publish(config.AvailabilityTopic, 1, true, "online")
+		}
 	})
 	opts.SetConnectionLostHandler(func(client mqtt.Client, err error) {
 		log.Printf("MQTT connection lost: %v", err)
@@ -46,8 +56,9 @@ func NewClient(config *Config) *Client {
 	mqttClient := mqtt.NewClient(opts)
 
 	return &Client{
-		client: mqttClient,
-		topic:  config.Topic,
+		client:            mqttClient,
+		topic:             config.Topic,
+		availabilityTopic: config.AvailabilityTopic,
 	}
 }
 
@@ -59,6 +70,9 @@ func (c *Client) Connect() error {
 }
 
 func (c *Client) Disconnect() {
+	if c.availabilityTopic != "" {
+		c.client.Publish(c.availabilityTopic, 1, true, "offline").Wait()
+	}
 	c.client.Disconnect(250)
 }
 
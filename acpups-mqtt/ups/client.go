@@ -11,12 +11,17 @@ import (
 	"time"
 )
 
+// Data is the published UPS reading. k8s-ups-drainer decodes these fields
+// (see its payloadFields), so keep the JSON keys and units in step with it.
 type Data struct {
 	Timestamp    time.Time `json:"timestamp"`
 	BatteryLevel float64   `json:"battery_level"`
 	InputVoltage float64   `json:"input_voltage"`
 	Load         float64   `json:"load"`
 	Status       string    `json:"status"`
+	// TimeLeft is the estimated runtime on battery in minutes, nil if the
+	// UPS does not report it
+	TimeLeft *float64 `json:"time_left,omitempty"`
 }
 
 type Client struct {
@@ -151,6 +156,14 @@ func parseResponse(response string) (*Data, error) {
 			if val, err := strconv.ParseFloat(value, 64); err == nil {
 				data.Load = val
 			}
+		case "TIMELEFT":
+			// Estimated runtime on battery
+			if strings.HasSuffix(value, " Minutes") {
+				value = strings.TrimSuffix(value, " Minutes")
+			}
+			if val, err := strconv.ParseFloat(value, 64); err == nil {
+				data.TimeLeft = &val
+			}
 		case "STATUS":
 			// UPS status string
 			data.Status = value